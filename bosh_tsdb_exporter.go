@@ -1,16 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	"github.com/bosh-prometheus/bosh_tsdb_exporter/director"
 )
 
 var (
@@ -26,6 +30,274 @@ var (
 		"tsdb.listen-address", "Address to listen on for the TSDB collector ($BOSH_TSDB_EXPORTER_TSDB_LISTEN_ADDRESS)",
 	).Envar("BOSH_TSDB_EXPORTER_TSDB_LISTEN_ADDRESS").Default(":13321").String()
 
+	tsdbEnvironmentListenAddresses = kingpin.Flag(
+		"tsdb.environment-listen-address", "Additional `environment=address` to listen on for the TSDB collector, attaching its own environment label to the metrics received there (repeatable) ($BOSH_TSDB_EXPORTER_TSDB_ENVIRONMENT_LISTEN_ADDRESS)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_ENVIRONMENT_LISTEN_ADDRESS").StringMap()
+
+	tsdbAllowedNetworks = kingpin.Flag(
+		"tsdb.allowed-network", "CIDR network the TSDB listeners accept connections from, any network if not set (repeatable) ($BOSH_TSDB_EXPORTER_TSDB_ALLOWED_NETWORK)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_ALLOWED_NETWORK").Strings()
+
+	tsdbMaxConnections = kingpin.Flag(
+		"tsdb.max-connections", "Maximum number of concurrent connections of every TSDB listener, 0 for unlimited ($BOSH_TSDB_EXPORTER_TSDB_MAX_CONNECTIONS)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_MAX_CONNECTIONS").Default("0").Int()
+
+	tsdbRateLimitLinesPerSecond = kingpin.Flag(
+		"tsdb.rate-limit.lines-per-second", "Number of BOSH HM TSDB messages per second processed for every source address, messages above are discarded, 0 for unlimited ($BOSH_TSDB_EXPORTER_TSDB_RATE_LIMIT_LINES_PER_SECOND)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_RATE_LIMIT_LINES_PER_SECOND").Default("0").Float64()
+
+	tsdbRateLimitBurst = kingpin.Flag(
+		"tsdb.rate-limit.burst", "Number of BOSH HM TSDB messages a source address can send at once above the rate limit, the rate limit rounded up if 0 ($BOSH_TSDB_EXPORTER_TSDB_RATE_LIMIT_BURST)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_RATE_LIMIT_BURST").Default("0").Int()
+
+	tsdbIdleTimeout = kingpin.Flag(
+		"tsdb.idle-timeout", "How long a TSDB connection can stay without receiving anything before being closed, 0 to never close idle connections ($BOSH_TSDB_EXPORTER_TSDB_IDLE_TIMEOUT)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_IDLE_TIMEOUT").Default("0").Duration()
+
+	tsdbTLSCertFile = kingpin.Flag(
+		"tsdb.tls.cert_file", "Path to a file that contains the TLS certificate (PEM format) of the TSDB listeners, plaintext if empty ($BOSH_TSDB_EXPORTER_TSDB_TLS_CERTFILE)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_TLS_CERTFILE").ExistingFile()
+
+	tsdbTLSKeyFile = kingpin.Flag(
+		"tsdb.tls.key_file", "Path to a file that contains the TLS private key (PEM format) of the TSDB listeners ($BOSH_TSDB_EXPORTER_TSDB_TLS_KEYFILE)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_TLS_KEYFILE").ExistingFile()
+
+	tsdbTLSClientCAFile = kingpin.Flag(
+		"tsdb.tls.client_ca_file", "Path to a file that contains the CA certificates (PEM format) the TSDB listeners require client certificates to be signed by ($BOSH_TSDB_EXPORTER_TSDB_TLS_CLIENTCAFILE)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_TLS_CLIENTCAFILE").ExistingFile()
+
+	tsdbEnvironmentTag = kingpin.Flag(
+		"tsdb.environment-tag", "BOSH HM TSDB tag to take the environment label from, e.g. `director`, falling back to the listener environment when missing ($BOSH_TSDB_EXPORTER_TSDB_ENVIRONMENT_TAG)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_ENVIRONMENT_TAG").Default("").String()
+
+	tsdbEnvironmentNetworks = kingpin.Flag(
+		"tsdb.environment-network", "`CIDR=environment` to take the environment label from the BOSH HM address, falling back to the listener environment when no network matches (repeatable) ($BOSH_TSDB_EXPORTER_TSDB_ENVIRONMENT_NETWORK)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_ENVIRONMENT_NETWORK").StringMap()
+
+	tsdbEnvironments = kingpin.Flag(
+		"tsdb.environment", "Environment accepted from the `tsdb.environment-tag` tag besides the listener and `tsdb.environment-network` environments, other values falling back to the listener environment (repeatable) ($BOSH_TSDB_EXPORTER_TSDB_ENVIRONMENT)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_ENVIRONMENT").Strings()
+
+	tsdbHTTPListenAddress = kingpin.Flag(
+		"tsdb.http-listen-address", "Address to listen on for the OpenTSDB HTTP `/api/put` and the BOSH HM `/api/hm/events` endpoints, disabled if empty ($BOSH_TSDB_EXPORTER_TSDB_HTTP_LISTEN_ADDRESS)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_HTTP_LISTEN_ADDRESS").Default("").String()
+
+	tsdbMappingFile = kingpin.Flag(
+		"tsdb.mapping-file", "Path to a YAML or JSON file that maps BOSH HM TSDB metrics to Prometheus metrics, replacing the built-in mappings ($BOSH_TSDB_EXPORTER_TSDB_MAPPING_FILE)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_MAPPING_FILE").ExistingFile()
+
+	tsdbPassthrough = kingpin.Flag(
+		"tsdb.passthrough", "Export BOSH HM TSDB metrics without a mapping as generic gauges instead of discarding them ($BOSH_TSDB_EXPORTER_TSDB_PASSTHROUGH)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_PASSTHROUGH").Default("false").Bool()
+
+	tsdbPassthroughAllowRegex = kingpin.Flag(
+		"tsdb.passthrough.allow-regex", "Regular expression matching the BOSH HM TSDB metric names allowed in pass-through mode ($BOSH_TSDB_EXPORTER_TSDB_PASSTHROUGH_ALLOW_REGEX)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_PASSTHROUGH_ALLOW_REGEX").Default(".*").String()
+
+	tsdbPassthroughDenyRegex = kingpin.Flag(
+		"tsdb.passthrough.deny-regex", "Regular expression matching the BOSH HM TSDB metric names denied in pass-through mode ($BOSH_TSDB_EXPORTER_TSDB_PASSTHROUGH_DENY_REGEX)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_PASSTHROUGH_DENY_REGEX").Default("").String()
+
+	tsdbForwardTo = kingpin.Flag(
+		"tsdb.forward-to", "host:port of an OpenTSDB or another exporter to forward the BOSH HM TSDB messages to, can be repeated ($BOSH_TSDB_EXPORTER_TSDB_FORWARD_TO)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_FORWARD_TO").Strings()
+
+	tsdbForwardBufferSize = kingpin.Flag(
+		"tsdb.forward.buffer-size", "Number of BOSH HM TSDB messages buffered for every forward target before dropping them ($BOSH_TSDB_EXPORTER_TSDB_FORWARD_BUFFER_SIZE)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_FORWARD_BUFFER_SIZE").Default("10000").Int()
+
+	tsdbForwardAllowRegex = kingpin.Flag(
+		"tsdb.forward.allow-regex", "Regular expression matching the BOSH HM TSDB metric names forwarded ($BOSH_TSDB_EXPORTER_TSDB_FORWARD_ALLOW_REGEX)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_FORWARD_ALLOW_REGEX").Default("").String()
+
+	tsdbForwardDenyRegex = kingpin.Flag(
+		"tsdb.forward.deny-regex", "Regular expression matching the BOSH HM TSDB metric names not forwarded ($BOSH_TSDB_EXPORTER_TSDB_FORWARD_DENY_REGEX)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_FORWARD_DENY_REGEX").Default("").String()
+
+	tsdbSinkQueueSize = kingpin.Flag(
+		"tsdb.sink-queue-size", "Number of BOSH HM metrics queued for every forward target and exporter sink before dropping them ($BOSH_TSDB_EXPORTER_TSDB_SINK_QUEUE_SIZE)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_SINK_QUEUE_SIZE").Default("10000").Int()
+
+	tsdbMetricsTTL = kingpin.Flag(
+		"tsdb.metrics-ttl", "How long BOSH Job metrics are exported after their last update, 0 to never expire them ($BOSH_TSDB_EXPORTER_TSDB_METRICS_TTL)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_METRICS_TTL").Default("2m").Duration()
+
+	tsdbTimestampsMaxAge = kingpin.Flag(
+		"tsdb.timestamps.max-age", "Reject BOSH HM TSDB metrics with a timestamp older than this, 0 to accept any timestamp in the past ($BOSH_TSDB_EXPORTER_TSDB_TIMESTAMPS_MAX_AGE)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_TIMESTAMPS_MAX_AGE").Default("10m").Duration()
+
+	tsdbTimestampsMaxFuture = kingpin.Flag(
+		"tsdb.timestamps.max-future", "Reject BOSH HM TSDB metrics with a timestamp further than this in the future, 0 to accept any timestamp in the future ($BOSH_TSDB_EXPORTER_TSDB_TIMESTAMPS_MAX_FUTURE)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_TIMESTAMPS_MAX_FUTURE").Default("1m").Duration()
+
+	tsdbTimestampsExport = kingpin.Flag(
+		"tsdb.timestamps.export", "Expose BOSH Job metrics with the timestamp of the BOSH HM TSDB message instead of the scrape time ($BOSH_TSDB_EXPORTER_TSDB_TIMESTAMPS_EXPORT)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_TIMESTAMPS_EXPORT").Default("false").Bool()
+
+	tsdbHeartbeatInterval = kingpin.Flag(
+		"tsdb.heartbeat.interval", "Expected interval between two heartbeats of a BOSH Job ($BOSH_TSDB_EXPORTER_TSDB_HEARTBEAT_INTERVAL)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_HEARTBEAT_INTERVAL").Default("1m").Duration()
+
+	tsdbHeartbeatMaxMissed = kingpin.Flag(
+		"tsdb.heartbeat.max-missed", "Number of heartbeat intervals a BOSH Job can miss before being reported as missing, 0 to disable the detection ($BOSH_TSDB_EXPORTER_TSDB_HEARTBEAT_MAX_MISSED)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_HEARTBEAT_MAX_MISSED").Default("3").Int()
+
+	tsdbHeartbeatGracePeriod = kingpin.Flag(
+		"tsdb.heartbeat.grace-period", "How long a missing BOSH Job is reported before being forgotten ($BOSH_TSDB_EXPORTER_TSDB_HEARTBEAT_GRACE_PERIOD)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_HEARTBEAT_GRACE_PERIOD").Default("1h").Duration()
+
+	tsdbHeartbeatMarkUnhealthy = kingpin.Flag(
+		"tsdb.heartbeat.mark-unhealthy", "Also report missing BOSH Jobs as unhealthy ($BOSH_TSDB_EXPORTER_TSDB_HEARTBEAT_MARK_UNHEALTHY)",
+	).Envar("BOSH_TSDB_EXPORTER_TSDB_HEARTBEAT_MARK_UNHEALTHY").Default("false").Bool()
+
+	graphiteListenAddress = kingpin.Flag(
+		"graphite.listen-address", "Address to listen on for the BOSH HM Graphite plugin, disabled if empty ($BOSH_TSDB_EXPORTER_GRAPHITE_LISTEN_ADDRESS)",
+	).Envar("BOSH_TSDB_EXPORTER_GRAPHITE_LISTEN_ADDRESS").Default("").String()
+
+	graphiteTemplate = kingpin.Flag(
+		"graphite.template", "Template used to recover the BOSH Job identity and the metric name from the Graphite metric paths ($BOSH_TSDB_EXPORTER_GRAPHITE_TEMPLATE)",
+	).Envar("BOSH_TSDB_EXPORTER_GRAPHITE_TEMPLATE").Default(collectors.DefaultGraphiteTemplate).String()
+
+	hmJSONStdin = kingpin.Flag(
+		"hm.json-stdin", "Read the heartbeats and alerts written to stdin by the BOSH HM `json` plugin, exiting when stdin is closed ($BOSH_TSDB_EXPORTER_HM_JSON_STDIN)",
+	).Envar("BOSH_TSDB_EXPORTER_HM_JSON_STDIN").Default("false").Bool()
+
+	directorURL = kingpin.Flag(
+		"director.url", "BOSH Director URL to fetch the BOSH Job metadata from, disabled if empty ($BOSH_TSDB_EXPORTER_DIRECTOR_URL)",
+	).Envar("BOSH_TSDB_EXPORTER_DIRECTOR_URL").Default("").String()
+
+	directorUAAClientID = kingpin.Flag(
+		"director.uaa.client-id", "BOSH Director UAA Client ID, or username when the BOSH Director uses basic auth ($BOSH_TSDB_EXPORTER_DIRECTOR_UAA_CLIENT_ID)",
+	).Envar("BOSH_TSDB_EXPORTER_DIRECTOR_UAA_CLIENT_ID").String()
+
+	directorUAAClientSecret = kingpin.Flag(
+		"director.uaa.client-secret", "BOSH Director UAA Client Secret, or password when the BOSH Director uses basic auth ($BOSH_TSDB_EXPORTER_DIRECTOR_UAA_CLIENT_SECRET)",
+	).Envar("BOSH_TSDB_EXPORTER_DIRECTOR_UAA_CLIENT_SECRET").String()
+
+	directorCACertFile = kingpin.Flag(
+		"director.ca-cert-file", "Path to a file that contains the BOSH Director and UAA CA certificate (PEM format) ($BOSH_TSDB_EXPORTER_DIRECTOR_CA_CERT_FILE)",
+	).Envar("BOSH_TSDB_EXPORTER_DIRECTOR_CA_CERT_FILE").ExistingFile()
+
+	directorRefreshInterval = kingpin.Flag(
+		"director.refresh-interval", "How often the BOSH Job metadata is fetched from the BOSH Director ($BOSH_TSDB_EXPORTER_DIRECTOR_REFRESH_INTERVAL)",
+	).Envar("BOSH_TSDB_EXPORTER_DIRECTOR_REFRESH_INTERVAL").Default("5m").Duration()
+
+	sdTargetPort = kingpin.Flag(
+		"sd.target-port", "Port of the service discovery targets, e.g. the node_exporter port ($BOSH_TSDB_EXPORTER_SD_TARGET_PORT)",
+	).Envar("BOSH_TSDB_EXPORTER_SD_TARGET_PORT").Default("9100").Int()
+
+	sdBOSHDNSNetwork = kingpin.Flag(
+		"sd.bosh-dns-network", "BOSH network of the service discovery targets BOSH DNS names, used when the BOSH Director URL is not set ($BOSH_TSDB_EXPORTER_SD_BOSH_DNS_NETWORK)",
+	).Envar("BOSH_TSDB_EXPORTER_SD_BOSH_DNS_NETWORK").Default("default").String()
+
+	sdFile = kingpin.Flag(
+		"sd.file", "Path to a Prometheus file_sd JSON file to write the service discovery targets to, disabled if empty ($BOSH_TSDB_EXPORTER_SD_FILE)",
+	).Envar("BOSH_TSDB_EXPORTER_SD_FILE").Default("").String()
+
+	sdFileRefreshInterval = kingpin.Flag(
+		"sd.file-refresh-interval", "How often the service discovery file is written ($BOSH_TSDB_EXPORTER_SD_FILE_REFRESH_INTERVAL)",
+	).Envar("BOSH_TSDB_EXPORTER_SD_FILE_REFRESH_INTERVAL").Default("30s").Duration()
+
+	remoteWriteURL = kingpin.Flag(
+		"remote-write.url", "Prometheus remote write URL to push the metrics to, disabled if empty ($BOSH_TSDB_EXPORTER_REMOTE_WRITE_URL)",
+	).Envar("BOSH_TSDB_EXPORTER_REMOTE_WRITE_URL").Default("").String()
+
+	remoteWriteUsername = kingpin.Flag(
+		"remote-write.username", "Prometheus remote write basic auth username ($BOSH_TSDB_EXPORTER_REMOTE_WRITE_USERNAME)",
+	).Envar("BOSH_TSDB_EXPORTER_REMOTE_WRITE_USERNAME").Default("").String()
+
+	remoteWritePassword = kingpin.Flag(
+		"remote-write.password", "Prometheus remote write basic auth password ($BOSH_TSDB_EXPORTER_REMOTE_WRITE_PASSWORD)",
+	).Envar("BOSH_TSDB_EXPORTER_REMOTE_WRITE_PASSWORD").Default("").String()
+
+	remoteWriteBearerToken = kingpin.Flag(
+		"remote-write.bearer-token", "Prometheus remote write bearer token ($BOSH_TSDB_EXPORTER_REMOTE_WRITE_BEARER_TOKEN)",
+	).Envar("BOSH_TSDB_EXPORTER_REMOTE_WRITE_BEARER_TOKEN").Default("").String()
+
+	remoteWriteInterval = kingpin.Flag(
+		"remote-write.interval", "How often the metrics are pushed to the Prometheus remote write URL ($BOSH_TSDB_EXPORTER_REMOTE_WRITE_INTERVAL)",
+	).Envar("BOSH_TSDB_EXPORTER_REMOTE_WRITE_INTERVAL").Default("30s").Duration()
+
+	remoteWriteTimeout = kingpin.Flag(
+		"remote-write.timeout", "Timeout of the Prometheus remote write requests ($BOSH_TSDB_EXPORTER_REMOTE_WRITE_TIMEOUT)",
+	).Envar("BOSH_TSDB_EXPORTER_REMOTE_WRITE_TIMEOUT").Default("10s").Duration()
+
+	remoteWriteQueueSize = kingpin.Flag(
+		"remote-write.queue-size", "Number of Prometheus remote write requests queued while the URL is unavailable ($BOSH_TSDB_EXPORTER_REMOTE_WRITE_QUEUE_SIZE)",
+	).Envar("BOSH_TSDB_EXPORTER_REMOTE_WRITE_QUEUE_SIZE").Default("10").Int()
+
+	remoteWriteMaxRetries = kingpin.Flag(
+		"remote-write.max-retries", "Number of times a failed Prometheus remote write request is retried before being dropped ($BOSH_TSDB_EXPORTER_REMOTE_WRITE_MAX_RETRIES)",
+	).Envar("BOSH_TSDB_EXPORTER_REMOTE_WRITE_MAX_RETRIES").Default("3").Int()
+
+	pushgatewayURL = kingpin.Flag(
+		"pushgateway.url", "Prometheus Pushgateway URL to push the metrics to, disabled if empty ($BOSH_TSDB_EXPORTER_PUSHGATEWAY_URL)",
+	).Envar("BOSH_TSDB_EXPORTER_PUSHGATEWAY_URL").Default("").String()
+
+	pushgatewayJob = kingpin.Flag(
+		"pushgateway.job", "Job name of the metrics pushed to the Prometheus Pushgateway ($BOSH_TSDB_EXPORTER_PUSHGATEWAY_JOB)",
+	).Envar("BOSH_TSDB_EXPORTER_PUSHGATEWAY_JOB").Default("bosh_tsdb_exporter").String()
+
+	pushgatewayInterval = kingpin.Flag(
+		"pushgateway.interval", "How often the metrics are pushed to the Prometheus Pushgateway ($BOSH_TSDB_EXPORTER_PUSHGATEWAY_INTERVAL)",
+	).Envar("BOSH_TSDB_EXPORTER_PUSHGATEWAY_INTERVAL").Default("30s").Duration()
+
+	pushgatewayGroupByDeployment = kingpin.Flag(
+		"pushgateway.group-by-deployment", "Push the metrics of every BOSH deployment to its own Prometheus Pushgateway group ($BOSH_TSDB_EXPORTER_PUSHGATEWAY_GROUP_BY_DEPLOYMENT)",
+	).Envar("BOSH_TSDB_EXPORTER_PUSHGATEWAY_GROUP_BY_DEPLOYMENT").Default("false").Bool()
+
+	pushgatewayTimeout = kingpin.Flag(
+		"pushgateway.timeout", "Timeout of the Prometheus Pushgateway requests ($BOSH_TSDB_EXPORTER_PUSHGATEWAY_TIMEOUT)",
+	).Envar("BOSH_TSDB_EXPORTER_PUSHGATEWAY_TIMEOUT").Default("10s").Duration()
+
+	otlpURL = kingpin.Flag(
+		"otlp.url", "OpenTelemetry OTLP/HTTP metrics URL to push the BOSH HM metrics to, disabled if empty ($BOSH_TSDB_EXPORTER_OTLP_URL)",
+	).Envar("BOSH_TSDB_EXPORTER_OTLP_URL").Default("").String()
+
+	otlpEncoding = kingpin.Flag(
+		"otlp.encoding", "Encoding of the OpenTelemetry OTLP/HTTP requests, `protobuf` or `json` ($BOSH_TSDB_EXPORTER_OTLP_ENCODING)",
+	).Envar("BOSH_TSDB_EXPORTER_OTLP_ENCODING").Default("protobuf").String()
+
+	otlpHeaders = kingpin.Flag(
+		"otlp.header", "`name=value` header to add to the OpenTelemetry OTLP/HTTP requests (repeatable) ($BOSH_TSDB_EXPORTER_OTLP_HEADER)",
+	).Envar("BOSH_TSDB_EXPORTER_OTLP_HEADER").StringMap()
+
+	otlpInterval = kingpin.Flag(
+		"otlp.interval", "How often the BOSH HM metrics are pushed to the OpenTelemetry OTLP/HTTP URL ($BOSH_TSDB_EXPORTER_OTLP_INTERVAL)",
+	).Envar("BOSH_TSDB_EXPORTER_OTLP_INTERVAL").Default("30s").Duration()
+
+	otlpTimeout = kingpin.Flag(
+		"otlp.timeout", "Timeout of the OpenTelemetry OTLP/HTTP requests ($BOSH_TSDB_EXPORTER_OTLP_TIMEOUT)",
+	).Envar("BOSH_TSDB_EXPORTER_OTLP_TIMEOUT").Default("10s").Duration()
+
+	influxDBURL = kingpin.Flag(
+		"influxdb.url", "InfluxDB write URL to write the BOSH HM metrics to, disabled if empty ($BOSH_TSDB_EXPORTER_INFLUXDB_URL)",
+	).Envar("BOSH_TSDB_EXPORTER_INFLUXDB_URL").Default("").String()
+
+	influxDBUsername = kingpin.Flag(
+		"influxdb.username", "InfluxDB basic auth username ($BOSH_TSDB_EXPORTER_INFLUXDB_USERNAME)",
+	).Envar("BOSH_TSDB_EXPORTER_INFLUXDB_USERNAME").Default("").String()
+
+	influxDBPassword = kingpin.Flag(
+		"influxdb.password", "InfluxDB basic auth password ($BOSH_TSDB_EXPORTER_INFLUXDB_PASSWORD)",
+	).Envar("BOSH_TSDB_EXPORTER_INFLUXDB_PASSWORD").Default("").String()
+
+	influxDBToken = kingpin.Flag(
+		"influxdb.token", "InfluxDB v2 API token ($BOSH_TSDB_EXPORTER_INFLUXDB_TOKEN)",
+	).Envar("BOSH_TSDB_EXPORTER_INFLUXDB_TOKEN").Default("").String()
+
+	influxDBFlushInterval = kingpin.Flag(
+		"influxdb.flush-interval", "How often the BOSH HM metrics are written to InfluxDB ($BOSH_TSDB_EXPORTER_INFLUXDB_FLUSH_INTERVAL)",
+	).Envar("BOSH_TSDB_EXPORTER_INFLUXDB_FLUSH_INTERVAL").Default("10s").Duration()
+
+	influxDBTimeout = kingpin.Flag(
+		"influxdb.timeout", "Timeout of the InfluxDB write requests ($BOSH_TSDB_EXPORTER_INFLUXDB_TIMEOUT)",
+	).Envar("BOSH_TSDB_EXPORTER_INFLUXDB_TIMEOUT").Default("10s").Duration()
+
+	influxDBBufferSize = kingpin.Flag(
+		"influxdb.buffer-size", "Number of BOSH HM metrics buffered between two InfluxDB writes ($BOSH_TSDB_EXPORTER_INFLUXDB_BUFFER_SIZE)",
+	).Envar("BOSH_TSDB_EXPORTER_INFLUXDB_BUFFER_SIZE").Default("10000").Int()
+
 	listenAddress = kingpin.Flag(
 		"web.listen-address", "Address to listen on for web interface and telemetry ($BOSH_TSDB_EXPORTER_WEB_LISTEN_ADDRESS)",
 	).Envar("BOSH_TSDB_EXPORTER_WEB_LISTEN_ADDRESS").Default(":9194").String()
@@ -56,7 +328,7 @@ func init() {
 }
 
 type basicAuthHandler struct {
-	handler  http.HandlerFunc
+	handler  http.Handler
 	username string
 	password string
 }
@@ -69,16 +341,14 @@ func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
-	h.handler(w, r)
+	h.handler.ServeHTTP(w, r)
 	return
 }
 
-func prometheusHandler() http.Handler {
-	handler := prometheus.Handler()
-
+func authHandler(handler http.Handler) http.Handler {
 	if *authUsername != "" && *authPassword != "" {
 		handler = &basicAuthHandler{
-			handler:  prometheus.Handler().ServeHTTP,
+			handler:  handler,
 			username: *authUsername,
 			password: *authPassword,
 		}
@@ -87,6 +357,10 @@ func prometheusHandler() http.Handler {
 	return handler
 }
 
+func prometheusHandler() http.Handler {
+	return authHandler(promhttp.Handler())
+}
+
 func main() {
 	log.AddFlags(kingpin.CommandLine)
 	kingpin.Version(version.Print("bosh_tsdb_exporter"))
@@ -96,20 +370,365 @@ func main() {
 	log.Infoln("Starting bosh_tsdb_exporter", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
-	log.Infoln("TSDB listening on", *tsdbListenAddress)
-	tsdbListener, err := net.Listen("tcp", *tsdbListenAddress)
+	metricMappingsConfig := collectors.MetricMappingsConfig{Mappings: collectors.DefaultMetricMappings()}
+	if *tsdbMappingFile != "" {
+		log.Infoln("Loading TSDB metric mappings from", *tsdbMappingFile)
+		fileMetricMappingsConfig, err := collectors.LoadMetricMappingsFile(*tsdbMappingFile)
+		if err != nil {
+			log.Errorf("Could not load TSDB metric mappings: %v", err)
+			os.Exit(1)
+		}
+		metricMappingsConfig = fileMetricMappingsConfig
+	}
+
+	metricMapper, err := collectors.NewMetricMapper(metricMappingsConfig.Mappings, metricMappingsConfig.Tags)
 	if err != nil {
-		log.Errorf("Could not open TSDB listen address: %v", err)
+		log.Errorf("Invalid TSDB metric mappings: %v", err)
 		os.Exit(1)
 	}
+
+	var passthroughFilter *collectors.PassthroughFilter
+	if *tsdbPassthrough {
+		passthroughFilter, err = collectors.NewPassthroughFilter(*tsdbPassthroughAllowRegex, *tsdbPassthroughDenyRegex)
+		if err != nil {
+			log.Errorf("Invalid TSDB pass-through filter: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	allowedNetworks, err := collectors.ParseAllowedNetworks(*tsdbAllowedNetworks)
+	if err != nil {
+		log.Errorf("Invalid TSDB connection policy: %v", err)
+		os.Exit(1)
+	}
+	connectionPolicy := collectors.ConnectionPolicy{
+		AllowedNetworks: allowedNetworks,
+		MaxConnections:  *tsdbMaxConnections,
+		LinesPerSecond:  *tsdbRateLimitLinesPerSecond,
+		Burst:           *tsdbRateLimitBurst,
+		IdleTimeout:     *tsdbIdleTimeout,
+	}
+
+	// Keep the names of the exporter metrics, so pass-through metrics cannot
+	// collide with them.
+	registerer := collectors.NewReservedMetricNames(prometheus.DefaultRegisterer)
+
+	hmMetricBus := collectors.NewHMMetricBus(*metricsNamespace, *metricsEnvironment, *tsdbSinkQueueSize)
+	registerer.MustRegister(hmMetricBus)
+
+	for _, target := range *tsdbForwardTo {
+		tsdbForwarder, err := collectors.NewTSDBForwarder(
+			*metricsNamespace,
+			*metricsEnvironment,
+			target,
+			*tsdbForwardBufferSize,
+			*tsdbForwardAllowRegex,
+			*tsdbForwardDenyRegex,
+		)
+		if err != nil {
+			log.Errorf("Invalid TSDB forward target: %v", err)
+			os.Exit(1)
+		}
+		registerer.MustRegister(tsdbForwarder)
+		hmMetricBus.Subscribe(tsdbForwarder)
+	}
+
+	if *otlpURL != "" {
+		otlpExporter, err := collectors.NewOTLPExporter(
+			*metricsNamespace,
+			*metricsEnvironment,
+			collectors.OTLPConfig{
+				URL:      *otlpURL,
+				Encoding: *otlpEncoding,
+				Headers:  *otlpHeaders,
+				Timeout:  *otlpTimeout,
+			},
+		)
+		if err != nil {
+			log.Errorf("Invalid OTLP configuration: %v", err)
+			os.Exit(1)
+		}
+		registerer.MustRegister(otlpExporter)
+		hmMetricBus.Subscribe(otlpExporter)
+
+		log.Infoln("Pushing BOSH HM metrics to", *otlpURL)
+		go otlpExporter.PushLoop(*otlpInterval)
+	}
+
+	if *influxDBURL != "" {
+		influxDBWriter, err := collectors.NewInfluxDBWriter(
+			*metricsNamespace,
+			*metricsEnvironment,
+			metricMapper,
+			passthroughFilter,
+			collectors.InfluxDBConfig{
+				URL:        *influxDBURL,
+				Username:   *influxDBUsername,
+				Password:   *influxDBPassword,
+				Token:      *influxDBToken,
+				Timeout:    *influxDBTimeout,
+				BufferSize: *influxDBBufferSize,
+			},
+		)
+		if err != nil {
+			log.Errorf("Invalid InfluxDB configuration: %v", err)
+			os.Exit(1)
+		}
+		registerer.MustRegister(influxDBWriter)
+		hmMetricBus.Subscribe(influxDBWriter)
+
+		log.Infoln("Writing BOSH HM metrics to", *influxDBURL)
+		go influxDBWriter.FlushLoop(*influxDBFlushInterval)
+	}
+
+	newTSDBCollector := func(environment string) (*collectors.HMTSDBCollector, error) {
+		tsdbCollector := collectors.NewHMTSDBCollector(
+			*metricsNamespace,
+			environment,
+			collectors.HMTSDBCollectorConfig{
+				MetricMapper:      metricMapper,
+				PassthroughFilter: passthroughFilter,
+				MetricsTTL:        *tsdbMetricsTTL,
+				TimestampPolicy: collectors.TimestampPolicy{
+					MaxAge:    *tsdbTimestampsMaxAge,
+					MaxFuture: *tsdbTimestampsMaxFuture,
+					Export:    *tsdbTimestampsExport,
+				},
+				HeartbeatPolicy: collectors.HeartbeatPolicy{
+					Interval:      *tsdbHeartbeatInterval,
+					MaxMissed:     *tsdbHeartbeatMaxMissed,
+					GracePeriod:   *tsdbHeartbeatGracePeriod,
+					MarkUnhealthy: *tsdbHeartbeatMarkUnhealthy,
+				},
+				HMMetricBus:         hmMetricBus,
+				ReservedMetricNames: registerer,
+			},
+		)
+		if err := registerer.Register(tsdbCollector); err != nil {
+			return nil, err
+		}
+
+		return tsdbCollector, nil
+	}
+
+	var tsdbTLSConfig *tls.Config
+	if *tsdbTLSCertFile != "" || *tsdbTLSKeyFile != "" || *tsdbTLSClientCAFile != "" {
+		tsdbTLSConfig, err = collectors.NewTSDBTLSConfig(*tsdbTLSCertFile, *tsdbTLSKeyFile, *tsdbTLSClientCAFile)
+		if err != nil {
+			log.Errorf("Invalid TSDB TLS configuration: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var environmentResolver *collectors.EnvironmentResolver
+	if *tsdbEnvironmentTag != "" || len(*tsdbEnvironmentNetworks) > 0 {
+		environments := append([]string{*metricsEnvironment}, *tsdbEnvironments...)
+		for environment := range *tsdbEnvironmentListenAddresses {
+			environments = append(environments, environment)
+		}
+
+		environmentResolver, err = collectors.NewEnvironmentResolver(*tsdbEnvironmentTag, *tsdbEnvironmentNetworks, environments)
+		if err != nil {
+			log.Errorf("Invalid TSDB environment resolution: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	environmentRouter := collectors.NewEnvironmentRouter(environmentResolver, func(environment string) (*collectors.HMTSDBCollector, error) {
+		log.Infof("TSDB receiving metrics for environment `%s`", environment)
+		return newTSDBCollector(environment)
+	})
+
+	listenTSDBCollector := func(environment string, listenAddress string) (*collectors.HMTSDBCollector, *collectors.HMTSDBListener, net.Listener) {
+		log.Infof("TSDB listening on %s for environment `%s`", listenAddress, environment)
+		tsdbListener, err := net.Listen("tcp", listenAddress)
+		if err != nil {
+			log.Errorf("Could not open TSDB listen address: %v", err)
+			os.Exit(1)
+		}
+		if tsdbTLSConfig != nil {
+			tsdbListener = tls.NewListener(tsdbListener, tsdbTLSConfig)
+		}
+
+		tsdbCollector, err := newTSDBCollector(environment)
+		if err != nil {
+			log.Errorf("Could not register the TSDB collector of environment `%s`: %v", environment, err)
+			os.Exit(1)
+		}
+		environmentRouter.Add(tsdbCollector)
+
+		hmTSDBListener := collectors.NewHMTSDBListener(
+			*metricsNamespace,
+			environment,
+			collectors.HMTSDBListenerConfig{
+				ConnectionPolicy:  connectionPolicy,
+				HMMetricBus:       hmMetricBus,
+				EnvironmentRouter: environmentRouter,
+			},
+			tsdbCollector,
+			tsdbListener,
+		)
+		registerer.MustRegister(hmTSDBListener)
+
+		return tsdbCollector, hmTSDBListener, tsdbListener
+	}
+
+	tsdbCollector, hmTSDBListener, tsdbListener := listenTSDBCollector(*metricsEnvironment, *tsdbListenAddress)
 	defer tsdbListener.Close()
 
-	tsdbCollector := collectors.NewHMTSDBCollector(
-		*metricsNamespace,
-		*metricsEnvironment,
-		tsdbListener,
-	)
-	prometheus.MustRegister(tsdbCollector)
+	// Every environment gets its own collector, as the environment label is a
+	// constant label of the exported metrics.
+	for environment, listenAddress := range *tsdbEnvironmentListenAddresses {
+		if environment == "" || environment == *metricsEnvironment {
+			log.Errorf("Invalid TSDB environment `%s`: it must not be empty nor the metrics environment", environment)
+			os.Exit(1)
+		}
+
+		_, _, environmentTSDBListener := listenTSDBCollector(environment, listenAddress)
+		defer environmentTSDBListener.Close()
+	}
+
+	if *tsdbHTTPListenAddress != "" {
+		tsdbHTTPListener, err := net.Listen("tcp", *tsdbHTTPListenAddress)
+		if err != nil {
+			log.Errorf("Could not open TSDB HTTP listen address: %v", err)
+			os.Exit(1)
+		}
+		tsdbHTTPServer := collectors.NewTSDBHTTPServer(hmTSDBListener, tsdbTLSConfig)
+
+		log.Infoln("TSDB HTTP listening on", *tsdbHTTPListenAddress)
+		go func() {
+			log.Fatal(collectors.ServeTSDBHTTP(tsdbHTTPServer, hmTSDBListener.LimitListener(tsdbHTTPListener)))
+		}()
+	}
+
+	if *graphiteListenAddress != "" {
+		template, err := collectors.ParseGraphiteTemplate(*graphiteTemplate)
+		if err != nil {
+			log.Errorf("Invalid Graphite template: %v", err)
+			os.Exit(1)
+		}
+
+		log.Infoln("Graphite listening on", *graphiteListenAddress)
+		graphiteListener, err := net.Listen("tcp", *graphiteListenAddress)
+		if err != nil {
+			log.Errorf("Could not open Graphite listen address: %v", err)
+			os.Exit(1)
+		}
+		defer graphiteListener.Close()
+
+		graphiteCollector := collectors.NewHMGraphiteCollector(
+			*metricsNamespace,
+			*metricsEnvironment,
+			template,
+			hmTSDBListener,
+			graphiteListener,
+		)
+		registerer.MustRegister(graphiteCollector)
+	}
+
+	if *hmJSONStdin {
+		log.Infoln("Reading BOSH HM JSON messages from stdin")
+		jsonCollector := collectors.NewHMJSONCollector(
+			*metricsNamespace,
+			*metricsEnvironment,
+			hmTSDBListener,
+			os.Stdin,
+		)
+		registerer.MustRegister(jsonCollector)
+
+		go func() {
+			<-jsonCollector.Done()
+			log.Infoln("BOSH HM JSON stdin closed, exiting")
+			os.Exit(0)
+		}()
+	}
+
+	var directorCollector *collectors.DirectorCollector
+	if *directorURL != "" {
+		directorConfig := director.Config{
+			URL:          *directorURL,
+			ClientID:     *directorUAAClientID,
+			ClientSecret: *directorUAAClientSecret,
+		}
+		if *directorCACertFile != "" {
+			caCert, err := ioutil.ReadFile(*directorCACertFile)
+			if err != nil {
+				log.Errorf("Could not read BOSH Director CA certificate: %v", err)
+				os.Exit(1)
+			}
+			directorConfig.CACert = string(caCert)
+		}
+
+		directorClient, err := director.NewClient(directorConfig)
+		if err != nil {
+			log.Errorf("Invalid BOSH Director configuration: %v", err)
+			os.Exit(1)
+		}
+
+		log.Infoln("Fetching BOSH Job metadata from", *directorURL)
+		directorCollector = collectors.NewDirectorCollector(
+			*metricsNamespace,
+			*metricsEnvironment,
+			directorClient,
+			*directorRefreshInterval,
+			tsdbCollector,
+		)
+		registerer.MustRegister(directorCollector)
+	}
+
+	serviceDiscovery := collectors.NewServiceDiscovery(*sdTargetPort, *sdBOSHDNSNetwork, environmentRouter, directorCollector)
+	http.Handle("/sd", authHandler(serviceDiscovery))
+
+	if *sdFile != "" {
+		log.Infoln("Writing service discovery targets to", *sdFile)
+		go serviceDiscovery.WriteFileLoop(*sdFile, *sdFileRefreshInterval)
+	}
+
+	if *remoteWriteURL != "" {
+		remoteWriter, err := collectors.NewRemoteWriter(
+			*metricsNamespace,
+			*metricsEnvironment,
+			collectors.RemoteWriteConfig{
+				URL:         *remoteWriteURL,
+				Username:    *remoteWriteUsername,
+				Password:    *remoteWritePassword,
+				BearerToken: *remoteWriteBearerToken,
+				Timeout:     *remoteWriteTimeout,
+				QueueSize:   *remoteWriteQueueSize,
+				MaxRetries:  *remoteWriteMaxRetries,
+			},
+			prometheus.DefaultGatherer,
+		)
+		if err != nil {
+			log.Errorf("Invalid remote write configuration: %v", err)
+			os.Exit(1)
+		}
+		registerer.MustRegister(remoteWriter)
+
+		log.Infoln("Pushing metrics to", *remoteWriteURL)
+		go remoteWriter.PushLoop(*remoteWriteInterval)
+	}
+
+	if *pushgatewayURL != "" {
+		pushgatewayPusher, err := collectors.NewPushgatewayPusher(
+			*metricsNamespace,
+			*metricsEnvironment,
+			*pushgatewayURL,
+			*pushgatewayJob,
+			*pushgatewayGroupByDeployment,
+			*pushgatewayTimeout,
+			prometheus.DefaultGatherer,
+		)
+		if err != nil {
+			log.Errorf("Invalid Pushgateway configuration: %v", err)
+			os.Exit(1)
+		}
+		registerer.MustRegister(pushgatewayPusher)
+
+		log.Infoln("Pushing metrics to", *pushgatewayURL)
+		go pushgatewayPusher.PushLoop(*pushgatewayInterval)
+	}
 
 	handler := prometheusHandler()
 	http.Handle(*metricsPath, handler)
@@ -1,9 +1,13 @@
 package collectors_test
 
 import (
+	"net"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+
 	"testing"
 )
 
@@ -11,3 +15,21 @@ func TestCollectors(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Collectors Suite")
 }
+
+// newTestHMTSDBListener returns a HMTSDBListener listening on a random local
+// port and the HMTSDBCollector it publishes to, through the bus of the
+// collector config if any, with the default metric mappings when the config has
+// none.
+func newTestHMTSDBListener(namespace string, environment string, config HMTSDBCollectorConfig, listenerConfig HMTSDBListenerConfig) (*HMTSDBCollector, *HMTSDBListener, net.Listener) {
+	tsdbListener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+
+	if config.MetricMapper == nil {
+		config.MetricMapper, err = NewMetricMapper(DefaultMetricMappings(), nil)
+		Expect(err).ToNot(HaveOccurred())
+	}
+	listenerConfig.HMMetricBus = config.HMMetricBus
+
+	hmTSDBCollector := NewHMTSDBCollector(namespace, environment, config)
+	return hmTSDBCollector, NewHMTSDBListener(namespace, environment, listenerConfig, hmTSDBCollector, tsdbListener), tsdbListener
+}
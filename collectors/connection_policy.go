@@ -0,0 +1,202 @@
+package collectors
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConnectionPolicy limits the BOSH HM TSDB connections a HMTSDBListener
+// accepts and the rate of the messages it processes.
+type ConnectionPolicy struct {
+	AllowedNetworks []*net.IPNet
+	MaxConnections  int
+	LinesPerSecond  float64
+	Burst           int
+	IdleTimeout     time.Duration
+}
+
+// ParseAllowedNetworks parses a list of CIDR networks.
+func ParseAllowedNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network `%s`: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func (p ConnectionPolicy) allowed(ip net.IP) bool {
+	if len(p.AllowedNetworks) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p.AllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p ConnectionPolicy) burst() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+
+	return math.Ceil(p.LinesPerSecond)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	refs   int
+}
+
+type sourceLimiter struct {
+	rate    float64
+	burst   float64
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newSourceLimiter(rate float64, burst float64) *sourceLimiter {
+	return &sourceLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+func (l *sourceLimiter) acquire(source string) *tokenBucket {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, ok := l.buckets[source]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: time.Now()}
+		l.buckets[source] = bucket
+	}
+	bucket.refs++
+
+	return bucket
+}
+
+func (l *sourceLimiter) release(source string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, ok := l.buckets[source]
+	if !ok {
+		return
+	}
+	bucket.refs--
+	if bucket.refs <= 0 {
+		delete(l.buckets, source)
+	}
+}
+
+func (l *sourceLimiter) allow(bucket *tokenBucket, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
+
+func remoteIP(remoteAddr net.Addr) net.IP {
+	if remoteAddr == nil {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		host = remoteAddr.String()
+	}
+
+	return net.ParseIP(host)
+}
+
+type limitedListener struct {
+	net.Listener
+	hmTSDBListener *HMTSDBListener
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !l.hmTSDBListener.acceptHMConnection(conn) {
+			conn.Close()
+			continue
+		}
+
+		l.hmTSDBListener.totalTSDBConnectionsMetric.Inc()
+		l.hmTSDBListener.openTSDBConnectionsMetric.Inc()
+
+		// Holding the source for the connection lifetime keeps its rate
+		// limit across the requests sent on the connection.
+		_, releaseHMSource := l.hmTSDBListener.limitHMSource(conn.RemoteAddr())
+
+		return &limitedConn{
+			Conn:                         conn,
+			idleTimeout:                  l.hmTSDBListener.connectionPolicy.IdleTimeout,
+			totalReceivedTSDBBytesMetric: l.hmTSDBListener.totalReceivedTSDBBytesMetric,
+			release: func() {
+				releaseHMSource()
+				l.hmTSDBListener.openTSDBConnectionsMetric.Dec()
+				if l.hmTSDBListener.connections != nil {
+					<-l.hmTSDBListener.connections
+				}
+			},
+		}, nil
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	idleTimeout                  time.Duration
+	totalReceivedTSDBBytesMetric prometheus.Counter
+	release                      func()
+	released                     sync.Once
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.idleTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+
+	n, err := c.Conn.Read(p)
+	c.totalReceivedTSDBBytesMetric.Add(float64(n))
+
+	return n, err
+}
+
+func (c *limitedConn) Close() error {
+	c.released.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,313 @@
+package collectors_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("ParseAllowedNetworks", func() {
+	It("parses the networks", func() {
+		networks, err := ParseAllowedNetworks([]string{"10.0.0.0/8", "192.168.1.0/24"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(networks).To(HaveLen(2))
+		Expect(networks[1].String()).To(Equal("192.168.1.0/24"))
+	})
+
+	It("returns an error when a network is not valid", func() {
+		_, err := ParseAllowedNetworks([]string{"10.0.0.0"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("HMTSDBListener with a ConnectionPolicy", func() {
+	var (
+		err              error
+		namespace        string
+		environment      string
+		connectionPolicy ConnectionPolicy
+		tsdbListener     net.Listener
+		hmTSDBCollector  *HMTSDBCollector
+		hmTSDBListener   *HMTSDBListener
+
+		totalRejectedTSDBConnectionsMetric *prometheus.CounterVec
+		totalThrottledTSDBMessagesMetric   prometheus.Counter
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		connectionPolicy = ConnectionPolicy{}
+
+		totalRejectedTSDBConnectionsMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "rejected_tsdb_connections_total",
+				Help:      "Total number of BOSH HM TSDB rejected connections.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"reason"},
+		)
+
+		totalThrottledTSDBMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "throttled_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB messages discarded because their source exceeded the rate limit.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	JustBeforeEach(func() {
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener(namespace, environment, HMTSDBCollectorConfig{}, HMTSDBListenerConfig{ConnectionPolicy: connectionPolicy})
+	})
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", tsdbListener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+
+	put := func(conn net.Conn, id string) {
+		fmt.Fprintf(conn, "put system.healthy %d 1 deployment=fake-deployment job=fake-job index=0 id=%s\n", time.Now().Unix(), id)
+	}
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		hmTSDBListener.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	Describe("Describe", func() {
+		var descriptions chan *prometheus.Desc
+
+		JustBeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+			go hmTSDBListener.Describe(descriptions)
+		})
+
+		It("returns a rejected_tsdb_connections_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalRejectedTSDBConnectionsMetric.WithLabelValues("").Desc())))
+		})
+
+		It("returns a throttled_tsdb_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalThrottledTSDBMessagesMetric.Desc())))
+		})
+	})
+
+	Context("when the source is not in the allowed networks", func() {
+		BeforeEach(func() {
+			connectionPolicy.AllowedNetworks, err = ParseAllowedNetworks([]string{"192.0.2.0/24"})
+			Expect(err).ToNot(HaveOccurred())
+			totalRejectedTSDBConnectionsMetric.WithLabelValues("not_allowed").Inc()
+		})
+
+		It("rejects the connection", func() {
+			conn := dial()
+			defer conn.Close()
+			put(conn, "fake-id")
+
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalRejectedTSDBConnectionsMetric.WithLabelValues("not_allowed"))))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(BeEmpty())
+		})
+	})
+
+	Context("when the source is in the allowed networks", func() {
+		BeforeEach(func() {
+			connectionPolicy.AllowedNetworks, err = ParseAllowedNetworks([]string{"127.0.0.0/8"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("accepts the connection", func() {
+			conn := dial()
+			defer conn.Close()
+			put(conn, "fake-id")
+
+			Eventually(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(Equal([]string{"fake-id"}))
+		})
+	})
+
+	Context("when there are too many connections", func() {
+		BeforeEach(func() {
+			connectionPolicy.MaxConnections = 1
+			totalRejectedTSDBConnectionsMetric.WithLabelValues("too_many_connections").Inc()
+		})
+
+		It("rejects the connections above the limit", func() {
+			firstConn := dial()
+			defer firstConn.Close()
+			put(firstConn, "fake-id-1")
+			Eventually(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(Equal([]string{"fake-id-1"}))
+
+			secondConn := dial()
+			defer secondConn.Close()
+			put(secondConn, "fake-id-2")
+
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalRejectedTSDBConnectionsMetric.WithLabelValues("too_many_connections"))))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(Equal([]string{"fake-id-1"}))
+		})
+
+		It("accepts new connections once a connection is closed", func() {
+			firstConn := dial()
+			put(firstConn, "fake-id-1")
+			Eventually(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(Equal([]string{"fake-id-1"}))
+			firstConn.Close()
+
+			Eventually(func() []string {
+				conn := dial()
+				defer conn.Close()
+				put(conn, "fake-id-2")
+				time.Sleep(10 * time.Millisecond)
+				return jobInstanceIDsOf(hmTSDBCollector)
+			}).Should(Equal([]string{"fake-id-1", "fake-id-2"}))
+		})
+	})
+
+	Context("when the Graphite source is not in the allowed networks", func() {
+		var graphiteListener net.Listener
+
+		BeforeEach(func() {
+			connectionPolicy.AllowedNetworks, err = ParseAllowedNetworks([]string{"192.0.2.0/24"})
+			Expect(err).ToNot(HaveOccurred())
+			totalRejectedTSDBConnectionsMetric.WithLabelValues("not_allowed").Inc()
+		})
+
+		JustBeforeEach(func() {
+			graphiteListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			template, err := ParseGraphiteTemplate("bosh.<deployment>.<job>.<index>.<id>.<metric...>")
+			Expect(err).ToNot(HaveOccurred())
+			NewHMGraphiteCollector(namespace, environment, template, hmTSDBListener, graphiteListener)
+		})
+
+		AfterEach(func() {
+			graphiteListener.Close()
+		})
+
+		It("rejects the connection", func() {
+			conn, err := net.Dial("tcp", graphiteListener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			fmt.Fprintf(conn, "bosh.fake-deployment.fake-job.0.fake-id.system_healthy 1 %d\n", time.Now().Unix())
+
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalRejectedTSDBConnectionsMetric.WithLabelValues("not_allowed"))))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(BeEmpty())
+		})
+	})
+
+	Context("when the HTTP source is not in the allowed networks", func() {
+		var httpListener net.Listener
+
+		BeforeEach(func() {
+			connectionPolicy.AllowedNetworks, err = ParseAllowedNetworks([]string{"192.0.2.0/24"})
+			Expect(err).ToNot(HaveOccurred())
+			totalRejectedTSDBConnectionsMetric.WithLabelValues("not_allowed").Inc()
+		})
+
+		JustBeforeEach(func() {
+			httpListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			go ServeTSDBHTTP(NewTSDBHTTPServer(hmTSDBListener, nil), hmTSDBListener.LimitListener(httpListener))
+		})
+
+		AfterEach(func() {
+			httpListener.Close()
+		})
+
+		It("rejects the connection", func() {
+			body := fmt.Sprintf(`{"metric":"system.healthy","timestamp":%d,"value":1,"tags":{"deployment":"fake-deployment","job":"fake-job","index":"0","id":"fake-id"}}`, time.Now().Unix())
+			_, err := http.Post("http://"+httpListener.Addr().String()+"/api/put", "application/json", strings.NewReader(body))
+			Expect(err).To(HaveOccurred())
+
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalRejectedTSDBConnectionsMetric.WithLabelValues("not_allowed"))))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(BeEmpty())
+		})
+	})
+
+	Context("when an HTTP source exceeds the rate limit", func() {
+		BeforeEach(func() {
+			connectionPolicy.LinesPerSecond = 0.001
+			connectionPolicy.Burst = 2
+			totalThrottledTSDBMessagesMetric.Add(2)
+		})
+
+		It("fails the data points above the rate limit", func() {
+			dataPoints := []string{}
+			for _, id := range []string{"fake-id-1", "fake-id-2", "fake-id-3", "fake-id-4"} {
+				dataPoints = append(dataPoints, fmt.Sprintf(`{"metric":"system.healthy","timestamp":%d,"value":1,"tags":{"deployment":"fake-deployment","job":"fake-job","index":"0","id":"%s"}}`, time.Now().Unix(), id))
+			}
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/api/put?summary", strings.NewReader("["+strings.Join(dataPoints, ",")+"]"))
+			NewHMTSDBHTTPHandler(hmTSDBListener).ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(recorder.Body.String()).To(MatchJSON(`{"failed":2,"success":2}`))
+
+			Expect(collect()).To(ContainElement(PrometheusMetric(totalThrottledTSDBMessagesMetric)))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(Equal([]string{"fake-id-1", "fake-id-2"}))
+		})
+	})
+
+	Context("when a source exceeds the rate limit", func() {
+		BeforeEach(func() {
+			connectionPolicy.LinesPerSecond = 0.001
+			connectionPolicy.Burst = 2
+			totalThrottledTSDBMessagesMetric.Add(2)
+		})
+
+		It("discards the messages above the rate limit", func() {
+			conn := dial()
+			defer conn.Close()
+			for _, id := range []string{"fake-id-1", "fake-id-2", "fake-id-3", "fake-id-4"} {
+				put(conn, id)
+			}
+
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalThrottledTSDBMessagesMetric)))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(Equal([]string{"fake-id-1", "fake-id-2"}))
+		})
+
+		It("shares the rate limit between the connections of a source", func() {
+			firstConn := dial()
+			defer firstConn.Close()
+			put(firstConn, "fake-id-1")
+			put(firstConn, "fake-id-2")
+			Eventually(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(Equal([]string{"fake-id-1", "fake-id-2"}))
+
+			secondConn := dial()
+			defer secondConn.Close()
+			put(secondConn, "fake-id-3")
+			put(secondConn, "fake-id-4")
+
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalThrottledTSDBMessagesMetric)))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(Equal([]string{"fake-id-1", "fake-id-2"}))
+		})
+	})
+})
@@ -0,0 +1,326 @@
+package collectors
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/bosh-prometheus/bosh_tsdb_exporter/director"
+)
+
+// DirectorCollector periodically fetches the VMs and instances of every
+// deployment from the BOSH Director to export the metadata the BOSH HM metrics
+// do not carry and, when given the HMTSDBCollector, to reconcile the instances
+// the BOSH Director expects with the ones sending metrics.
+type DirectorCollector struct {
+	environment                              string
+	client                                   director.Client
+	refreshInterval                          time.Duration
+	hmTSDBCollector                          *HMTSDBCollector
+	vmsMutex                                 sync.Mutex
+	vms                                      map[string][]director.VM
+	instances                                map[string][]director.Instance
+	jobInfoDesc                              *prometheus.Desc
+	deploymentExpectedInstancesDesc          *prometheus.Desc
+	deploymentReportingInstancesDesc         *prometheus.Desc
+	jobReportingDesc                         *prometheus.Desc
+	totalDirectorRefreshErrorsMetric         prometheus.Counter
+	lastDirectorRefreshTimestampMetric       prometheus.Gauge
+	lastDirectorRefreshDurationSecondsMetric prometheus.Gauge
+}
+
+func NewDirectorCollector(
+	namespace string,
+	environment string,
+	client director.Client,
+	refreshInterval time.Duration,
+	hmTSDBCollector *HMTSDBCollector,
+) *DirectorCollector {
+	jobInfoDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "job", "info"),
+		"BOSH Job metadata from the BOSH Director (always 1).",
+		concatStrings(jobLabelNames, []string{"az", "vm_cid", "stemcell", "ips", "agent_id", "vm_type"}),
+		prometheus.Labels{"environment": environment},
+	)
+
+	deploymentExpectedInstancesDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "deployment", "expected_instances"),
+		"Number of BOSH Job instances the BOSH Director expects to have a VM.",
+		[]string{"bosh_deployment"},
+		prometheus.Labels{"environment": environment},
+	)
+
+	deploymentReportingInstancesDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "deployment", "reporting_instances"),
+		"Number of expected BOSH Job instances sending BOSH HM metrics.",
+		[]string{"bosh_deployment"},
+		prometheus.Labels{"environment": environment},
+	)
+
+	jobReportingDesc := prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "job", "reporting"),
+		"BOSH Job reporting (1 when an instance expected by the BOSH Director is sending BOSH HM metrics, 0 otherwise).",
+		jobLabelNames,
+		prometheus.Labels{"environment": environment},
+	)
+
+	totalDirectorRefreshErrorsMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "director_refresh_errors_total",
+			Help:      "Total number of errors while fetching the BOSH Director metadata.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastDirectorRefreshTimestampMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_director_refresh_timestamp",
+			Help:      "Number of seconds since 1970 since last refresh of the BOSH Director metadata.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastDirectorRefreshDurationSecondsMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_director_refresh_duration_seconds",
+			Help:      "Duration of the last refresh of the BOSH Director metadata.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	collector := &DirectorCollector{
+		environment:                              environment,
+		client:                                   client,
+		refreshInterval:                          refreshInterval,
+		hmTSDBCollector:                          hmTSDBCollector,
+		vms:                                      map[string][]director.VM{},
+		instances:                                map[string][]director.Instance{},
+		jobInfoDesc:                              jobInfoDesc,
+		deploymentExpectedInstancesDesc:          deploymentExpectedInstancesDesc,
+		deploymentReportingInstancesDesc:         deploymentReportingInstancesDesc,
+		jobReportingDesc:                         jobReportingDesc,
+		totalDirectorRefreshErrorsMetric:         totalDirectorRefreshErrorsMetric,
+		lastDirectorRefreshTimestampMetric:       lastDirectorRefreshTimestampMetric,
+		lastDirectorRefreshDurationSecondsMetric: lastDirectorRefreshDurationSecondsMetric,
+	}
+	go collector.refreshLoop()
+
+	return collector
+}
+
+func (c *DirectorCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, vm := range c.VMs() {
+		ch <- prometheus.MustNewConstMetric(
+			c.jobInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			vm.Deployment,
+			vm.JobName,
+			vm.ID,
+			vm.Index,
+			vm.AZ,
+			vm.VMCID,
+			vm.Stemcell,
+			strings.Join(vm.IPs, ","),
+			vm.AgentID,
+			vm.VMType,
+		)
+	}
+
+	if c.hmTSDBCollector != nil {
+		c.collectReporting(ch)
+	}
+
+	c.totalDirectorRefreshErrorsMetric.Collect(ch)
+	c.lastDirectorRefreshTimestampMetric.Collect(ch)
+	c.lastDirectorRefreshDurationSecondsMetric.Collect(ch)
+}
+
+func (c *DirectorCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.jobInfoDesc
+	if c.hmTSDBCollector != nil {
+		ch <- c.deploymentExpectedInstancesDesc
+		ch <- c.deploymentReportingInstancesDesc
+		ch <- c.jobReportingDesc
+	}
+	c.totalDirectorRefreshErrorsMetric.Describe(ch)
+	c.lastDirectorRefreshTimestampMetric.Describe(ch)
+	c.lastDirectorRefreshDurationSecondsMetric.Describe(ch)
+}
+
+// VMs returns the VMs fetched during the last refresh, sorted by deployment.
+func (c *DirectorCollector) VMs() []director.VM {
+	c.vmsMutex.Lock()
+	defer c.vmsMutex.Unlock()
+
+	deployments := make([]string, 0, len(c.vms))
+	for deployment := range c.vms {
+		deployments = append(deployments, deployment)
+	}
+	sort.Strings(deployments)
+
+	vms := []director.VM{}
+	for _, deployment := range deployments {
+		vms = append(vms, c.vms[deployment]...)
+	}
+
+	return vms
+}
+
+// Instances returns the instances expecting a VM fetched during the last
+// refresh, sorted by deployment.
+func (c *DirectorCollector) Instances() []director.Instance {
+	c.vmsMutex.Lock()
+	defer c.vmsMutex.Unlock()
+
+	deployments := make([]string, 0, len(c.instances))
+	for deployment := range c.instances {
+		deployments = append(deployments, deployment)
+	}
+	sort.Strings(deployments)
+
+	instances := []director.Instance{}
+	for _, deployment := range deployments {
+		for _, instance := range c.instances[deployment] {
+			if instance.ExpectsVM {
+				instances = append(instances, instance)
+			}
+		}
+	}
+
+	return instances
+}
+
+func (c *DirectorCollector) collectReporting(ch chan<- prometheus.Metric) {
+	reporting := map[string]bool{}
+	for _, jobInstance := range c.hmTSDBCollector.JobInstances() {
+		if jobInstance.Reporting {
+			reporting[reportingKey(jobInstance.Deployment, jobInstance.Job, jobInstance.ID)] = true
+		}
+	}
+
+	expectedInstances := map[string]int{}
+	reportingInstances := map[string]int{}
+	deployments := []string{}
+	for _, instance := range c.Instances() {
+		if _, ok := expectedInstances[instance.Deployment]; !ok {
+			deployments = append(deployments, instance.Deployment)
+		}
+		expectedInstances[instance.Deployment]++
+
+		value := 0.0
+		if reporting[reportingKey(instance.Deployment, instance.JobName, instance.ID)] {
+			reportingInstances[instance.Deployment]++
+			value = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			c.jobReportingDesc,
+			prometheus.GaugeValue,
+			value,
+			instance.Deployment,
+			instance.JobName,
+			instance.ID,
+			instance.Index,
+		)
+	}
+
+	for _, deployment := range deployments {
+		ch <- prometheus.MustNewConstMetric(
+			c.deploymentExpectedInstancesDesc,
+			prometheus.GaugeValue,
+			float64(expectedInstances[deployment]),
+			deployment,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.deploymentReportingInstancesDesc,
+			prometheus.GaugeValue,
+			float64(reportingInstances[deployment]),
+			deployment,
+		)
+	}
+}
+
+func reportingKey(deployment string, job string, id string) string {
+	return strings.Join([]string{deployment, job, id}, "\xff")
+}
+
+func (c *DirectorCollector) refreshLoop() {
+	c.refresh()
+
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.refresh()
+	}
+}
+
+func (c *DirectorCollector) refresh() {
+	begun := time.Now()
+
+	deployments, err := c.client.Deployments()
+	if err != nil {
+		log.Errorf("Error fetching BOSH Director deployments: %v", err)
+		c.totalDirectorRefreshErrorsMetric.Inc()
+		return
+	}
+
+	c.vmsMutex.Lock()
+	previousVMs := c.vms
+	previousInstances := c.instances
+	c.vmsMutex.Unlock()
+
+	vms := map[string][]director.VM{}
+	for _, deployment := range deployments {
+		deploymentVMs, err := c.client.VMs(deployment.Name)
+		if err != nil {
+			log.Errorf("Error fetching BOSH Director VMs of deployment `%s`: %v", deployment.Name, err)
+			c.totalDirectorRefreshErrorsMetric.Inc()
+			if previous, ok := previousVMs[deployment.Name]; ok {
+				vms[deployment.Name] = previous
+			}
+			continue
+		}
+		vms[deployment.Name] = deploymentVMs
+	}
+
+	instances := map[string][]director.Instance{}
+	if c.hmTSDBCollector != nil {
+		for _, deployment := range deployments {
+			deploymentInstances, err := c.client.Instances(deployment.Name)
+			if err != nil {
+				log.Errorf("Error fetching BOSH Director instances of deployment `%s`: %v", deployment.Name, err)
+				c.totalDirectorRefreshErrorsMetric.Inc()
+				if previous, ok := previousInstances[deployment.Name]; ok {
+					instances[deployment.Name] = previous
+				}
+				continue
+			}
+			instances[deployment.Name] = deploymentInstances
+		}
+	}
+
+	c.vmsMutex.Lock()
+	c.vms = vms
+	c.instances = instances
+	c.vmsMutex.Unlock()
+
+	c.lastDirectorRefreshTimestampMetric.Set(float64(time.Now().Unix()))
+	c.lastDirectorRefreshDurationSecondsMetric.Set(time.Since(begun).Seconds())
+}
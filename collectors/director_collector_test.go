@@ -0,0 +1,325 @@
+package collectors_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/bosh-prometheus/bosh_tsdb_exporter/director"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+type fakeDirectorClient struct {
+	mutex          sync.Mutex
+	deployments    []director.Deployment
+	deploymentsErr error
+	vms            map[string][]director.VM
+	vmsErr         map[string]error
+	instances      map[string][]director.Instance
+	instancesErr   map[string]error
+}
+
+func (c *fakeDirectorClient) Deployments() ([]director.Deployment, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.deployments, c.deploymentsErr
+}
+
+func (c *fakeDirectorClient) VMs(deployment string) ([]director.VM, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.vms[deployment], c.vmsErr[deployment]
+}
+
+func (c *fakeDirectorClient) Instances(deployment string) ([]director.Instance, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.instances[deployment], c.instancesErr[deployment]
+}
+
+var _ = Describe("DirectorCollector", func() {
+	var (
+		namespace         string
+		environment       string
+		directorClient    *fakeDirectorClient
+		directorCollector *DirectorCollector
+		hmTSDBCollector   *HMTSDBCollector
+
+		jobInfoMetric                    *prometheus.GaugeVec
+		totalDirectorRefreshErrorsMetric prometheus.Counter
+
+		deploymentName = "fake-deployment-name"
+		jobName        = "fake-job-name"
+		jobID          = "fake-job-id"
+		jobIndex       = "0"
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+
+		directorClient = &fakeDirectorClient{
+			deployments: []director.Deployment{{Name: deploymentName}},
+			vms: map[string][]director.VM{
+				deploymentName: {
+					{
+						Deployment: deploymentName,
+						AgentID:    "fake-agent-id",
+						VMCID:      "fake-vm-cid",
+						JobName:    jobName,
+						Index:      jobIndex,
+						ID:         jobID,
+						AZ:         "z1",
+						IPs:        []string{"10.0.0.1", "10.0.1.1"},
+						VMType:     "small",
+						Stemcell:   "fake-stemcell/3468.21",
+					},
+				},
+			},
+			vmsErr: map[string]error{},
+			instances: map[string][]director.Instance{
+				deploymentName: {
+					{Deployment: deploymentName, JobName: jobName, Index: jobIndex, ID: jobID, ExpectsVM: true},
+				},
+			},
+			instancesErr: map[string]error{},
+		}
+		hmTSDBCollector = nil
+
+		jobInfoMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "info",
+				Help:      "BOSH Job metadata from the BOSH Director (always 1).",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index", "az", "vm_cid", "stemcell", "ips", "agent_id", "vm_type"},
+		)
+
+		totalDirectorRefreshErrorsMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "director_refresh_errors_total",
+				Help:      "Total number of errors while fetching the BOSH Director metadata.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	JustBeforeEach(func() {
+		directorCollector = NewDirectorCollector(namespace, environment, directorClient, time.Hour, hmTSDBCollector)
+	})
+
+	collect := func() chan prometheus.Metric {
+		metrics := make(chan prometheus.Metric, 100)
+		directorCollector.Collect(metrics)
+		close(metrics)
+		return metrics
+	}
+
+	collectAll := func() []prometheus.Metric {
+		metrics := []prometheus.Metric{}
+		for metric := range collect() {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	Describe("Describe", func() {
+		var (
+			descriptions chan *prometheus.Desc
+		)
+
+		BeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+		})
+
+		JustBeforeEach(func() {
+			go directorCollector.Describe(descriptions)
+		})
+
+		It("returns a job_info metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(jobInfoMetric.WithLabelValues(
+				deploymentName, jobName, jobID, jobIndex, "", "", "", "", "", "",
+			).Desc())))
+		})
+
+		It("returns a director_refresh_errors_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalDirectorRefreshErrorsMetric.Desc())))
+		})
+	})
+
+	Describe("Collect", func() {
+		BeforeEach(func() {
+			jobInfoMetric.WithLabelValues(
+				deploymentName, jobName, jobID, jobIndex, "z1", "fake-vm-cid", "fake-stemcell/3468.21", "10.0.0.1,10.0.1.1", "fake-agent-id", "small",
+			).Set(1)
+		})
+
+		It("returns a job_info metric", func() {
+			Eventually(func() int { return len(directorCollector.VMs()) }).Should(Equal(1))
+			Expect(collect()).To(Receive(PrometheusMetric(jobInfoMetric.WithLabelValues(
+				deploymentName, jobName, jobID, jobIndex, "z1", "fake-vm-cid", "fake-stemcell/3468.21", "10.0.0.1,10.0.1.1", "fake-agent-id", "small",
+			))))
+		})
+
+		Context("when the deployments cannot be fetched", func() {
+			BeforeEach(func() {
+				directorClient.deploymentsErr = errors.New("fake-error")
+				totalDirectorRefreshErrorsMetric.Inc()
+			})
+
+			It("returns a director_refresh_errors_total metric", func() {
+				Eventually(func() chan prometheus.Metric { return collect() }).Should(Receive(PrometheusMetric(totalDirectorRefreshErrorsMetric)))
+			})
+
+			It("does not return job_info metrics", func() {
+				Consistently(func() int { return len(directorCollector.VMs()) }).Should(Equal(0))
+			})
+		})
+
+		Context("when the VMs of a deployment cannot be fetched", func() {
+			BeforeEach(func() {
+				directorClient.vmsErr[deploymentName] = errors.New("fake-error")
+				totalDirectorRefreshErrorsMetric.Inc()
+			})
+
+			It("returns a director_refresh_errors_total metric", func() {
+				Eventually(func() chan prometheus.Metric { return collect() }).Should(Receive(PrometheusMetric(totalDirectorRefreshErrorsMetric)))
+			})
+		})
+	})
+	Context("when reconciling with the HMTSDBCollector", func() {
+		var (
+			tsdbListener   net.Listener
+			hmTSDBListener *HMTSDBListener
+
+			deploymentExpectedInstancesMetric  *prometheus.GaugeVec
+			deploymentReportingInstancesMetric *prometheus.GaugeVec
+			jobReportingMetric                 *prometheus.GaugeVec
+
+			otherJobID    = "fake-other-job-id"
+			otherJobIndex = "1"
+		)
+
+		BeforeEach(func() {
+			hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener(namespace, environment, HMTSDBCollectorConfig{}, HMTSDBListenerConfig{})
+			hmJSONCollector := NewHMJSONCollector(namespace, environment, hmTSDBListener, strings.NewReader(fmt.Sprintf(
+				`{"kind":"heartbeat","timestamp":%d,"deployment":"%s","job":"%s","index":"%s","instance_id":"%s","metrics":[{"name":"system.healthy","value":"1","timestamp":%d,"tags":{}}]}`+"\n",
+				time.Now().Unix(), deploymentName, jobName, jobIndex, jobID, time.Now().Unix(),
+			)))
+			Eventually(hmJSONCollector.Done()).Should(BeClosed())
+
+			directorClient.instances[deploymentName] = append(
+				directorClient.instances[deploymentName],
+				director.Instance{Deployment: deploymentName, JobName: jobName, Index: otherJobIndex, ID: otherJobID, ExpectsVM: true},
+				director.Instance{Deployment: deploymentName, JobName: "fake-errand-name", Index: "0", ID: "fake-errand-id", ExpectsVM: false},
+			)
+
+			deploymentExpectedInstancesMetric = prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Subsystem: "deployment",
+					Name:      "expected_instances",
+					Help:      "Number of BOSH Job instances the BOSH Director expects to have a VM.",
+					ConstLabels: prometheus.Labels{
+						"environment": environment,
+					},
+				},
+				[]string{"bosh_deployment"},
+			)
+
+			deploymentReportingInstancesMetric = prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Subsystem: "deployment",
+					Name:      "reporting_instances",
+					Help:      "Number of expected BOSH Job instances sending BOSH HM metrics.",
+					ConstLabels: prometheus.Labels{
+						"environment": environment,
+					},
+				},
+				[]string{"bosh_deployment"},
+			)
+
+			jobReportingMetric = prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Subsystem: "job",
+					Name:      "reporting",
+					Help:      "BOSH Job reporting (1 when an instance expected by the BOSH Director is sending BOSH HM metrics, 0 otherwise).",
+					ConstLabels: prometheus.Labels{
+						"environment": environment,
+					},
+				},
+				[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+			)
+
+			deploymentExpectedInstancesMetric.WithLabelValues(deploymentName).Set(2)
+			deploymentReportingInstancesMetric.WithLabelValues(deploymentName).Set(1)
+			jobReportingMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(1)
+			jobReportingMetric.WithLabelValues(deploymentName, jobName, otherJobID, otherJobIndex).Set(0)
+		})
+
+		AfterEach(func() {
+			tsdbListener.Close()
+		})
+
+		It("returns a deployment_expected_instances metric", func() {
+			Eventually(collectAll).Should(ContainElement(PrometheusMetric(deploymentExpectedInstancesMetric.WithLabelValues(deploymentName))))
+		})
+
+		It("returns a deployment_reporting_instances metric", func() {
+			Eventually(collectAll).Should(ContainElement(PrometheusMetric(deploymentReportingInstancesMetric.WithLabelValues(deploymentName))))
+		})
+
+		It("returns a job_reporting metric for the reporting instance", func() {
+			Eventually(collectAll).Should(ContainElement(PrometheusMetric(jobReportingMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+		})
+
+		It("returns a job_reporting metric for the silent instance", func() {
+			Eventually(collectAll).Should(ContainElement(PrometheusMetric(jobReportingMetric.WithLabelValues(deploymentName, jobName, otherJobID, otherJobIndex))))
+		})
+
+		It("does not return a job_reporting metric for the instances without VM", func() {
+			Eventually(func() int { return len(directorCollector.Instances()) }).Should(Equal(2))
+			for metric := range collect() {
+				Expect(metric.Desc().String()).ToNot(ContainSubstring("fake-errand-id"))
+			}
+		})
+
+		Context("when the instances of a deployment cannot be fetched", func() {
+			BeforeEach(func() {
+				directorClient.instancesErr[deploymentName] = errors.New("fake-error")
+				totalDirectorRefreshErrorsMetric.Inc()
+			})
+
+			It("returns a director_refresh_errors_total metric", func() {
+				Eventually(collectAll).Should(ContainElement(PrometheusMetric(totalDirectorRefreshErrorsMetric)))
+			})
+
+			It("does not return job_reporting metrics", func() {
+				Consistently(func() int { return len(directorCollector.Instances()) }).Should(Equal(0))
+			})
+		})
+	})
+})
@@ -0,0 +1,149 @@
+package collectors
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+type environmentNetwork struct {
+	network     *net.IPNet
+	environment string
+}
+
+// EnvironmentResolver resolves the environment of a BOSH HM message from one
+// of its tags or, failing that, from the address of the BOSH HM that sent it.
+type EnvironmentResolver struct {
+	tag          string
+	networks     []environmentNetwork
+	environments map[string]bool
+}
+
+// NewEnvironmentResolver returns an EnvironmentResolver reading the
+// environment from the `tag` tag, if not empty, and from the `networks` CIDR to
+// environment table. The tag is only trusted for the `environments` and the
+// networks environments, so clients cannot create any number of environments.
+func NewEnvironmentResolver(tag string, networks map[string]string, environments []string) (*EnvironmentResolver, error) {
+	resolver := &EnvironmentResolver{tag: tag, environments: map[string]bool{}}
+	for _, environment := range environments {
+		resolver.environments[environment] = true
+	}
+
+	for cidr, environment := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid environment network `%s`: %v", cidr, err)
+		}
+		if environment == "" {
+			return nil, fmt.Errorf("invalid environment network `%s`: empty environment", cidr)
+		}
+		resolver.networks = append(resolver.networks, environmentNetwork{network: network, environment: environment})
+		resolver.environments[environment] = true
+	}
+
+	// Match the most specific network first.
+	sort.Slice(resolver.networks, func(i, j int) bool {
+		iOnes, _ := resolver.networks[i].network.Mask.Size()
+		jOnes, _ := resolver.networks[j].network.Mask.Size()
+		if iOnes != jOnes {
+			return iOnes > jOnes
+		}
+		return resolver.networks[i].network.String() < resolver.networks[j].network.String()
+	})
+
+	return resolver, nil
+}
+
+// Resolve returns the environment of a BOSH HM metric, or an empty string when
+// neither an allowed tag nor the networks match.
+func (r *EnvironmentResolver) Resolve(hmMetric HMMetric, remoteAddr net.Addr) string {
+	if r.tag != "" {
+		if environment := hmMetric.Tags[r.tag]; r.environments[environment] {
+			return environment
+		}
+	}
+
+	ip := remoteIP(remoteAddr)
+	if ip == nil {
+		return ""
+	}
+
+	for _, network := range r.networks {
+		if network.network.Contains(ip) {
+			return network.environment
+		}
+	}
+
+	return ""
+}
+
+// EnvironmentRouter dispatches the BOSH HM messages received by a
+// HMTSDBListener to the HMTSDBCollector of their environment, creating it on
+// first use, as the environment is a constant label of the exported metrics.
+// Without resolver, it only keeps track of the collectors of every environment.
+type EnvironmentRouter struct {
+	resolver     *EnvironmentResolver
+	newCollector func(environment string) (*HMTSDBCollector, error)
+	mutex        sync.Mutex
+	collectors   map[string]*HMTSDBCollector
+}
+
+func NewEnvironmentRouter(
+	resolver *EnvironmentResolver,
+	newCollector func(environment string) (*HMTSDBCollector, error),
+) *EnvironmentRouter {
+	return &EnvironmentRouter{
+		resolver:     resolver,
+		newCollector: newCollector,
+		collectors:   map[string]*HMTSDBCollector{},
+	}
+}
+
+// Add makes the router dispatch the messages of an environment to an existing
+// HMTSDBCollector.
+func (r *EnvironmentRouter) Add(collector *HMTSDBCollector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.collectors[collector.environment] = collector
+}
+
+// Collectors returns the HMTSDBCollector of every environment, sorted by
+// environment.
+func (r *EnvironmentRouter) Collectors() []*HMTSDBCollector {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	collectors := make([]*HMTSDBCollector, 0, len(r.collectors))
+	for _, collector := range r.collectors {
+		collectors = append(collectors, collector)
+	}
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].environment < collectors[j].environment
+	})
+
+	return collectors
+}
+
+func (r *EnvironmentRouter) collector(hmMetric HMMetric, remoteAddr net.Addr) (*HMTSDBCollector, error) {
+	environment := r.resolver.Resolve(hmMetric, remoteAddr)
+	if environment == "" {
+		return nil, nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if collector, ok := r.collectors[environment]; ok {
+		return collector, nil
+	}
+
+	collector, err := r.newCollector(environment)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the collector of environment `%s`: %v", environment, err)
+	}
+	r.collectors[environment] = collector
+
+	return collector, nil
+}
@@ -0,0 +1,247 @@
+package collectors_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("EnvironmentResolver", func() {
+	var (
+		err                 error
+		tag                 string
+		networks            map[string]string
+		environments        []string
+		environmentResolver *EnvironmentResolver
+
+		hmMetric HMMetric
+	)
+
+	BeforeEach(func() {
+		tag = "director"
+		networks = map[string]string{
+			"10.0.0.0/8":  "fake-environment-1",
+			"10.1.0.0/16": "fake-environment-2",
+		}
+		environments = []string{"fake-director"}
+		hmMetric = HMMetric{Tags: map[string]string{}}
+	})
+
+	JustBeforeEach(func() {
+		environmentResolver, err = NewEnvironmentResolver(tag, networks, environments)
+	})
+
+	It("returns the environment from the tag", func() {
+		Expect(err).ToNot(HaveOccurred())
+		hmMetric.Tags["director"] = "fake-director"
+		Expect(environmentResolver.Resolve(hmMetric, &net.TCPAddr{IP: net.ParseIP("10.1.0.1")})).To(Equal("fake-director"))
+	})
+
+	It("returns the environment from the tag when it is a network environment", func() {
+		Expect(err).ToNot(HaveOccurred())
+		hmMetric.Tags["director"] = "fake-environment-2"
+		Expect(environmentResolver.Resolve(hmMetric, nil)).To(Equal("fake-environment-2"))
+	})
+
+	It("ignores the tag when its environment is not allowed", func() {
+		Expect(err).ToNot(HaveOccurred())
+		hmMetric.Tags["director"] = "unknown-director"
+		Expect(environmentResolver.Resolve(hmMetric, &net.TCPAddr{IP: net.ParseIP("10.1.0.1")})).To(Equal("fake-environment-2"))
+		Expect(environmentResolver.Resolve(hmMetric, nil)).To(BeEmpty())
+	})
+
+	It("returns the environment of the most specific network", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(environmentResolver.Resolve(hmMetric, &net.TCPAddr{IP: net.ParseIP("10.1.0.1"), Port: 1234})).To(Equal("fake-environment-2"))
+		Expect(environmentResolver.Resolve(hmMetric, &net.TCPAddr{IP: net.ParseIP("10.2.0.1"), Port: 1234})).To(Equal("fake-environment-1"))
+	})
+
+	It("returns an empty environment when nothing matches", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(environmentResolver.Resolve(hmMetric, &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1234})).To(BeEmpty())
+		Expect(environmentResolver.Resolve(hmMetric, nil)).To(BeEmpty())
+	})
+
+	Context("when a network is not valid", func() {
+		BeforeEach(func() {
+			networks = map[string]string{"10.0.0.0": "fake-environment"}
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when a network environment is empty", func() {
+		BeforeEach(func() {
+			networks = map[string]string{"10.0.0.0/8": ""}
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("EnvironmentRouter", func() {
+	var (
+		err               error
+		tsdbListener      net.Listener
+		metricMapper      *MetricMapper
+		routedMutex       sync.Mutex
+		routedCollectors  map[string]*HMTSDBCollector
+		environmentRouter *EnvironmentRouter
+		hmTSDBCollector   *HMTSDBCollector
+		hmTSDBListener    *HMTSDBListener
+	)
+
+	BeforeEach(func() {
+		metricMapper, err = NewMetricMapper(DefaultMetricMappings(), nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		routedCollectors = map[string]*HMTSDBCollector{}
+		environmentResolver, err := NewEnvironmentResolver("director", map[string]string{"192.0.2.0/24": "fake-network"}, []string{"test_environment", "fake-director"})
+		Expect(err).ToNot(HaveOccurred())
+		environmentRouter = NewEnvironmentRouter(environmentResolver, func(environment string) (*HMTSDBCollector, error) {
+			collector := NewHMTSDBCollector("test_exporter", environment, HMTSDBCollectorConfig{MetricMapper: metricMapper})
+			routedMutex.Lock()
+			routedCollectors[environment] = collector
+			routedMutex.Unlock()
+			return collector, nil
+		})
+
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener("test_exporter", "test_environment", HMTSDBCollectorConfig{
+			MetricMapper: metricMapper,
+		}, HMTSDBListenerConfig{
+			EnvironmentRouter: environmentRouter,
+		})
+		environmentRouter.Add(hmTSDBCollector)
+
+		conn, err := net.Dial("tcp", tsdbListener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = fmt.Fprintf(conn, "put system.healthy %d 1 deployment=fake-deployment-1 job=fake-job index=0 id=fake-id-1 director=fake-director\n", time.Now().Unix())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = fmt.Fprintf(conn, "put system.healthy %d 1 deployment=fake-deployment-2 job=fake-job index=0 id=fake-id-2 director=test_environment\n", time.Now().Unix())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = fmt.Fprintf(conn, "put system.healthy %d 1 deployment=fake-deployment-3 job=fake-job index=0 id=fake-id-3\n", time.Now().Unix())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = fmt.Fprintf(conn, "put system.healthy %d 1 deployment=fake-deployment-4 job=fake-job index=0 id=fake-id-4 director=unknown-director\n", time.Now().Unix())
+		Expect(err).ToNot(HaveOccurred())
+		conn.Close()
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	routedCollector := func(environment string) *HMTSDBCollector {
+		routedMutex.Lock()
+		defer routedMutex.Unlock()
+		return routedCollectors[environment]
+	}
+
+	It("routes the messages to the collector of their environment", func() {
+		Eventually(func() []string { return jobInstanceIDsOf(routedCollector("fake-director")) }).Should(Equal([]string{"fake-id-1"}))
+	})
+
+	It("returns the collector of every environment", func() {
+		Eventually(func() []string { return jobInstanceIDsOf(routedCollector("fake-director")) }).Should(Equal([]string{"fake-id-1"}))
+		Expect(environmentRouter.Collectors()).To(Equal([]*HMTSDBCollector{routedCollector("fake-director"), hmTSDBCollector}))
+	})
+
+	It("keeps the messages of its own environment and without environment", func() {
+		Eventually(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(ContainElement("fake-id-2"))
+		Eventually(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(ContainElement("fake-id-3"))
+		Expect(routedCollector("test_environment")).To(BeNil())
+	})
+
+	It("keeps the messages of a not allowed environment and counts them as unresolved", func() {
+		Eventually(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(Equal([]string{"fake-id-2", "fake-id-3", "fake-id-4"}))
+		Expect(routedCollector("unknown-director")).To(BeNil())
+
+		totalUnresolvedEnvironmentTSDBMessagesMetric := prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "test_exporter",
+				Subsystem: "",
+				Name:      "unresolved_environment_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB messages kept in the listener environment because their environment could not be resolved or is not allowed.",
+				ConstLabels: prometheus.Labels{
+					"environment": "test_environment",
+				},
+			},
+		)
+		totalUnresolvedEnvironmentTSDBMessagesMetric.Add(2)
+
+		ch := make(chan prometheus.Metric, 100)
+		hmTSDBListener.Collect(ch)
+		close(ch)
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		Expect(metrics).To(ContainElement(PrometheusMetric(totalUnresolvedEnvironmentTSDBMessagesMetric)))
+	})
+
+	It("routes the data points posted to the OpenTSDB HTTP API", func() {
+		body := fmt.Sprintf(`{"metric":"system.healthy","timestamp":%d,"value":1,"tags":{"deployment":"fake-deployment-5","job":"fake-job","index":"0","id":"fake-id-5","director":"fake-director"}}`, time.Now().Unix())
+		recorder := httptest.NewRecorder()
+		NewHMTSDBHTTPHandler(hmTSDBListener).ServeHTTP(recorder, httptest.NewRequest("POST", "/api/put", strings.NewReader(body)))
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+
+		Eventually(func() []string { return jobInstanceIDsOf(routedCollector("fake-director")) }).Should(ContainElement("fake-id-5"))
+	})
+
+	It("routes the heartbeats posted to the BOSH HM events webhook", func() {
+		body := fmt.Sprintf(`{"kind":"heartbeat","id":"fake-id-6","timestamp":%d,"deployment":"fake-deployment-6","job":"fake-job","index":"0","instance_id":"fake-id-6","metrics":[{"name":"system.healthy","value":"1","timestamp":%d,"tags":{"director":"fake-director"}}]}`, time.Now().Unix(), time.Now().Unix())
+		recorder := httptest.NewRecorder()
+		NewHMJSONHTTPHandler(hmTSDBListener).ServeHTTP(recorder, httptest.NewRequest("POST", "/api/hm/events", strings.NewReader(body)))
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+
+		Eventually(func() []string { return jobInstanceIDsOf(routedCollector("fake-director")) }).Should(ContainElement("fake-id-6"))
+	})
+
+	It("routes the alerts posted to the BOSH HM events webhook by the address of the BOSH HM", func() {
+		body := fmt.Sprintf(`{"kind":"alert","id":"fake-alert-id","severity":4,"category":"vm_health","title":"fake-title","summary":"fake-summary","source":"fake-source","deployment":"fake-deployment-7","created_at":%d}`, time.Now().Unix())
+		request := httptest.NewRequest("POST", "/api/hm/events", strings.NewReader(body))
+		request.RemoteAddr = "192.0.2.1:1234"
+		recorder := httptest.NewRecorder()
+		NewHMJSONHTTPHandler(hmTSDBListener).ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+
+		totalAlertsMetric := prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "test_exporter",
+				Subsystem: "",
+				Name:      "alerts_total",
+				Help:      "Total number of BOSH HM alerts received.",
+				ConstLabels: prometheus.Labels{
+					"environment": "fake-network",
+				},
+			},
+			[]string{"bosh_deployment", "severity", "category", "source"},
+		)
+		totalAlertsMetric.WithLabelValues("fake-deployment-7", "warning", "vm_health", "fake-source").Inc()
+
+		Expect(routedCollector("fake-network")).ToNot(BeNil())
+		ch := make(chan prometheus.Metric, 100)
+		routedCollector("fake-network").Collect(ch)
+		close(ch)
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		Expect(metrics).To(ContainElement(PrometheusMetric(totalAlertsMetric.WithLabelValues("fake-deployment-7", "warning", "vm_health", "fake-source"))))
+	})
+})
@@ -0,0 +1,133 @@
+package collectors
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultGraphiteTemplate = "<deployment>.<job>.<index>.<id>.<metric...>"
+
+	graphiteMetricField = "metric"
+)
+
+type graphiteTemplateSegment struct {
+	literal string
+	field   string
+	greedy  bool
+}
+
+// GraphiteTemplate recovers a BOSH HM metric name and its tags from a dotted
+// Graphite path.
+type GraphiteTemplate struct {
+	template string
+	segments []graphiteTemplateSegment
+	greedy   int
+}
+
+func ParseGraphiteTemplate(template string) (*GraphiteTemplate, error) {
+	graphiteTemplate := &GraphiteTemplate{template: template, greedy: -1}
+	fields := map[string]bool{}
+
+	for i, part := range splitGraphiteTemplate(template) {
+		segment := graphiteTemplateSegment{}
+		switch {
+		case part == "":
+			return nil, fmt.Errorf("Invalid graphite template `%s`: empty segment", template)
+		case part == "*":
+		case strings.HasPrefix(part, "<") && strings.HasSuffix(part, ">"):
+			segment.field = part[1 : len(part)-1]
+			if strings.HasSuffix(segment.field, "...") {
+				segment.field = strings.TrimSuffix(segment.field, "...")
+				segment.greedy = true
+			}
+			if !labelNameRE.MatchString(segment.field) {
+				return nil, fmt.Errorf("Invalid graphite template `%s`: `%s` is not a valid field name", template, segment.field)
+			}
+			if fields[segment.field] {
+				return nil, fmt.Errorf("Invalid graphite template `%s`: field `%s` is used more than once", template, segment.field)
+			}
+			fields[segment.field] = true
+		default:
+			segment.literal = part
+		}
+
+		if segment.greedy {
+			if graphiteTemplate.greedy >= 0 {
+				return nil, fmt.Errorf("Invalid graphite template `%s`: only one field can capture several segments", template)
+			}
+			graphiteTemplate.greedy = i
+		}
+		graphiteTemplate.segments = append(graphiteTemplate.segments, segment)
+	}
+
+	if !fields[graphiteMetricField] {
+		return nil, fmt.Errorf("Invalid graphite template `%s`: the `<%s>` field is required", template, graphiteMetricField)
+	}
+
+	return graphiteTemplate, nil
+}
+
+func (t *GraphiteTemplate) String() string {
+	return t.template
+}
+
+// Apply returns the metric name and the tags captured from a Graphite path.
+func (t *GraphiteTemplate) Apply(path string) (string, map[string]string, error) {
+	parts := strings.Split(path, ".")
+	if t.greedy < 0 && len(parts) != len(t.segments) || t.greedy >= 0 && len(parts) < len(t.segments) {
+		return "", nil, errors.New("path does not have the number of segments expected by the template")
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", nil, errors.New("path has an empty segment")
+		}
+	}
+
+	name := ""
+	tags := map[string]string{}
+	for i, segment := range t.segments {
+		var part string
+		switch {
+		case segment.greedy:
+			part = strings.Join(parts[i:len(parts)-len(t.segments)+i+1], ".")
+		case t.greedy >= 0 && i > t.greedy:
+			part = parts[len(parts)-len(t.segments)+i]
+		default:
+			part = parts[i]
+		}
+
+		switch {
+		case segment.literal != "":
+			if part != segment.literal {
+				return "", nil, fmt.Errorf("path segment `%s` does not match `%s`", part, segment.literal)
+			}
+		case segment.field == graphiteMetricField:
+			name = part
+		case segment.field != "":
+			tags[segment.field] = part
+		}
+	}
+
+	return name, tags, nil
+}
+
+func splitGraphiteTemplate(template string) []string {
+	parts := []string{}
+	start := 0
+	inField := false
+	for i, c := range template {
+		switch {
+		case c == '<':
+			inField = true
+		case c == '>':
+			inField = false
+		case c == '.' && !inField:
+			parts = append(parts, template[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, template[start:])
+}
@@ -0,0 +1,90 @@
+package collectors_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+)
+
+var _ = Describe("GraphiteTemplate", func() {
+	Describe("ParseGraphiteTemplate", func() {
+		It("parses the default template", func() {
+			template, err := ParseGraphiteTemplate(DefaultGraphiteTemplate)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(template.String()).To(Equal(DefaultGraphiteTemplate))
+		})
+
+		It("returns an error when the metric field is missing", func() {
+			_, err := ParseGraphiteTemplate("<deployment>.<job>.<index>.<id>")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a field is used more than once", func() {
+			_, err := ParseGraphiteTemplate("<deployment>.<deployment>.<metric>")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when several fields capture several segments", func() {
+			_, err := ParseGraphiteTemplate("<deployment...>.<metric...>")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a field name is not valid", func() {
+			_, err := ParseGraphiteTemplate("<deploy-ment>.<metric>")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a segment is empty", func() {
+			_, err := ParseGraphiteTemplate("<deployment>..<metric>")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Apply", func() {
+		var template *GraphiteTemplate
+
+		BeforeEach(func() {
+			var err error
+			template, err = ParseGraphiteTemplate("bosh.*.<deployment>.<job>.<index>.<id>.<metric...>")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the metric name and the tags", func() {
+			name, tags, err := template.Apply("bosh.prefix.fake-deployment.fake-job.0.fake-id.system.disk.ephemeral.percent")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(name).To(Equal("system.disk.ephemeral.percent"))
+			Expect(tags).To(Equal(map[string]string{
+				"deployment": "fake-deployment",
+				"job":        "fake-job",
+				"index":      "0",
+				"id":         "fake-id",
+			}))
+		})
+
+		It("captures the segments after a greedy field", func() {
+			template, err := ParseGraphiteTemplate("<metric...>.<deployment>")
+			Expect(err).ToNot(HaveOccurred())
+
+			name, tags, err := template.Apply("system.healthy.fake-deployment")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(name).To(Equal("system.healthy"))
+			Expect(tags).To(Equal(map[string]string{"deployment": "fake-deployment"}))
+		})
+
+		It("returns an error when a literal segment does not match", func() {
+			_, _, err := template.Apply("other.prefix.fake-deployment.fake-job.0.fake-id.system_healthy")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the path is too short", func() {
+			_, _, err := template.Apply("bosh.prefix.fake-deployment.fake-job.0.fake-id")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the path has an empty segment", func() {
+			_, _, err := template.Apply("bosh.prefix.fake-deployment..0.fake-id.system_healthy")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,60 @@
+package collectors
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+var alertLabelNames = []string{"bosh_deployment", "severity", "category", "source"}
+
+type HMAlert struct {
+	Id         string
+	Severity   int
+	Category   string
+	Title      string
+	Summary    string
+	Source     string
+	Deployment string
+	CreatedAt  time.Time
+}
+
+// SeverityName returns the name of a BOSH HM alert severity.
+func (a HMAlert) SeverityName() string {
+	switch a.Severity {
+	case 1:
+		return "alert"
+	case 2:
+		return "critical"
+	case 3:
+		return "error"
+	case 4:
+		return "warning"
+	case -1:
+		return "ignored"
+	}
+
+	return strconv.Itoa(a.Severity)
+}
+
+// routeHMAlert returns the HMTSDBCollector of the environment of a BOSH HM
+// alert, resolved from its deployment and the address of the BOSH HM that sent
+// it as alerts have no tags.
+func (l *HMTSDBListener) routeHMAlert(hmAlert HMAlert, remoteAddr net.Addr) *HMTSDBCollector {
+	return l.routeHMMetric(newHMMetric("", 0, hmAlert.CreatedAt, map[string]string{"deployment": hmAlert.Deployment}), remoteAddr)
+}
+
+func (c *HMTSDBCollector) processHMAlert(hmAlert HMAlert) {
+	log.Debugf("BOSH HM alert `%s` received from `%s`: %s", hmAlert.Title, hmAlert.Source, hmAlert.Summary)
+
+	createdAt := hmAlert.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	labelValues := []string{hmAlert.Deployment, hmAlert.SeverityName(), hmAlert.Category, hmAlert.Source}
+	c.totalAlertsMetric.WithLabelValues(labelValues...).Inc()
+	c.alertLastTimestampMetric.WithLabelValues(labelValues...).Set(float64(createdAt.Unix()))
+}
@@ -0,0 +1,183 @@
+package collectors
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// HMGraphiteCollector accepts the Graphite plaintext protocol sent by the BOSH
+// HM graphite plugin and publishes the received metrics through a
+// HMTSDBListener, so they are exported exactly as the ones received through the
+// TSDB plugin.
+type HMGraphiteCollector struct {
+	template                                   *GraphiteTemplate
+	hmTSDBListener                             *HMTSDBListener
+	graphiteListener                           net.Listener
+	metricNames                                map[string]string
+	totalReceivedGraphiteMessagesMetric        prometheus.Counter
+	totalInvalidGraphiteMessagesMetric         prometheus.Counter
+	lastReceivedGraphiteMessageTimestampMetric prometheus.Gauge
+}
+
+func NewHMGraphiteCollector(
+	namespace string,
+	environment string,
+	template *GraphiteTemplate,
+	hmTSDBListener *HMTSDBListener,
+	graphiteListener net.Listener,
+) *HMGraphiteCollector {
+	// The graphite plugin replaces the dots of the metric names with
+	// underscores, so exact mappings are also looked up by that name.
+	metricNames := map[string]string{}
+	for _, mapping := range hmTSDBListener.collector.metricMapper.Mappings() {
+		if mapping.MatchType == MatchTypeExact {
+			metricNames[strings.Replace(mapping.Match, ".", "_", -1)] = mapping.Match
+		}
+	}
+
+	totalReceivedGraphiteMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "received_graphite_messages_total",
+			Help:      "Total number of BOSH HM Graphite received messages.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalInvalidGraphiteMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "invalid_graphite_messages_total",
+			Help:      "Total number of BOSH HM Graphite invalid messages.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastReceivedGraphiteMessageTimestampMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_received_graphite_message_timestamp",
+			Help:      "Number of seconds since 1970 since last received message from BOSH HM Graphite.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	collector := &HMGraphiteCollector{
+		template:                            template,
+		hmTSDBListener:                      hmTSDBListener,
+		graphiteListener:                    hmTSDBListener.LimitListener(graphiteListener),
+		metricNames:                         metricNames,
+		totalReceivedGraphiteMessagesMetric: totalReceivedGraphiteMessagesMetric,
+		totalInvalidGraphiteMessagesMetric:  totalInvalidGraphiteMessagesMetric,
+		lastReceivedGraphiteMessageTimestampMetric: lastReceivedGraphiteMessageTimestampMetric,
+	}
+	go collector.listenHMGraphite()
+
+	return collector
+}
+
+func (c *HMGraphiteCollector) Collect(ch chan<- prometheus.Metric) {
+	c.totalReceivedGraphiteMessagesMetric.Collect(ch)
+	c.totalInvalidGraphiteMessagesMetric.Collect(ch)
+	c.lastReceivedGraphiteMessageTimestampMetric.Collect(ch)
+}
+
+func (c *HMGraphiteCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.totalReceivedGraphiteMessagesMetric.Describe(ch)
+	c.totalInvalidGraphiteMessagesMetric.Describe(ch)
+	c.lastReceivedGraphiteMessageTimestampMetric.Describe(ch)
+}
+
+func (c *HMGraphiteCollector) listenHMGraphite() {
+	for {
+		conn, err := c.graphiteListener.Accept()
+		if err != nil {
+			log.Errorf("Error accepting BOSH HM Graphite connections: %v", err)
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		go c.handleHMMessage(conn)
+	}
+}
+
+func (c *HMGraphiteCollector) handleHMMessage(conn net.Conn) {
+	defer conn.Close()
+
+	allowHMMessage, releaseHMSource := c.hmTSDBListener.limitHMSource(conn.RemoteAddr())
+	defer releaseHMSource()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		c.totalReceivedGraphiteMessagesMetric.Inc()
+		c.lastReceivedGraphiteMessageTimestampMetric.Set(float64(time.Now().Unix()))
+
+		if !allowHMMessage() {
+			continue
+		}
+
+		hmMessage := scanner.Text()
+		hmMetric, err := c.parseHMMessage(hmMessage)
+		if err != nil {
+			log.Error(err)
+			c.totalInvalidGraphiteMessagesMetric.Inc()
+			continue
+		}
+
+		c.hmTSDBListener.publishHMMetric(c.hmTSDBListener.routeHMMetric(hmMetric, conn.RemoteAddr()), hmMetric)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Error reading BOSH HM Graphite connection from `%s`: %v", conn.RemoteAddr(), err)
+		c.hmTSDBListener.totalTSDBConnectionErrorsMetric.WithLabelValues(connectionErrorReason(err)).Inc()
+	}
+}
+
+func (c *HMGraphiteCollector) parseHMMessage(hmMessage string) (HMMetric, error) {
+	hmMetric := HMMetric{}
+
+	log.Debugf("Parsing BOSH HM Graphite message `%s`", hmMessage)
+
+	tokens := strings.Fields(hmMessage)
+	if len(tokens) != 3 {
+		return hmMetric, errors.New(fmt.Sprintf("BOSH HM Graphite message discarded, it does not have 3 tokens: %v", hmMessage))
+	}
+
+	name, tags, err := c.template.Apply(tokens[0])
+	if err != nil {
+		return hmMetric, errors.New(fmt.Sprintf("BOSH HM Graphite message discarded, path `%s` does not match template `%s`: %v", tokens[0], c.template, err))
+	}
+	if metricName, ok := c.metricNames[name]; ok {
+		name = metricName
+	}
+
+	value, err := strconv.ParseFloat(tokens[1], 64)
+	if err != nil {
+		return hmMetric, errors.New(fmt.Sprintf("BOSH HM Graphite message discarded, value `%s` cannot be parsed as float: %v", tokens[1], err))
+	}
+
+	timestamp, err := parseTimestamp(tokens[2])
+	if err != nil {
+		return hmMetric, errors.New(fmt.Sprintf("BOSH HM Graphite message discarded, timestamp `%s` cannot be parsed: %v", tokens[2], err))
+	}
+
+	return newHMMetric(name, value, timestamp, tags), nil
+}
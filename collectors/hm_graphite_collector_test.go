@@ -0,0 +1,223 @@
+package collectors_test
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("HMGraphiteCollector", func() {
+	var (
+		err                 error
+		namespace           string
+		environment         string
+		tsdbListener        net.Listener
+		graphiteListener    net.Listener
+		hmTSDBCollector     *HMTSDBCollector
+		hmTSDBListener      *HMTSDBListener
+		hmGraphiteCollector *HMGraphiteCollector
+
+		jobHealthyMetric                           *prometheus.GaugeVec
+		jobEphemeralDiskPercentMetric              *prometheus.GaugeVec
+		totalReceivedGraphiteMessagesMetric        prometheus.Counter
+		totalInvalidGraphiteMessagesMetric         prometheus.Counter
+		lastReceivedGraphiteMessageTimestampMetric prometheus.Gauge
+
+		deploymentName = "fake-deployment-name"
+		jobName        = "fake-job-name"
+		jobID          = "fake-job-id"
+		jobIndex       = "0"
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+
+		graphiteListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+
+		template, err := ParseGraphiteTemplate("bosh.<deployment>.<job>.<index>.<id>.<metric...>")
+		Expect(err).ToNot(HaveOccurred())
+
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener(namespace, environment, HMTSDBCollectorConfig{}, HMTSDBListenerConfig{})
+		hmGraphiteCollector = NewHMGraphiteCollector(namespace, environment, template, hmTSDBListener, graphiteListener)
+
+		jobHealthyMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "healthy",
+				Help:      "BOSH Job Healthy (1 for healthy, 0 for unhealthy).",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+		)
+
+		jobEphemeralDiskPercentMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "ephemeral_disk_percent",
+				Help:      "BOSH Job Ephemeral Disk Percent.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+		)
+
+		totalReceivedGraphiteMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "received_graphite_messages_total",
+				Help:      "Total number of BOSH HM Graphite received messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalInvalidGraphiteMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "invalid_graphite_messages_total",
+				Help:      "Total number of BOSH HM Graphite invalid messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		lastReceivedGraphiteMessageTimestampMetric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "last_received_graphite_message_timestamp",
+				Help:      "Number of seconds since 1970 since last received message from BOSH HM Graphite.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+		graphiteListener.Close()
+	})
+
+	Describe("Describe", func() {
+		var (
+			descriptions chan *prometheus.Desc
+		)
+
+		BeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+		})
+
+		JustBeforeEach(func() {
+			go hmGraphiteCollector.Describe(descriptions)
+		})
+
+		It("returns a received_graphite_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalReceivedGraphiteMessagesMetric.Desc())))
+		})
+
+		It("returns a invalid_graphite_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalInvalidGraphiteMessagesMetric.Desc())))
+		})
+
+		It("returns a last_received_graphite_message_timestamp metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(lastReceivedGraphiteMessageTimestampMetric.Desc())))
+		})
+	})
+
+	Describe("Collect", func() {
+		var (
+			graphiteMessage string
+			jobMetrics      chan prometheus.Metric
+			metrics         chan prometheus.Metric
+		)
+
+		JustBeforeEach(func() {
+			conn, err := net.Dial("tcp", graphiteListener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			_, err = conn.Write([]byte(graphiteMessage))
+			Expect(err).ToNot(HaveOccurred())
+			conn.Close()
+
+			// Leave some time to the graphite parser to process the message
+			time.Sleep(100 * time.Millisecond)
+
+			jobMetrics = make(chan prometheus.Metric, 100)
+			hmTSDBCollector.Collect(jobMetrics)
+			close(jobMetrics)
+
+			metrics = make(chan prometheus.Metric, 100)
+			hmGraphiteCollector.Collect(metrics)
+			close(metrics)
+		})
+
+		Context("when a system_healthy message is received", func() {
+			BeforeEach(func() {
+				graphiteMessage = fmt.Sprintf("bosh.%s.%s.%s.%s.system_healthy 1 %d\n", deploymentName, jobName, jobIndex, jobID, time.Now().Unix())
+				jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(1)
+				totalReceivedGraphiteMessagesMetric.Inc()
+			})
+
+			It("returns a job_healthy metric", func() {
+				Expect(jobMetrics).To(Receive(PrometheusMetric(jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+			})
+
+			It("returns a received_graphite_messages_total metric", func() {
+				Expect(metrics).To(Receive(PrometheusMetric(totalReceivedGraphiteMessagesMetric)))
+			})
+		})
+
+		Context("when a dotted system.disk.ephemeral.percent message is received", func() {
+			BeforeEach(func() {
+				graphiteMessage = fmt.Sprintf("bosh.%s.%s.%s.%s.system.disk.ephemeral.percent 40 %d\n", deploymentName, jobName, jobIndex, jobID, time.Now().Unix())
+				jobEphemeralDiskPercentMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(40)
+			})
+
+			It("returns a job_ephemeral_disk_percent metric", func() {
+				Expect(jobMetrics).To(Receive(PrometheusMetric(jobEphemeralDiskPercentMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+			})
+		})
+
+		Context("when a message does not match the template", func() {
+			BeforeEach(func() {
+				graphiteMessage = fmt.Sprintf("other.%s.%s.%s.%s.system_healthy 1 %d\n", deploymentName, jobName, jobIndex, jobID, time.Now().Unix())
+				totalReceivedGraphiteMessagesMetric.Inc()
+				totalInvalidGraphiteMessagesMetric.Inc()
+			})
+
+			It("returns a invalid_graphite_messages_total metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(totalInvalidGraphiteMessagesMetric)))
+			})
+		})
+
+		Context("when a message value is not a number", func() {
+			BeforeEach(func() {
+				graphiteMessage = fmt.Sprintf("bosh.%s.%s.%s.%s.system_healthy a %d\n", deploymentName, jobName, jobIndex, jobID, time.Now().Unix())
+				totalInvalidGraphiteMessagesMetric.Inc()
+			})
+
+			It("returns a invalid_graphite_messages_total metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(totalInvalidGraphiteMessagesMetric)))
+			})
+		})
+	})
+})
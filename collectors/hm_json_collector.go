@@ -0,0 +1,371 @@
+package collectors
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const maxHMJSONMessageSize = 1024 * 1024
+
+type hmJSONEvent struct {
+	Kind string `json:"kind"`
+}
+
+type hmJSONHeartbeat struct {
+	Timestamp  int64                   `json:"timestamp"`
+	Deployment string                  `json:"deployment"`
+	AgentId    string                  `json:"agent_id"`
+	Job        string                  `json:"job"`
+	Index      json.RawMessage         `json:"index"`
+	InstanceId string                  `json:"instance_id"`
+	JobState   string                  `json:"job_state"`
+	Vitals     hmJSONVitals            `json:"vitals"`
+	Metrics    []hmJSONHeartbeatMetric `json:"metrics"`
+}
+
+type hmJSONVitals struct {
+	CPU struct {
+		Sys  json.RawMessage `json:"sys"`
+		User json.RawMessage `json:"user"`
+		Wait json.RawMessage `json:"wait"`
+	} `json:"cpu"`
+	Disk struct {
+		System     hmJSONDiskVitals `json:"system"`
+		Ephemeral  hmJSONDiskVitals `json:"ephemeral"`
+		Persistent hmJSONDiskVitals `json:"persistent"`
+	} `json:"disk"`
+	Load []json.RawMessage `json:"load"`
+	Mem  hmJSONMemVitals   `json:"mem"`
+	Swap hmJSONMemVitals   `json:"swap"`
+}
+
+type hmJSONDiskVitals struct {
+	Percent      json.RawMessage `json:"percent"`
+	InodePercent json.RawMessage `json:"inode_percent"`
+}
+
+type hmJSONMemVitals struct {
+	KB      json.RawMessage `json:"kb"`
+	Percent json.RawMessage `json:"percent"`
+}
+
+func (v hmJSONVitals) metrics(jobState string) []hmJSONHeartbeatMetric {
+	vitals := []hmJSONHeartbeatMetric{
+		{Name: "system.cpu.sys", Value: v.CPU.Sys},
+		{Name: "system.cpu.user", Value: v.CPU.User},
+		{Name: "system.cpu.wait", Value: v.CPU.Wait},
+		{Name: "system.disk.system.percent", Value: v.Disk.System.Percent},
+		{Name: "system.disk.system.inode_percent", Value: v.Disk.System.InodePercent},
+		{Name: "system.disk.ephemeral.percent", Value: v.Disk.Ephemeral.Percent},
+		{Name: "system.disk.ephemeral.inode_percent", Value: v.Disk.Ephemeral.InodePercent},
+		{Name: "system.disk.persistent.percent", Value: v.Disk.Persistent.Percent},
+		{Name: "system.disk.persistent.inode_percent", Value: v.Disk.Persistent.InodePercent},
+		{Name: "system.mem.kb", Value: v.Mem.KB},
+		{Name: "system.mem.percent", Value: v.Mem.Percent},
+		{Name: "system.swap.kb", Value: v.Swap.KB},
+		{Name: "system.swap.percent", Value: v.Swap.Percent},
+	}
+	for i, name := range []string{"system.load.1m", "system.load.5m", "system.load.15m"} {
+		if i < len(v.Load) {
+			vitals = append(vitals, hmJSONHeartbeatMetric{Name: name, Value: v.Load[i]})
+		}
+	}
+	if jobState != "" {
+		healthy := "0"
+		if jobState == "running" {
+			healthy = "1"
+		}
+		vitals = append(vitals, hmJSONHeartbeatMetric{Name: "system.healthy", Value: json.RawMessage(healthy)})
+	}
+
+	metrics := []hmJSONHeartbeatMetric{}
+	for _, vital := range vitals {
+		if len(vital.Value) > 0 && string(vital.Value) != "null" {
+			metrics = append(metrics, vital)
+		}
+	}
+
+	return metrics
+}
+
+type hmJSONHeartbeatMetric struct {
+	Name      string            `json:"name"`
+	Value     json.RawMessage   `json:"value"`
+	Timestamp json.RawMessage   `json:"timestamp"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type hmJSONAlert struct {
+	Id         string `json:"id"`
+	Severity   int    `json:"severity"`
+	Category   string `json:"category"`
+	Title      string `json:"title"`
+	Summary    string `json:"summary"`
+	Source     string `json:"source"`
+	Deployment string `json:"deployment"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// HMJSONCollector reads the heartbeats and alerts written as JSON lines by the
+// BOSH HM `json` plugin to the stdin of its subprocesses, and publishes them
+// through a HMTSDBListener.
+type HMJSONCollector struct {
+	hmTSDBListener                         *HMTSDBListener
+	reader                                 io.Reader
+	done                                   chan struct{}
+	totalReceivedJSONMessagesMetric        prometheus.Counter
+	totalInvalidJSONMessagesMetric         prometheus.Counter
+	lastReceivedJSONMessageTimestampMetric prometheus.Gauge
+}
+
+func NewHMJSONCollector(
+	namespace string,
+	environment string,
+	hmTSDBListener *HMTSDBListener,
+	reader io.Reader,
+) *HMJSONCollector {
+	totalReceivedJSONMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "received_json_messages_total",
+			Help:      "Total number of BOSH HM JSON received messages.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalInvalidJSONMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "invalid_json_messages_total",
+			Help:      "Total number of BOSH HM JSON invalid messages.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastReceivedJSONMessageTimestampMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_received_json_message_timestamp",
+			Help:      "Number of seconds since 1970 since last received message from BOSH HM JSON.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	collector := &HMJSONCollector{
+		hmTSDBListener:                         hmTSDBListener,
+		reader:                                 reader,
+		done:                                   make(chan struct{}),
+		totalReceivedJSONMessagesMetric:        totalReceivedJSONMessagesMetric,
+		totalInvalidJSONMessagesMetric:         totalInvalidJSONMessagesMetric,
+		lastReceivedJSONMessageTimestampMetric: lastReceivedJSONMessageTimestampMetric,
+	}
+	go collector.readHMJSON()
+
+	return collector
+}
+
+func (c *HMJSONCollector) Collect(ch chan<- prometheus.Metric) {
+	c.totalReceivedJSONMessagesMetric.Collect(ch)
+	c.totalInvalidJSONMessagesMetric.Collect(ch)
+	c.lastReceivedJSONMessageTimestampMetric.Collect(ch)
+}
+
+func (c *HMJSONCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.totalReceivedJSONMessagesMetric.Describe(ch)
+	c.totalInvalidJSONMessagesMetric.Describe(ch)
+	c.lastReceivedJSONMessageTimestampMetric.Describe(ch)
+}
+
+// Done is closed once the reader has been consumed, which happens when the
+// BOSH HM stops the plugin.
+func (c *HMJSONCollector) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *HMJSONCollector) readHMJSON() {
+	defer close(c.done)
+
+	scanner := bufio.NewScanner(c.reader)
+	scanner.Buffer(make([]byte, 64*1024), maxHMJSONMessageSize)
+	for scanner.Scan() {
+		hmMessage := scanner.Bytes()
+		if len(hmMessage) == 0 {
+			continue
+		}
+
+		c.totalReceivedJSONMessagesMetric.Inc()
+		c.lastReceivedJSONMessageTimestampMetric.Set(float64(time.Now().Unix()))
+
+		if err := c.hmTSDBListener.processHMJSONMessage(hmMessage, nil); err != nil {
+			log.Error(err)
+			c.totalInvalidJSONMessagesMetric.Inc()
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Error reading BOSH HM JSON messages: %v", err)
+	}
+}
+
+func (l *HMTSDBListener) processHMJSONMessage(hmMessage []byte, remoteAddr net.Addr) error {
+	log.Debugf("Parsing BOSH HM JSON message `%s`", hmMessage)
+
+	event := hmJSONEvent{}
+	if err := json.Unmarshal(hmMessage, &event); err != nil {
+		return fmt.Errorf("BOSH HM JSON message discarded, it cannot be parsed: %v", err)
+	}
+
+	switch event.Kind {
+	case "heartbeat":
+		heartbeat, hmMetrics, err := parseHMJSONHeartbeat(hmMessage)
+		if err != nil {
+			return fmt.Errorf("BOSH HM JSON heartbeat discarded, %v", err)
+		}
+		collector := l.routeHMMetric(hmMetrics[0], remoteAddr)
+		timestamp := time.Unix(heartbeat.Timestamp, 0)
+		if err := collector.validateTimestamp(timestamp); err != nil {
+			log.Errorf("BOSH HM JSON heartbeat rejected: %v", err)
+			return nil
+		}
+
+		for _, hmMetric := range hmMetrics {
+			l.publishHMMetric(collector, hmMetric)
+		}
+		if heartbeat.JobState != "" {
+			collector.processHMJobState(hmMetrics[0], heartbeat.JobState, timestamp)
+		}
+	case "alert":
+		hmAlert, err := parseHMJSONAlert(hmMessage)
+		if err != nil {
+			return fmt.Errorf("BOSH HM JSON alert discarded, %v", err)
+		}
+		l.routeHMAlert(hmAlert, remoteAddr).processHMAlert(hmAlert)
+	default:
+		return fmt.Errorf("BOSH HM JSON message discarded, kind `%s` is not supported", event.Kind)
+	}
+
+	return nil
+}
+
+func (c *HMTSDBCollector) processHMJobState(hmMetric HMMetric, state string, timestamp time.Time) {
+	jobLabelValues := []string{hmMetric.Deployment, hmMetric.Job, hmMetric.Id, hmMetric.Index}
+
+	c.jobMetricsMutex.Lock()
+	defer c.jobMetricsMutex.Unlock()
+
+	previous := c.jobStateMetric.withPrefix(jobLabelValues)
+	for _, series := range previous {
+		if series.timestamp.After(timestamp) {
+			return
+		}
+	}
+	for _, series := range previous {
+		c.jobStateMetric.remove(series.labelValues)
+	}
+	c.jobStateMetric.set(concatStrings(jobLabelValues, []string{state}), 1, timestamp, time.Now())
+}
+
+func parseHMJSONHeartbeat(hmMessage []byte) (hmJSONHeartbeat, []HMMetric, error) {
+	heartbeat := hmJSONHeartbeat{}
+	if err := json.Unmarshal(hmMessage, &heartbeat); err != nil {
+		return heartbeat, nil, err
+	}
+
+	metrics := heartbeat.Metrics
+	for _, metric := range heartbeat.Vitals.metrics(heartbeat.JobState) {
+		if !hasHMJSONHeartbeatMetric(heartbeat.Metrics, metric.Name) {
+			metrics = append(metrics, metric)
+		}
+	}
+	if len(metrics) == 0 {
+		return heartbeat, nil, errors.New("it has no metrics")
+	}
+
+	hmMetrics := []HMMetric{}
+	for _, metric := range metrics {
+		if metric.Name == "" {
+			return heartbeat, nil, errors.New("metric name is empty")
+		}
+
+		value, err := strconv.ParseFloat(unquoteJSONNumber(metric.Value), 64)
+		if err != nil {
+			return heartbeat, nil, fmt.Errorf("metric `%s` value cannot be parsed as float: %v", metric.Name, err)
+		}
+
+		timestamp := time.Unix(heartbeat.Timestamp, 0)
+		if len(metric.Timestamp) > 0 {
+			timestamp, err = parseTimestamp(unquoteJSONNumber(metric.Timestamp))
+			if err != nil {
+				return heartbeat, nil, fmt.Errorf("metric `%s` timestamp cannot be parsed: %v", metric.Name, err)
+			}
+		}
+
+		tags := map[string]string{
+			"deployment": heartbeat.Deployment,
+			"job":        heartbeat.Job,
+			"index":      unquoteJSONNumber(heartbeat.Index),
+			"id":         heartbeat.InstanceId,
+		}
+		if heartbeat.AgentId != "" {
+			tags["agent_id"] = heartbeat.AgentId
+		}
+		for tag, tagValue := range metric.Tags {
+			tags[tag] = tagValue
+		}
+
+		hmMetrics = append(hmMetrics, newHMMetric(metric.Name, value, timestamp, tags))
+	}
+
+	return heartbeat, hmMetrics, nil
+}
+
+func hasHMJSONHeartbeatMetric(metrics []hmJSONHeartbeatMetric, name string) bool {
+	for _, metric := range metrics {
+		if metric.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseHMJSONAlert(hmMessage []byte) (HMAlert, error) {
+	alert := hmJSONAlert{}
+	if err := json.Unmarshal(hmMessage, &alert); err != nil {
+		return HMAlert{}, err
+	}
+
+	createdAt := time.Time{}
+	if alert.CreatedAt > 0 {
+		createdAt = time.Unix(alert.CreatedAt, 0)
+	}
+
+	return HMAlert{
+		Id:         alert.Id,
+		Severity:   alert.Severity,
+		Category:   alert.Category,
+		Title:      alert.Title,
+		Summary:    alert.Summary,
+		Source:     alert.Source,
+		Deployment: alert.Deployment,
+		CreatedAt:  createdAt,
+	}, nil
+}
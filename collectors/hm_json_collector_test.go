@@ -0,0 +1,325 @@
+package collectors_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("HMJSONCollector", func() {
+	var (
+		namespace       string
+		environment     string
+		tsdbListener    net.Listener
+		config          HMTSDBCollectorConfig
+		hmTSDBCollector *HMTSDBCollector
+		hmTSDBListener  *HMTSDBListener
+		hmJSONCollector *HMJSONCollector
+
+		hmMessages string
+		jobMetrics chan prometheus.Metric
+		metrics    chan prometheus.Metric
+
+		jobHealthyMetric                       *prometheus.GaugeVec
+		jobLoadAvg01Metric                     *prometheus.GaugeVec
+		jobCPUSysMetric                        *prometheus.GaugeVec
+		jobStateMetric                         *prometheus.GaugeVec
+		totalAlertsMetric                      *prometheus.CounterVec
+		totalReceivedJSONMessagesMetric        prometheus.Counter
+		totalInvalidJSONMessagesMetric         prometheus.Counter
+		lastReceivedJSONMessageTimestampMetric prometheus.Gauge
+
+		deploymentName = "fake-deployment-name"
+		jobName        = "fake-job-name"
+		jobID          = "fake-job-id"
+		jobIndex       = "0"
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		config = HMTSDBCollectorConfig{}
+
+		jobHealthyMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "healthy",
+				Help:      "BOSH Job Healthy (1 for healthy, 0 for unhealthy).",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+		)
+
+		jobLoadAvg01Metric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "load_avg01",
+				Help:      "BOSH Job Load avg01.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+		)
+
+		jobCPUSysMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "cpu_sys",
+				Help:      "BOSH Job CPU System.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+		)
+
+		jobStateMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "state",
+				Help:      "BOSH Job state reported by the BOSH HM `json` plugin heartbeats (1 for the current state).",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index", "state"},
+		)
+
+		totalAlertsMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "alerts_total",
+				Help:      "Total number of BOSH HM alerts received.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "severity", "category", "source"},
+		)
+
+		totalReceivedJSONMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "received_json_messages_total",
+				Help:      "Total number of BOSH HM JSON received messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalInvalidJSONMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "invalid_json_messages_total",
+				Help:      "Total number of BOSH HM JSON invalid messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		lastReceivedJSONMessageTimestampMetric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "last_received_json_message_timestamp",
+				Help:      "Number of seconds since 1970 since last received message from BOSH HM JSON.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	JustBeforeEach(func() {
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener(namespace, environment, config, HMTSDBListenerConfig{})
+		hmJSONCollector = NewHMJSONCollector(namespace, environment, hmTSDBListener, strings.NewReader(hmMessages))
+		Eventually(hmJSONCollector.Done()).Should(BeClosed())
+
+		jobMetrics = make(chan prometheus.Metric, 100)
+		hmTSDBCollector.Collect(jobMetrics)
+		close(jobMetrics)
+
+		metrics = make(chan prometheus.Metric, 100)
+		hmJSONCollector.Collect(metrics)
+		close(metrics)
+	})
+
+	Describe("Describe", func() {
+		var (
+			descriptions chan *prometheus.Desc
+		)
+
+		BeforeEach(func() {
+			hmMessages = ""
+			descriptions = make(chan *prometheus.Desc)
+		})
+
+		JustBeforeEach(func() {
+			go hmJSONCollector.Describe(descriptions)
+		})
+
+		It("returns a received_json_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalReceivedJSONMessagesMetric.Desc())))
+		})
+
+		It("returns a invalid_json_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalInvalidJSONMessagesMetric.Desc())))
+		})
+
+		It("returns a last_received_json_message_timestamp metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(lastReceivedJSONMessageTimestampMetric.Desc())))
+		})
+	})
+
+	Context("when a heartbeat is received", func() {
+		BeforeEach(func() {
+			timestamp := time.Now().Unix()
+			hmMessages = fmt.Sprintf(
+				`{"kind":"heartbeat","id":"fake-heartbeat-id","timestamp":%d,"deployment":"%s","agent_id":"fake-agent-id","job":"%s","index":"%s","instance_id":"%s","job_state":"running","vitals":{},"metrics":[{"name":"system.healthy","value":"1","timestamp":%d,"tags":{"job":"%s","index":"%s","id":"%s"}},{"name":"system.load.1m","value":"0.5","timestamp":%d,"tags":{"job":"%s","index":"%s","id":"%s"}}]}`+"\n",
+				timestamp, deploymentName, jobName, jobIndex, jobID,
+				timestamp, jobName, jobIndex, jobID,
+				timestamp, jobName, jobIndex, jobID,
+			)
+			jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(1)
+			jobLoadAvg01Metric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(0.5)
+			totalReceivedJSONMessagesMetric.Inc()
+		})
+
+		It("returns a job_healthy metric", func() {
+			Expect(jobMetrics).To(Receive(PrometheusMetric(jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+		})
+
+		It("returns a job_load_avg01 metric", func() {
+			Eventually(jobMetrics).Should(Receive(PrometheusMetric(jobLoadAvg01Metric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+		})
+
+		It("returns a received_json_messages_total metric", func() {
+			Expect(metrics).To(Receive(PrometheusMetric(totalReceivedJSONMessagesMetric)))
+		})
+	})
+
+	Context("when a heartbeat only carries vitals", func() {
+		BeforeEach(func() {
+			timestamp := time.Now().Unix()
+			hmMessages = fmt.Sprintf(
+				`{"kind":"heartbeat","id":"fake-heartbeat-id","timestamp":%d,"deployment":"%s","agent_id":"fake-agent-id","job":"%s","index":"%s","instance_id":"%s","job_state":"failing","vitals":{"cpu":{"sys":"2.5","user":"10.1","wait":"0.2"},"load":["0.5","0.4","0.3"]},"metrics":[]}`+"\n",
+				timestamp, deploymentName, jobName, jobIndex, jobID,
+			)
+			jobCPUSysMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(2.5)
+			jobLoadAvg01Metric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(0.5)
+			jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(0)
+		})
+
+		It("returns a job_cpu_sys metric", func() {
+			Eventually(jobMetrics).Should(Receive(PrometheusMetric(jobCPUSysMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+		})
+
+		It("returns a job_load_avg01 metric", func() {
+			Eventually(jobMetrics).Should(Receive(PrometheusMetric(jobLoadAvg01Metric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+		})
+
+		It("returns a job_healthy metric from the job state", func() {
+			Eventually(jobMetrics).Should(Receive(PrometheusMetric(jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+		})
+	})
+
+	Context("when the job state of an instance changes", func() {
+		BeforeEach(func() {
+			timestamp := time.Now().Unix()
+			hmMessages = ""
+			for i, jobState := range []string{"running", "failing"} {
+				hmMessages += fmt.Sprintf(
+					`{"kind":"heartbeat","id":"fake-heartbeat-id","timestamp":%d,"deployment":"%s","agent_id":"fake-agent-id","job":"%s","index":"%s","instance_id":"%s","job_state":"%s","vitals":{"cpu":{"sys":"2.5"}},"metrics":[]}`+"\n",
+					timestamp+int64(i), deploymentName, jobName, jobIndex, jobID, jobState,
+				)
+			}
+			jobStateMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex, "failing").Set(1)
+		})
+
+		It("returns a job_state metric for the current state", func() {
+			Eventually(jobMetrics).Should(Receive(PrometheusMetric(jobStateMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex, "failing"))))
+		})
+
+		It("does not return a job_state metric for the previous state", func() {
+			Consistently(jobMetrics).ShouldNot(Receive(PrometheusMetric(jobStateMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex, "running"))))
+		})
+	})
+
+	Context("when the timestamp of a heartbeat is out of bounds", func() {
+		BeforeEach(func() {
+			config.TimestampPolicy = TimestampPolicy{MaxFuture: time.Hour}
+			timestamp := time.Now().Unix()
+			hmMessages = ""
+			for i, jobState := range []string{"failing", "running"} {
+				hmMessages += fmt.Sprintf(
+					`{"kind":"heartbeat","id":"fake-heartbeat-id","timestamp":%d,"deployment":"%s","agent_id":"fake-agent-id","job":"%s","index":"%s","instance_id":"%s","job_state":"%s","vitals":{"cpu":{"sys":"2.5"}},"metrics":[]}`+"\n",
+					timestamp+int64(i)*int64(2*time.Hour/time.Second), deploymentName, jobName, jobIndex, jobID, jobState,
+				)
+			}
+			jobStateMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex, "failing").Set(1)
+		})
+
+		It("keeps the job_state metric of the previous heartbeat", func() {
+			Eventually(jobMetrics).Should(Receive(PrometheusMetric(jobStateMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex, "failing"))))
+		})
+
+		It("does not return a job_state metric for the rejected heartbeat", func() {
+			Consistently(jobMetrics).ShouldNot(Receive(PrometheusMetric(jobStateMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex, "running"))))
+		})
+	})
+
+	Context("when an alert is received", func() {
+		BeforeEach(func() {
+			hmMessages = fmt.Sprintf(
+				`{"kind":"alert","id":"fake-alert-id","severity":2,"category":null,"title":"fake-title","summary":"fake-summary","source":"fake-source","deployment":"%s","created_at":%d}`+"\n",
+				deploymentName, time.Now().Unix(),
+			)
+			totalAlertsMetric.WithLabelValues(deploymentName, "critical", "", "fake-source").Inc()
+		})
+
+		It("returns an alerts_total metric", func() {
+			Eventually(jobMetrics).Should(Receive(PrometheusMetric(totalAlertsMetric.WithLabelValues(deploymentName, "critical", "", "fake-source"))))
+		})
+	})
+
+	Context("when an invalid message is received", func() {
+		BeforeEach(func() {
+			hmMessages = "{\"kind\":\n{\"kind\":\"unknown\"}\n"
+			totalReceivedJSONMessagesMetric.Add(2)
+			totalInvalidJSONMessagesMetric.Add(2)
+		})
+
+		It("returns a received_json_messages_total metric", func() {
+			Expect(metrics).To(Receive(PrometheusMetric(totalReceivedJSONMessagesMetric)))
+		})
+
+		It("returns a invalid_json_messages_total metric", func() {
+			Eventually(metrics).Should(Receive(PrometheusMetric(totalInvalidJSONMessagesMetric)))
+		})
+	})
+})
@@ -0,0 +1,74 @@
+package collectors
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/log"
+)
+
+// HMJSONHTTPHandler is a webhook accepting heartbeats and alerts in the format
+// of the BOSH HM `json` plugin, one JSON event per line, and publishing them
+// through a HMTSDBListener.
+type HMJSONHTTPHandler struct {
+	listener *HMTSDBListener
+}
+
+func NewHMJSONHTTPHandler(listener *HMTSDBListener) *HMJSONHTTPHandler {
+	return &HMJSONHTTPHandler{listener: listener}
+}
+
+func (h *HMJSONHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf("The HTTP method [%s] is not permitted for this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := readOpenTSDBBody(w, r)
+	if err == errOpenTSDBBodyTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read the request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	remoteAddr := requestRemoteAddr(r)
+	allowHMMessage, releaseHMSource := h.listener.limitHMSource(remoteAddr)
+	defer releaseHMSource()
+
+	errs := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), maxHMJSONMessageSize)
+	for scanner.Scan() {
+		hmMessage := bytes.TrimSpace(scanner.Bytes())
+		if len(hmMessage) == 0 {
+			continue
+		}
+
+		if !allowHMMessage() {
+			errs = append(errs, "BOSH HM JSON message discarded, rate limit exceeded")
+			continue
+		}
+
+		if err := h.listener.processHMJSONMessage(hmMessage, remoteAddr); err != nil {
+			log.Error(err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		http.Error(w, strings.Join(errs, "\n"), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,161 @@
+package collectors_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("HMJSONHTTPHandler", func() {
+	var (
+		namespace       string
+		environment     string
+		tsdbListener    net.Listener
+		hmTSDBCollector *HMTSDBCollector
+		hmTSDBListener  *HMTSDBListener
+		handler         *HMJSONHTTPHandler
+
+		method    string
+		body      string
+		recorder  *httptest.ResponseRecorder
+		createdAt int64
+
+		totalAlertsMetric        *prometheus.CounterVec
+		alertLastTimestampMetric *prometheus.GaugeVec
+
+		deploymentName = "fake-deployment-name"
+		alertSource    = "fake-deployment-name: fake-job-name(fake-job-id) [id=fake-agent-id, index=0, cid=fake-cid]"
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener(namespace, environment, HMTSDBCollectorConfig{}, HMTSDBListenerConfig{})
+		handler = NewHMJSONHTTPHandler(hmTSDBListener)
+
+		method = "POST"
+		createdAt = time.Now().Unix()
+
+		totalAlertsMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "alerts_total",
+				Help:      "Total number of BOSH HM alerts received.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "severity", "category", "source"},
+		)
+
+		alertLastTimestampMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "alert_last_timestamp_seconds",
+				Help:      "Number of seconds since 1970 of the last BOSH HM alert.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "severity", "category", "source"},
+		)
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	JustBeforeEach(func() {
+		request := httptest.NewRequest(method, "/api/hm/events", bytes.NewReader([]byte(body)))
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+	})
+
+	alert := func(severity int, category string) string {
+		return fmt.Sprintf(
+			`{"kind":"alert","id":"fake-alert-id","severity":%d,"category":%s,"title":"fake-title","summary":"fake-summary","source":"%s","deployment":"%s","created_at":%d}`,
+			severity, category, alertSource, deploymentName, createdAt,
+		)
+	}
+
+	collect := func() chan prometheus.Metric {
+		metrics := make(chan prometheus.Metric, 100)
+		hmTSDBCollector.Collect(metrics)
+		close(metrics)
+		return metrics
+	}
+
+	Context("when alerts are posted", func() {
+		BeforeEach(func() {
+			body = alert(4, `"vm_health"`) + "\n" + alert(4, `"vm_health"`) + "\n" + alert(1, "null") + "\n"
+			totalAlertsMetric.WithLabelValues(deploymentName, "warning", "vm_health", alertSource).Add(2)
+			totalAlertsMetric.WithLabelValues(deploymentName, "alert", "", alertSource).Inc()
+			alertLastTimestampMetric.WithLabelValues(deploymentName, "warning", "vm_health", alertSource).Set(float64(createdAt))
+		})
+
+		It("returns a 204 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusNoContent))
+		})
+
+		It("returns an alerts_total metric by severity and category", func() {
+			metrics := collect()
+			Eventually(metrics).Should(Receive(PrometheusMetric(totalAlertsMetric.WithLabelValues(deploymentName, "warning", "vm_health", alertSource))))
+		})
+
+		It("returns an alerts_total metric for alerts without category", func() {
+			metrics := collect()
+			Eventually(metrics).Should(Receive(PrometheusMetric(totalAlertsMetric.WithLabelValues(deploymentName, "alert", "", alertSource))))
+		})
+
+		It("returns an alert_last_timestamp_seconds metric", func() {
+			metrics := collect()
+			Eventually(metrics).Should(Receive(PrometheusMetric(alertLastTimestampMetric.WithLabelValues(deploymentName, "warning", "vm_health", alertSource))))
+		})
+	})
+
+	Context("when an invalid event is posted", func() {
+		BeforeEach(func() {
+			body = `{"kind":"unknown"}`
+		})
+
+		It("returns a 400 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(recorder.Body.String()).To(ContainSubstring("kind `unknown` is not supported"))
+		})
+	})
+
+	Context("when the body is too large", func() {
+		BeforeEach(func() {
+			body = alert(4, `"vm_health"`) + strings.Repeat("\n", 8*1024*1024)
+		})
+
+		It("returns a 413 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+	})
+
+	Context("when the method is not POST", func() {
+		BeforeEach(func() {
+			method = "GET"
+			body = ""
+		})
+
+		It("returns a 405 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
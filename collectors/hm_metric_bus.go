@@ -0,0 +1,197 @@
+package collectors
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink consumes the BOSH HM metrics published on a HMMetricBus.
+type Sink interface {
+	SinkName() string
+
+	// Consume is called from a single goroutine per queued subscription.
+	Consume(environment string, hmMetric HMMetric)
+}
+
+// HMMetricBus fans the BOSH HM metrics accepted by the listeners out to the
+// subscribed Sinks. Queued subscriptions drop the metrics their queue cannot
+// hold, so a slow sink cannot stall ingestion, while synchronous ones consume
+// every metric from the publishing listener.
+type HMMetricBus struct {
+	sync.RWMutex
+	queueSize                  int
+	subscriptions              []*hmMetricSubscription
+	closed                     bool
+	sinkQueueLengthMetric      *prometheus.GaugeVec
+	totalConsumedMetricsMetric *prometheus.CounterVec
+	totalDroppedMetricsMetric  *prometheus.CounterVec
+}
+
+type hmMetricSubscription struct {
+	sink        Sink
+	environment string
+	queue       chan publishedHMMetric
+	consumed    prometheus.Counter
+}
+
+type publishedHMMetric struct {
+	environment string
+	hmMetric    HMMetric
+}
+
+// NewHMMetricBus returns a HMMetricBus queuing up to `queueSize` metrics per
+// subscription.
+func NewHMMetricBus(namespace string, environment string, queueSize int) *HMMetricBus {
+	sinkQueueLengthMetric := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "sink_queue_length",
+			Help:      "Number of BOSH HM metrics waiting to be consumed by the sink.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+		[]string{"sink"},
+	)
+
+	totalConsumedMetricsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "sink_consumed_metrics_total",
+			Help:      "Total number of BOSH HM metrics consumed by the sink.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+		[]string{"sink"},
+	)
+
+	totalDroppedMetricsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "sink_dropped_metrics_total",
+			Help:      "Total number of BOSH HM metrics not consumed by the sink because its queue was full.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+		[]string{"sink"},
+	)
+
+	return &HMMetricBus{
+		queueSize:                  queueSize,
+		sinkQueueLengthMetric:      sinkQueueLengthMetric,
+		totalConsumedMetricsMetric: totalConsumedMetricsMetric,
+		totalDroppedMetricsMetric:  totalDroppedMetricsMetric,
+	}
+}
+
+// Subscribe subscribes a Sink to the metrics of every environment through a
+// queue.
+func (b *HMMetricBus) Subscribe(sink Sink) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	subscription := &hmMetricSubscription{
+		sink:     sink,
+		queue:    make(chan publishedHMMetric, b.queueSize),
+		consumed: b.totalConsumedMetricsMetric.WithLabelValues(sink.SinkName()),
+	}
+	b.subscriptions = append(b.subscriptions, subscription)
+
+	b.totalDroppedMetricsMetric.WithLabelValues(sink.SinkName())
+	go func() {
+		for published := range subscription.queue {
+			sink.Consume(published.environment, published.hmMetric)
+			subscription.consumed.Inc()
+		}
+	}()
+}
+
+// subscribeSync subscribes a Sink to the metrics of an environment, consuming
+// them in Publish so none is ever dropped.
+func (b *HMMetricBus) subscribeSync(sink Sink, environment string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.subscriptions = append(b.subscriptions, &hmMetricSubscription{
+		sink:        sink,
+		environment: environment,
+		consumed:    b.totalConsumedMetricsMetric.WithLabelValues(sink.SinkName()),
+	})
+}
+
+// Publish hands a BOSH HM metric of an environment to every subscribed Sink,
+// dropping it for the queued sinks whose queue is full.
+func (b *HMMetricBus) Publish(environment string, hmMetric HMMetric) {
+	b.RLock()
+	defer b.RUnlock()
+
+	for _, subscription := range b.subscriptions {
+		if subscription.environment != "" && subscription.environment != environment {
+			continue
+		}
+
+		if subscription.queue == nil {
+			subscription.sink.Consume(environment, hmMetric)
+			subscription.consumed.Inc()
+			continue
+		}
+
+		select {
+		case subscription.queue <- publishedHMMetric{environment: environment, hmMetric: hmMetric}:
+		default:
+			b.totalDroppedMetricsMetric.WithLabelValues(subscription.sink.SinkName()).Inc()
+		}
+	}
+}
+
+func (b *HMMetricBus) Close() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for _, subscription := range b.subscriptions {
+		if subscription.queue != nil {
+			close(subscription.queue)
+		}
+	}
+	b.subscriptions = nil
+}
+
+func (b *HMMetricBus) Collect(ch chan<- prometheus.Metric) {
+	b.RLock()
+	for _, subscription := range b.subscriptions {
+		if subscription.queue == nil {
+			continue
+		}
+		b.sinkQueueLengthMetric.WithLabelValues(subscription.sink.SinkName()).Set(float64(len(subscription.queue)))
+	}
+	b.RUnlock()
+
+	b.sinkQueueLengthMetric.Collect(ch)
+	b.totalConsumedMetricsMetric.Collect(ch)
+	b.totalDroppedMetricsMetric.Collect(ch)
+}
+
+func (b *HMMetricBus) Describe(ch chan<- *prometheus.Desc) {
+	b.sinkQueueLengthMetric.Describe(ch)
+	b.totalConsumedMetricsMetric.Describe(ch)
+	b.totalDroppedMetricsMetric.Describe(ch)
+}
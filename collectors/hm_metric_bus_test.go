@@ -0,0 +1,304 @@
+package collectors_test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("HMMetricBus", func() {
+	var (
+		namespace   string
+		environment string
+		queueSize   int
+		hmMetricBus *HMMetricBus
+		sink        *fakeSink
+
+		sinkQueueLengthMetric      *prometheus.GaugeVec
+		totalConsumedMetricsMetric *prometheus.CounterVec
+		totalDroppedMetricsMetric  *prometheus.CounterVec
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		queueSize = 100
+		sink = newFakeSink("fake-sink")
+
+		sinkQueueLengthMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "sink_queue_length",
+				Help:      "Number of BOSH HM metrics waiting to be consumed by the sink.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"sink"},
+		)
+
+		totalConsumedMetricsMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "sink_consumed_metrics_total",
+				Help:      "Total number of BOSH HM metrics consumed by the sink.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"sink"},
+		)
+
+		totalDroppedMetricsMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "sink_dropped_metrics_total",
+				Help:      "Total number of BOSH HM metrics not consumed by the sink because its queue was full.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"sink"},
+		)
+	})
+
+	JustBeforeEach(func() {
+		hmMetricBus = NewHMMetricBus(namespace, environment, queueSize)
+		hmMetricBus.Subscribe(sink)
+	})
+
+	AfterEach(func() {
+		sink.release()
+		hmMetricBus.Close()
+	})
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		hmMetricBus.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	Describe("Describe", func() {
+		var descriptions chan *prometheus.Desc
+
+		JustBeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+			go hmMetricBus.Describe(descriptions)
+		})
+
+		It("returns a sink_queue_length metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(sinkQueueLengthMetric.WithLabelValues("fake-sink").Desc())))
+		})
+
+		It("returns a sink_consumed_metrics_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalConsumedMetricsMetric.WithLabelValues("fake-sink").Desc())))
+		})
+
+		It("returns a sink_dropped_metrics_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalDroppedMetricsMetric.WithLabelValues("fake-sink").Desc())))
+		})
+	})
+
+	It("delivers the published metrics to every sink", func() {
+		otherSink := newFakeSink("other-sink")
+		hmMetricBus.Subscribe(otherSink)
+
+		hmMetricBus.Publish("fake-environment-1", HMMetric{Name: "system.healthy", Id: "fake-id-1"})
+		hmMetricBus.Publish("fake-environment-2", HMMetric{Name: "system.healthy", Id: "fake-id-2"})
+
+		consumed := []string{"fake-environment-1 system.healthy fake-id-1", "fake-environment-2 system.healthy fake-id-2"}
+		Eventually(sink.consumed).Should(Equal(consumed))
+		Eventually(otherSink.consumed).Should(Equal(consumed))
+
+		totalConsumedMetricsMetric.WithLabelValues("fake-sink").Add(2)
+		Eventually(collect).Should(ContainElement(PrometheusMetric(totalConsumedMetricsMetric.WithLabelValues("fake-sink"))))
+	})
+
+	Context("when a sink queue is full", func() {
+		BeforeEach(func() {
+			queueSize = 1
+			sink.block()
+			sinkQueueLengthMetric.WithLabelValues("fake-sink").Set(1)
+			totalDroppedMetricsMetric.WithLabelValues("fake-sink").Inc()
+		})
+
+		It("drops the metrics for that sink only", func() {
+			otherSink := newFakeSink("other-sink")
+			hmMetricBus.Subscribe(otherSink)
+
+			hmMetricBus.Publish(environment, HMMetric{Name: "system.healthy", Id: "fake-id-1"})
+			Eventually(sink.consuming).Should(Receive())
+			hmMetricBus.Publish(environment, HMMetric{Name: "system.healthy", Id: "fake-id-2"})
+			hmMetricBus.Publish(environment, HMMetric{Name: "system.healthy", Id: "fake-id-3"})
+
+			Eventually(otherSink.consumed).Should(HaveLen(3))
+
+			metrics := collect()
+			Expect(metrics).To(ContainElement(PrometheusMetric(sinkQueueLengthMetric.WithLabelValues("fake-sink"))))
+			Expect(metrics).To(ContainElement(PrometheusMetric(totalDroppedMetricsMetric.WithLabelValues("fake-sink"))))
+
+			sink.release()
+			Eventually(sink.consumed).Should(Equal([]string{
+				"test_environment system.healthy fake-id-1",
+				"test_environment system.healthy fake-id-2",
+			}))
+		})
+	})
+
+	Context("when the bus is closed", func() {
+		It("stops delivering the metrics", func() {
+			hmMetricBus.Close()
+			hmMetricBus.Publish(environment, HMMetric{Name: "system.healthy"})
+
+			Consistently(sink.consumed).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("HMTSDBCollector with a HMMetricBus", func() {
+	var (
+		tsdbListener    net.Listener
+		hmMetricBus     *HMMetricBus
+		sink            *fakeSink
+		hmTSDBCollector *HMTSDBCollector
+	)
+
+	BeforeEach(func() {
+		sink = newFakeSink("fake-sink")
+		hmMetricBus = NewHMMetricBus("test_exporter", "test_environment", 100)
+		hmMetricBus.Subscribe(sink)
+
+		hmTSDBCollector, _, tsdbListener = newTestHMTSDBListener("test_exporter", "test_environment", HMTSDBCollectorConfig{
+			TimestampPolicy: TimestampPolicy{MaxAge: time.Hour},
+			HMMetricBus:     hmMetricBus,
+		}, HMTSDBListenerConfig{})
+	})
+
+	AfterEach(func() {
+		sink.release()
+		hmMetricBus.Close()
+		tsdbListener.Close()
+	})
+
+	It("publishes the metrics with a valid timestamp to the sinks and itself", func() {
+		conn, err := net.Dial("tcp", tsdbListener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "put system.healthy %d 1 deployment=fake-deployment job=fake-job index=0 id=fake-id\n", time.Now().Unix())
+		fmt.Fprint(conn, "put system.healthy 1 1 deployment=fake-deployment job=fake-job index=0 id=fake-id\n")
+
+		Eventually(sink.consumed).Should(HaveLen(1))
+		Consistently(sink.consumed).Should(HaveLen(1))
+		Expect(sink.consumed()[0]).To(Equal("test_environment system.healthy fake-id"))
+
+		Expect(hmTSDBCollector.SinkName()).To(Equal("prometheus/test_environment"))
+		totalConsumedMetricsMetric := prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "test_exporter",
+				Subsystem: "",
+				Name:      "sink_consumed_metrics_total",
+				Help:      "Total number of BOSH HM metrics consumed by the sink.",
+				ConstLabels: prometheus.Labels{
+					"environment": "test_environment",
+					"sink":        "prometheus/test_environment",
+				},
+			},
+		)
+		totalConsumedMetricsMetric.Inc()
+
+		collect := func() []prometheus.Metric {
+			ch := make(chan prometheus.Metric, 100)
+			hmMetricBus.Collect(ch)
+			close(ch)
+
+			metrics := []prometheus.Metric{}
+			for metric := range ch {
+				metrics = append(metrics, metric)
+			}
+			return metrics
+		}
+		Eventually(collect).Should(ContainElement(PrometheusMetric(totalConsumedMetricsMetric)))
+	})
+
+	It("does not drop any metric when the queue of another sink is full", func() {
+		sink.block()
+
+		conn, err := net.Dial("tcp", tsdbListener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		for i := 0; i < 200; i++ {
+			fmt.Fprintf(conn, "put system.healthy %d 1 deployment=fake-deployment job=fake-job index=0 id=fake-id-%d\n", time.Now().Unix(), i)
+		}
+		conn.Close()
+
+		Eventually(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(HaveLen(200))
+	})
+})
+
+// fakeSink records the metrics it consumes. A blocked fakeSink signals on
+// `consuming` and waits to be released before consuming every metric.
+type fakeSink struct {
+	name      string
+	mutex     sync.Mutex
+	messages  []string
+	blocked   chan struct{}
+	unblocked sync.Once
+	consuming chan struct{}
+}
+
+func newFakeSink(name string) *fakeSink {
+	return &fakeSink{
+		name:      name,
+		consuming: make(chan struct{}, 100),
+	}
+}
+
+func (s *fakeSink) SinkName() string {
+	return s.name
+}
+
+func (s *fakeSink) Consume(environment string, hmMetric HMMetric) {
+	if s.blocked != nil {
+		s.consuming <- struct{}{}
+		<-s.blocked
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messages = append(s.messages, fmt.Sprintf("%s %s %s", environment, hmMetric.Name, hmMetric.Id))
+}
+
+// block must be called before the sink is subscribed.
+func (s *fakeSink) block() {
+	s.blocked = make(chan struct{})
+}
+
+func (s *fakeSink) release() {
+	if s.blocked != nil {
+		s.unblocked.Do(func() { close(s.blocked) })
+	}
+}
+
+func (s *fakeSink) consumed() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.messages...)
+}
@@ -1,12 +1,8 @@
 package collectors
 
 import (
-	"bufio"
-	"errors"
 	"fmt"
-	"net"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,279 +16,165 @@ type HMMetric struct {
 	Job        string
 	Index      string
 	Id         string
+	Tags       map[string]string
+	Timestamp  time.Time
+}
+
+func newHMMetric(name string, value float64, timestamp time.Time, tags map[string]string) HMMetric {
+	return HMMetric{
+		Name:       name,
+		Value:      value,
+		Deployment: tags["deployment"],
+		Job:        tags["job"],
+		Index:      tags["index"],
+		Id:         tags["id"],
+		Tags:       tags,
+		Timestamp:  timestamp,
+	}
+}
+
+type HMTSDBCollectorConfig struct {
+	MetricMapper        *MetricMapper
+	PassthroughFilter   *PassthroughFilter
+	MetricsTTL          time.Duration
+	TimestampPolicy     TimestampPolicy
+	HeartbeatPolicy     HeartbeatPolicy
+	HMMetricBus         *HMMetricBus
+	ReservedMetricNames *ReservedMetricNames
 }
 
 type HMTSDBCollector struct {
-	tsdbListener                           net.Listener
-	jobHealthyMetric                       *prometheus.GaugeVec
-	jobLoadAvg01Metric                     *prometheus.GaugeVec
-	jobCPUSysMetric                        *prometheus.GaugeVec
-	jobCPUUserMetric                       *prometheus.GaugeVec
-	jobCPUWaitMetric                       *prometheus.GaugeVec
-	jobMemKBMetric                         *prometheus.GaugeVec
-	jobMemPercentMetric                    *prometheus.GaugeVec
-	jobSwapKBMetric                        *prometheus.GaugeVec
-	jobSwapPercentMetric                   *prometheus.GaugeVec
-	jobSystemDiskInodePercentMetric        *prometheus.GaugeVec
-	jobSystemDiskPercentMetric             *prometheus.GaugeVec
-	jobEphemeralDiskInodePercentMetric     *prometheus.GaugeVec
-	jobEphemeralDiskPercentMetric          *prometheus.GaugeVec
-	jobPersistentDiskInodePercentMetric    *prometheus.GaugeVec
-	jobPersistentDiskPercentMetric         *prometheus.GaugeVec
-	totalReceivedTSDBMessagesMetric        prometheus.Counter
-	totalInvalidTSDBMessagesMetric         prometheus.Counter
-	totalDiscardedTSDBMessagesMetric       prometheus.Counter
-	lastReceivedTSDBMessageTimestampMetric prometheus.Gauge
-	lastHMTSDBScrapeTimestampMetric        prometheus.Gauge
-	lastHMTSDBScrapeDurationSecondsMetric  prometheus.Gauge
+	namespace                             string
+	environment                           string
+	metricMapper                          *MetricMapper
+	passthroughFilter                     *PassthroughFilter
+	metricsTTL                            time.Duration
+	timestampPolicy                       TimestampPolicy
+	heartbeatPolicy                       HeartbeatPolicy
+	reservedMetricNames                   *ReservedMetricNames
+	jobMetricsMutex                       sync.Mutex
+	jobMetrics                            []*jobMetric
+	jobMetricsByName                      map[string]*jobMetric
+	passthroughMetrics                    map[string]*jobMetric
+	jobLastHeartbeatTimestampMetric       *jobMetric
+	jobHeartbeatMissingMetric             *jobMetric
+	jobStateMetric                        *jobMetric
+	jobInstances                          map[string]*JobInstance
+	totalDiscardedTSDBMessagesMetric      prometheus.Counter
+	totalOutOfBoundsTSDBMessagesMetric    prometheus.Counter
+	totalSeriesExpiredMetric              prometheus.Counter
+	totalAlertsMetric                     *prometheus.CounterVec
+	alertLastTimestampMetric              *prometheus.GaugeVec
+	lastHMTSDBScrapeTimestampMetric       prometheus.Gauge
+	lastHMTSDBScrapeDurationSecondsMetric prometheus.Gauge
 }
 
 func NewHMTSDBCollector(
 	namespace string,
 	environment string,
-	tsdbListener net.Listener,
+	config HMTSDBCollectorConfig,
 ) *HMTSDBCollector {
-	jobHealthyMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "healthy",
-			Help:      "BOSH Job Healthy (1 for healthy, 0 for unhealthy).",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobLoadAvg01Metric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "load_avg01",
-			Help:      "BOSH Job Load avg01.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobCPUSysMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "cpu_sys",
-			Help:      "BOSH Job CPU System.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobCPUUserMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "cpu_user",
-			Help:      "BOSH Job CPU User.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobCPUWaitMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "cpu_wait",
-			Help:      "BOSH Job CPU Wait.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobMemKBMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "mem_kb",
-			Help:      "BOSH Job Memory KB.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobMemPercentMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "mem_percent",
-			Help:      "BOSH Job Memory Percent.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobSwapKBMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "swap_kb",
-			Help:      "BOSH Job Swap KB.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobSwapPercentMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "swap_percent",
-			Help:      "BOSH Job Swap Percent.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobSystemDiskInodePercentMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "system_disk_inode_percent",
-			Help:      "BOSH Job System Disk Inode Percent.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
+	jobMetrics := []*jobMetric{}
+	jobMetricsByName := map[string]*jobMetric{}
+	for _, mapping := range config.MetricMapper.Mappings() {
+		if _, ok := jobMetricsByName[prometheus.BuildFQName(namespace, "", mapping.Name)]; ok {
+			continue
+		}
+		jobMetric := newJobMetric(
+			prometheus.BuildFQName(namespace, "", mapping.Name),
+			mapping.Help,
+			mapping.ValueType(),
+			concatStrings(jobLabelNames, mapping.LabelNames(), config.MetricMapper.TagLabelNames()),
+			environment,
+		)
+		jobMetrics = append(jobMetrics, jobMetric)
+		jobMetricsByName[jobMetric.fqName] = jobMetric
+	}
 
-	jobSystemDiskPercentMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "system_disk_percent",
-			Help:      "BOSH Job System Disk Percent.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+	jobLastHeartbeatTimestampMetric := newJobMetric(
+		prometheus.BuildFQName(namespace, "job", "last_heartbeat_timestamp_seconds"),
+		"Number of seconds since 1970 of the last BOSH HM metric timestamp received from a BOSH Job.",
+		prometheus.GaugeValue,
+		jobLabelNames,
+		environment,
 	)
 
-	jobEphemeralDiskInodePercentMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "ephemeral_disk_inode_percent",
-			Help:      "BOSH Job Ephemeral Disk Inode Percent.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+	jobHeartbeatMissingMetric := newJobMetric(
+		prometheus.BuildFQName(namespace, "job", "heartbeat_missing"),
+		"BOSH Job heartbeat missing (1 when no BOSH HM metric was received from a BOSH Job for the configured number of heartbeat intervals, 0 otherwise).",
+		prometheus.GaugeValue,
+		jobLabelNames,
+		environment,
 	)
 
-	jobEphemeralDiskPercentMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "ephemeral_disk_percent",
-			Help:      "BOSH Job Ephemeral Disk Percent.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+	jobStateMetric := newJobMetric(
+		prometheus.BuildFQName(namespace, "job", "state"),
+		"BOSH Job state reported by the BOSH HM `json` plugin heartbeats (1 for the current state).",
+		prometheus.GaugeValue,
+		concatStrings(jobLabelNames, []string{"state"}),
+		environment,
 	)
 
-	jobPersistentDiskInodePercentMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "persistent_disk_inode_percent",
-			Help:      "BOSH Job Persistent Disk Inode Percent.",
-			ConstLabels: prometheus.Labels{
-				"environment": environment,
-			},
-		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
-	)
-
-	jobPersistentDiskPercentMetric := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
+	totalDiscardedTSDBMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
 			Namespace: namespace,
-			Subsystem: "job",
-			Name:      "persistent_disk_percent",
-			Help:      "BOSH Job Persistent Disk Percent.",
+			Subsystem: "",
+			Name:      "discarded_tsdb_messages_total",
+			Help:      "Total number of BOSH HM TSDB discarded messages.",
 			ConstLabels: prometheus.Labels{
 				"environment": environment,
 			},
 		},
-		[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
 	)
 
-	totalReceivedTSDBMessagesMetric := prometheus.NewCounter(
+	totalOutOfBoundsTSDBMessagesMetric := prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: "",
-			Name:      "received_tsdb_messages_total",
-			Help:      "Total number of BOSH HM TSDB received messages.",
+			Name:      "out_of_bounds_tsdb_messages_total",
+			Help:      "Total number of BOSH HM TSDB messages rejected because their timestamp is too old or too far in the future.",
 			ConstLabels: prometheus.Labels{
 				"environment": environment,
 			},
 		},
 	)
 
-	totalInvalidTSDBMessagesMetric := prometheus.NewCounter(
+	totalSeriesExpiredMetric := prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: "",
-			Name:      "invalid_tsdb_messages_total",
-			Help:      "Total number of BOSH HM TSDB invalid messages.",
+			Name:      "series_expired_total",
+			Help:      "Total number of BOSH Job metric series expired because they were not updated within the metrics TTL.",
 			ConstLabels: prometheus.Labels{
 				"environment": environment,
 			},
 		},
 	)
 
-	totalDiscardedTSDBMessagesMetric := prometheus.NewCounter(
+	totalAlertsMetric := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: "",
-			Name:      "discarded_tsdb_messages_total",
-			Help:      "Total number of BOSH HM TSDB discarded messages.",
+			Name:      "alerts_total",
+			Help:      "Total number of BOSH HM alerts received.",
 			ConstLabels: prometheus.Labels{
 				"environment": environment,
 			},
 		},
+		alertLabelNames,
 	)
 
-	lastReceivedTSDBMessageTimestampMetric := prometheus.NewGauge(
+	alertLastTimestampMetric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Subsystem: "",
-			Name:      "last_received_tsdb_message_timestamp",
-			Help:      "Number of seconds since 1970 since last received message from BOSH HM TSDB.",
+			Name:      "alert_last_timestamp_seconds",
+			Help:      "Number of seconds since 1970 of the last BOSH HM alert.",
 			ConstLabels: prometheus.Labels{
 				"environment": environment,
 			},
 		},
+		alertLabelNames,
 	)
 
 	lastHMTSDBScrapeTimestampMetric := prometheus.NewGauge(
@@ -320,30 +202,35 @@ func NewHMTSDBCollector(
 	)
 
 	collector := &HMTSDBCollector{
-		tsdbListener:                           tsdbListener,
-		jobHealthyMetric:                       jobHealthyMetric,
-		jobLoadAvg01Metric:                     jobLoadAvg01Metric,
-		jobCPUSysMetric:                        jobCPUSysMetric,
-		jobCPUUserMetric:                       jobCPUUserMetric,
-		jobCPUWaitMetric:                       jobCPUWaitMetric,
-		jobMemKBMetric:                         jobMemKBMetric,
-		jobMemPercentMetric:                    jobMemPercentMetric,
-		jobSwapKBMetric:                        jobSwapKBMetric,
-		jobSwapPercentMetric:                   jobSwapPercentMetric,
-		jobSystemDiskInodePercentMetric:        jobSystemDiskInodePercentMetric,
-		jobSystemDiskPercentMetric:             jobSystemDiskPercentMetric,
-		jobEphemeralDiskInodePercentMetric:     jobEphemeralDiskInodePercentMetric,
-		jobEphemeralDiskPercentMetric:          jobEphemeralDiskPercentMetric,
-		jobPersistentDiskInodePercentMetric:    jobPersistentDiskInodePercentMetric,
-		jobPersistentDiskPercentMetric:         jobPersistentDiskPercentMetric,
-		totalReceivedTSDBMessagesMetric:        totalReceivedTSDBMessagesMetric,
-		totalInvalidTSDBMessagesMetric:         totalInvalidTSDBMessagesMetric,
-		totalDiscardedTSDBMessagesMetric:       totalDiscardedTSDBMessagesMetric,
-		lastReceivedTSDBMessageTimestampMetric: lastReceivedTSDBMessageTimestampMetric,
-		lastHMTSDBScrapeTimestampMetric:        lastHMTSDBScrapeTimestampMetric,
-		lastHMTSDBScrapeDurationSecondsMetric:  lastHMTSDBScrapeDurationSecondsMetric,
+		namespace:                             namespace,
+		environment:                           environment,
+		metricMapper:                          config.MetricMapper,
+		passthroughFilter:                     config.PassthroughFilter,
+		metricsTTL:                            config.MetricsTTL,
+		timestampPolicy:                       config.TimestampPolicy,
+		heartbeatPolicy:                       config.HeartbeatPolicy,
+		reservedMetricNames:                   config.ReservedMetricNames,
+		jobMetrics:                            jobMetrics,
+		jobMetricsByName:                      jobMetricsByName,
+		passthroughMetrics:                    map[string]*jobMetric{},
+		jobLastHeartbeatTimestampMetric:       jobLastHeartbeatTimestampMetric,
+		jobHeartbeatMissingMetric:             jobHeartbeatMissingMetric,
+		jobStateMetric:                        jobStateMetric,
+		jobInstances:                          map[string]*JobInstance{},
+		totalDiscardedTSDBMessagesMetric:      totalDiscardedTSDBMessagesMetric,
+		totalOutOfBoundsTSDBMessagesMetric:    totalOutOfBoundsTSDBMessagesMetric,
+		totalSeriesExpiredMetric:              totalSeriesExpiredMetric,
+		totalAlertsMetric:                     totalAlertsMetric,
+		alertLastTimestampMetric:              alertLastTimestampMetric,
+		lastHMTSDBScrapeTimestampMetric:       lastHMTSDBScrapeTimestampMetric,
+		lastHMTSDBScrapeDurationSecondsMetric: lastHMTSDBScrapeDurationSecondsMetric,
+	}
+
+	// The exported metrics must not miss any BOSH HM metric, so the collector
+	// consumes them synchronously.
+	if config.HMMetricBus != nil {
+		config.HMMetricBus.subscribeSync(collector, environment)
 	}
-	go collector.listenHMTSDB()
 
 	return collector
 }
@@ -351,247 +238,171 @@ func NewHMTSDBCollector(
 func (c *HMTSDBCollector) Collect(ch chan<- prometheus.Metric) {
 	var begun = time.Now()
 
-	c.jobHealthyMetric.Collect(ch)
-	c.jobLoadAvg01Metric.Collect(ch)
-	c.jobCPUSysMetric.Collect(ch)
-	c.jobCPUUserMetric.Collect(ch)
-	c.jobCPUWaitMetric.Collect(ch)
-	c.jobMemKBMetric.Collect(ch)
-	c.jobMemPercentMetric.Collect(ch)
-	c.jobSwapKBMetric.Collect(ch)
-	c.jobSwapPercentMetric.Collect(ch)
-	c.jobSystemDiskInodePercentMetric.Collect(ch)
-	c.jobSystemDiskPercentMetric.Collect(ch)
-	c.jobEphemeralDiskInodePercentMetric.Collect(ch)
-	c.jobEphemeralDiskPercentMetric.Collect(ch)
-	c.jobPersistentDiskInodePercentMetric.Collect(ch)
-	c.jobPersistentDiskPercentMetric.Collect(ch)
-
-	c.totalReceivedTSDBMessagesMetric.Collect(ch)
-	c.totalInvalidTSDBMessagesMetric.Collect(ch)
+	c.jobMetricsMutex.Lock()
+	c.expireJobMetrics(begun)
+	c.updateJobInstances(begun)
+	jobMetrics := []prometheus.Metric{}
+	for _, jobMetric := range c.jobMetrics {
+		jobMetrics = append(jobMetrics, jobMetric.metrics(c.timestampPolicy.Export)...)
+	}
+	for _, passthroughMetric := range c.passthroughMetrics {
+		jobMetrics = append(jobMetrics, passthroughMetric.metrics(c.timestampPolicy.Export)...)
+	}
+	jobMetrics = append(jobMetrics, c.jobLastHeartbeatTimestampMetric.metrics(false)...)
+	jobMetrics = append(jobMetrics, c.jobHeartbeatMissingMetric.metrics(false)...)
+	jobMetrics = append(jobMetrics, c.jobStateMetric.metrics(false)...)
+	c.jobMetricsMutex.Unlock()
+
+	for _, metric := range jobMetrics {
+		ch <- metric
+	}
+
 	c.totalDiscardedTSDBMessagesMetric.Collect(ch)
-	c.lastReceivedTSDBMessageTimestampMetric.Collect(ch)
+	c.totalOutOfBoundsTSDBMessagesMetric.Collect(ch)
+	c.totalSeriesExpiredMetric.Collect(ch)
+	c.totalAlertsMetric.Collect(ch)
+	c.alertLastTimestampMetric.Collect(ch)
 
 	c.lastHMTSDBScrapeTimestampMetric.Set(float64(time.Now().Unix()))
 	c.lastHMTSDBScrapeTimestampMetric.Collect(ch)
 
 	c.lastHMTSDBScrapeDurationSecondsMetric.Set(time.Since(begun).Seconds())
 	c.lastHMTSDBScrapeDurationSecondsMetric.Collect(ch)
-
-	c.jobHealthyMetric.Reset()
-	c.jobLoadAvg01Metric.Reset()
-	c.jobCPUSysMetric.Reset()
-	c.jobCPUUserMetric.Reset()
-	c.jobCPUWaitMetric.Reset()
-	c.jobMemKBMetric.Reset()
-	c.jobMemPercentMetric.Reset()
-	c.jobSwapKBMetric.Reset()
-	c.jobSwapPercentMetric.Reset()
-	c.jobSystemDiskInodePercentMetric.Reset()
-	c.jobSystemDiskPercentMetric.Reset()
-	c.jobEphemeralDiskInodePercentMetric.Reset()
-	c.jobEphemeralDiskPercentMetric.Reset()
-	c.jobPersistentDiskInodePercentMetric.Reset()
-	c.jobPersistentDiskPercentMetric.Reset()
 }
 
 func (c *HMTSDBCollector) Describe(ch chan<- *prometheus.Desc) {
-	c.jobHealthyMetric.Describe(ch)
-	c.jobLoadAvg01Metric.Describe(ch)
-	c.jobCPUSysMetric.Describe(ch)
-	c.jobCPUUserMetric.Describe(ch)
-	c.jobCPUWaitMetric.Describe(ch)
-	c.jobMemKBMetric.Describe(ch)
-	c.jobMemPercentMetric.Describe(ch)
-	c.jobSwapKBMetric.Describe(ch)
-	c.jobSwapPercentMetric.Describe(ch)
-	c.jobSystemDiskInodePercentMetric.Describe(ch)
-	c.jobSystemDiskPercentMetric.Describe(ch)
-	c.jobEphemeralDiskInodePercentMetric.Describe(ch)
-	c.jobEphemeralDiskPercentMetric.Describe(ch)
-	c.jobPersistentDiskInodePercentMetric.Describe(ch)
-	c.jobPersistentDiskPercentMetric.Describe(ch)
-	c.totalReceivedTSDBMessagesMetric.Describe(ch)
-	c.totalInvalidTSDBMessagesMetric.Describe(ch)
+	for _, jobMetric := range c.jobMetrics {
+		ch <- jobMetric.desc
+	}
+	ch <- c.jobLastHeartbeatTimestampMetric.desc
+	ch <- c.jobHeartbeatMissingMetric.desc
+	ch <- c.jobStateMetric.desc
 	c.totalDiscardedTSDBMessagesMetric.Describe(ch)
-	c.lastReceivedTSDBMessageTimestampMetric.Describe(ch)
+	c.totalOutOfBoundsTSDBMessagesMetric.Describe(ch)
+	c.totalSeriesExpiredMetric.Describe(ch)
+	c.totalAlertsMetric.Describe(ch)
+	c.alertLastTimestampMetric.Describe(ch)
 	c.lastHMTSDBScrapeTimestampMetric.Describe(ch)
 	c.lastHMTSDBScrapeDurationSecondsMetric.Describe(ch)
 }
 
-func (c *HMTSDBCollector) listenHMTSDB() {
-	for {
-		conn, err := c.tsdbListener.Accept()
-		if err != nil {
-			log.Errorf("Error accepting BOSH HM TSDB connections: %v", err)
-			continue
-		}
-		go c.handleHMMessage(conn)
+// expireJobMetrics removes the series that have not been updated within the
+// metrics TTL. Callers must hold the job metrics lock.
+func (c *HMTSDBCollector) expireJobMetrics(now time.Time) {
+	if c.metricsTTL <= 0 {
+		return
 	}
+
+	before := now.Add(-c.metricsTTL)
+	expired := 0
+	for _, jobMetric := range c.jobMetrics {
+		expired += jobMetric.expire(before)
+	}
+	for _, passthroughMetric := range c.passthroughMetrics {
+		expired += passthroughMetric.expire(before)
+	}
+	expired += c.jobLastHeartbeatTimestampMetric.expire(before)
+	expired += c.jobStateMetric.expire(before)
+
+	c.totalSeriesExpiredMetric.Add(float64(expired))
 }
 
-func (c *HMTSDBCollector) handleHMMessage(conn net.Conn) {
-	defer conn.Close()
+// validateTimestamp checks the timestamp of a BOSH HM metric against the
+// timestamp policy of the environment, counting the rejected ones.
+func (c *HMTSDBCollector) validateTimestamp(timestamp time.Time) error {
+	if err := c.timestampPolicy.validate(timestamp, time.Now()); err != nil {
+		c.totalOutOfBoundsTSDBMessagesMetric.Inc()
+		return err
+	}
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		c.totalReceivedTSDBMessagesMetric.Inc()
-		c.lastReceivedTSDBMessageTimestampMetric.Set(float64(time.Now().Unix()))
+	return nil
+}
 
-		hmMessage := scanner.Text()
-		hmMetric, err := c.parseHMMessage(hmMessage)
-		if err != nil {
-			log.Error(err)
-			c.totalInvalidTSDBMessagesMetric.Inc()
-			continue
-		}
+func (c *HMTSDBCollector) SinkName() string {
+	return "prometheus/" + c.environment
+}
+
+// Consume stores a BOSH HM metric as the Prometheus metrics it maps to.
+func (c *HMTSDBCollector) Consume(environment string, hmMetric HMMetric) {
+	if environment != c.environment {
+		return
+	}
 
-		switch hmMetric.Name {
-		case "system.healthy":
-			c.jobHealthyMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.load.1m":
-			c.jobLoadAvg01Metric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.cpu.sys":
-			c.jobCPUSysMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.cpu.user":
-			c.jobCPUUserMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.cpu.wait":
-			c.jobCPUWaitMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.mem.kb":
-			c.jobMemKBMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.mem.percent":
-			c.jobMemPercentMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.swap.kb":
-			c.jobSwapKBMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.swap.percent":
-			c.jobSwapPercentMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.disk.system.inode_percent":
-			c.jobSystemDiskInodePercentMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.disk.system.percent":
-			c.jobSystemDiskPercentMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.disk.ephemeral.inode_percent":
-			c.jobEphemeralDiskInodePercentMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.disk.ephemeral.percent":
-			c.jobEphemeralDiskPercentMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.disk.persistent.inode_percent":
-			c.jobPersistentDiskInodePercentMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		case "system.disk.persistent.percent":
-			c.jobPersistentDiskPercentMetric.WithLabelValues(
-				hmMetric.Deployment,
-				hmMetric.Job,
-				hmMetric.Id,
-				hmMetric.Index,
-			).Set(hmMetric.Value)
-		default:
-			log.Errorf("BOSH HM TSDB metric `%s` not supported, discarded", hmMetric.Name)
-			c.totalDiscardedTSDBMessagesMetric.Inc()
+	now := time.Now()
+	c.jobMetricsMutex.Lock()
+	jobLabelValues := []string{hmMetric.Deployment, hmMetric.Job, hmMetric.Id, hmMetric.Index}
+	lastHeartbeat, ok := c.jobLastHeartbeatTimestampMetric.get(jobLabelValues)
+	if !ok || !lastHeartbeat.timestamp.After(hmMetric.Timestamp) {
+		c.jobLastHeartbeatTimestampMetric.set(jobLabelValues, float64(hmMetric.Timestamp.Unix()), hmMetric.Timestamp, now)
+	}
+	c.trackJobInstance(hmMetric, now)
+	c.jobMetricsMutex.Unlock()
+
+	mapping, labelValues, ok := c.metricMapper.Map(hmMetric.Name)
+	if !ok {
+		if c.passthroughFilter != nil && c.passthroughFilter.Allowed(hmMetric.Name) {
+			c.passthroughHMMetric(hmMetric)
+			return
 		}
+
+		log.Errorf("BOSH HM TSDB metric `%s` not supported, discarded", hmMetric.Name)
+		c.totalDiscardedTSDBMessagesMetric.Inc()
+		return
 	}
-}
 
-func (c *HMTSDBCollector) parseHMMessage(hmMessage string) (HMMetric, error) {
-	hmMetric := HMMetric{}
+	c.jobMetricsMutex.Lock()
+	updated := c.jobMetricsByName[prometheus.BuildFQName(c.namespace, "", mapping.Name)].set(
+		concatStrings(jobLabelValues, labelValues, c.metricMapper.TagLabelValues(hmMetric.Tags)),
+		hmMetric.Value,
+		hmMetric.Timestamp,
+		now,
+	)
+	c.jobMetricsMutex.Unlock()
 
-	log.Debugf("Parsing BOSH HM TSDB message `%s`", hmMessage)
+	if !updated {
+		log.Errorf("BOSH HM TSDB metric `%s` rejected: its timestamp is older than the current value one", hmMetric.Name)
+		c.totalOutOfBoundsTSDBMessagesMetric.Inc()
+	}
+}
 
-	tokens := strings.Split(hmMessage, " ")
-	if len(tokens) < 4 {
-		return hmMetric, errors.New(fmt.Sprintf("BOSH HM TSDB message discarded, it has less than 4 tokens: %v", hmMessage))
+func (c *HMTSDBCollector) passthroughHMMetric(hmMetric HMMetric) {
+	fqName := prometheus.BuildFQName(c.namespace, "", sanitizeMetricName(hmMetric.Name))
+	labelNames, labelValues, err := passthroughLabels(hmMetric, c.metricMapper)
+	if err != nil {
+		log.Errorf("BOSH HM TSDB metric `%s` discarded, %v", hmMetric.Name, err)
+		c.totalDiscardedTSDBMessagesMetric.Inc()
+		return
 	}
 
-	hmMetric.Name = tokens[1]
+	c.jobMetricsMutex.Lock()
+	defer c.jobMetricsMutex.Unlock()
 
-	value, err := strconv.ParseFloat(tokens[3], 64)
-	if err != nil {
-		return hmMetric, errors.New(fmt.Sprintf("BOSH HM TSDB message discarded, value `%s` cannot be parsed as float: %v", tokens[3], err))
+	if _, ok := c.jobMetricsByName[fqName]; ok || c.reservedMetricNames.reserved(fqName) {
+		log.Errorf("BOSH HM TSDB metric `%s` conflicts with metric `%s`, discarded", hmMetric.Name, fqName)
+		c.totalDiscardedTSDBMessagesMetric.Inc()
+		return
 	}
-	hmMetric.Value = value
-
-	for i := 4; i < len(tokens); i++ {
-		tag := strings.Split(tokens[i], "=")
-		if len(tag) > 1 {
-			switch tag[0] {
-			case "deployment":
-				hmMetric.Deployment = tag[1]
-			case "job":
-				hmMetric.Job = tag[1]
-			case "index":
-				hmMetric.Index = tag[1]
-			case "id":
-				hmMetric.Id = tag[1]
-			}
-		}
+
+	passthroughMetric, ok := c.passthroughMetrics[fqName]
+	if !ok {
+		passthroughMetric = newJobMetric(
+			fqName,
+			fmt.Sprintf("BOSH HM TSDB pass-through metric %s.", hmMetric.Name),
+			prometheus.GaugeValue,
+			labelNames,
+			c.environment,
+		)
+		c.passthroughMetrics[fqName] = passthroughMetric
+	}
+
+	if !equalStrings(passthroughMetric.labelNames, labelNames) {
+		log.Errorf("BOSH HM TSDB metric `%s` tags %v are inconsistent with previous labels %v, discarded", hmMetric.Name, labelNames, passthroughMetric.labelNames)
+		c.totalDiscardedTSDBMessagesMetric.Inc()
+		return
 	}
 
-	return hmMetric, nil
+	if !passthroughMetric.set(labelValues, hmMetric.Value, hmMetric.Timestamp, time.Now()) {
+		log.Errorf("BOSH HM TSDB metric `%s` rejected: its timestamp is older than the current value one", hmMetric.Name)
+		c.totalOutOfBoundsTSDBMessagesMetric.Inc()
+	}
 }
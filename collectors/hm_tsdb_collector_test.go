@@ -11,6 +11,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 
+	dto "github.com/prometheus/client_model/go"
+
 	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
 	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
 )
@@ -21,33 +23,41 @@ func init() {
 
 var _ = Describe("HMTSDBCollector", func() {
 	var (
-		err             error
-		namespace       string
-		environment     string
-		tsdbListener    net.Listener
-		hmTSDBCollector *HMTSDBCollector
-
-		jobHealthyMetric                       *prometheus.GaugeVec
-		jobLoadAvg01Metric                     *prometheus.GaugeVec
-		jobCPUSysMetric                        *prometheus.GaugeVec
-		jobCPUUserMetric                       *prometheus.GaugeVec
-		jobCPUWaitMetric                       *prometheus.GaugeVec
-		jobMemKBMetric                         *prometheus.GaugeVec
-		jobMemPercentMetric                    *prometheus.GaugeVec
-		jobSwapKBMetric                        *prometheus.GaugeVec
-		jobSwapPercentMetric                   *prometheus.GaugeVec
-		jobSystemDiskInodePercentMetric        *prometheus.GaugeVec
-		jobSystemDiskPercentMetric             *prometheus.GaugeVec
-		jobEphemeralDiskInodePercentMetric     *prometheus.GaugeVec
-		jobEphemeralDiskPercentMetric          *prometheus.GaugeVec
-		jobPersistentDiskInodePercentMetric    *prometheus.GaugeVec
-		jobPersistentDiskPercentMetric         *prometheus.GaugeVec
-		totalReceivedTSDBMessagesMetric        prometheus.Counter
-		totalInvalidTSDBMessagesMetric         prometheus.Counter
-		totalDiscardedTSDBMessagesMetric       prometheus.Counter
-		lastReceivedTSDBMessageTimestampMetric prometheus.Gauge
-		lastHMTSDBScrapeTimestampMetric        prometheus.Gauge
-		lastHMTSDBScrapeDurationSecondsMetric  prometheus.Gauge
+		err               error
+		namespace         string
+		environment       string
+		metricMapper      *MetricMapper
+		passthroughFilter *PassthroughFilter
+		metricsTTL        time.Duration
+		timestampPolicy   TimestampPolicy
+		heartbeatPolicy   HeartbeatPolicy
+		tsdbListener      net.Listener
+		hmTSDBCollector   *HMTSDBCollector
+
+		jobHealthyMetric                      *prometheus.GaugeVec
+		jobLoadAvg01Metric                    *prometheus.GaugeVec
+		jobCPUSysMetric                       *prometheus.GaugeVec
+		jobCPUUserMetric                      *prometheus.GaugeVec
+		jobCPUWaitMetric                      *prometheus.GaugeVec
+		jobMemKBMetric                        *prometheus.GaugeVec
+		jobMemPercentMetric                   *prometheus.GaugeVec
+		jobSwapKBMetric                       *prometheus.GaugeVec
+		jobSwapPercentMetric                  *prometheus.GaugeVec
+		jobSystemDiskInodePercentMetric       *prometheus.GaugeVec
+		jobSystemDiskPercentMetric            *prometheus.GaugeVec
+		jobEphemeralDiskInodePercentMetric    *prometheus.GaugeVec
+		jobEphemeralDiskPercentMetric         *prometheus.GaugeVec
+		jobPersistentDiskInodePercentMetric   *prometheus.GaugeVec
+		jobPersistentDiskPercentMetric        *prometheus.GaugeVec
+		jobLastHeartbeatTimestampMetric       *prometheus.GaugeVec
+		jobHeartbeatMissingMetric             *prometheus.GaugeVec
+		totalDiscardedTSDBMessagesMetric      prometheus.Counter
+		totalOutOfBoundsTSDBMessagesMetric    prometheus.Counter
+		totalSeriesExpiredMetric              prometheus.Counter
+		totalAlertsMetric                     *prometheus.CounterVec
+		alertLastTimestampMetric              *prometheus.GaugeVec
+		lastHMTSDBScrapeTimestampMetric       prometheus.Gauge
+		lastHMTSDBScrapeDurationSecondsMetric prometheus.Gauge
 
 		deploymentName                = "fake-deployment-name"
 		jobName                       = "fake-job-name"
@@ -72,8 +82,12 @@ var _ = Describe("HMTSDBCollector", func() {
 	BeforeEach(func() {
 		namespace = "test_exporter"
 		environment = "test_environment"
-		tsdbListener, err = net.Listen("tcp", "127.0.0.1:0")
+		metricMapper, err = NewMetricMapper(DefaultMetricMappings(), nil)
 		Expect(err).ToNot(HaveOccurred())
+		passthroughFilter = nil
+		metricsTTL = 2 * time.Minute
+		timestampPolicy = TimestampPolicy{MaxAge: 10 * time.Minute, MaxFuture: time.Minute}
+		heartbeatPolicy = HeartbeatPolicy{Interval: time.Minute, MaxMissed: 3, GracePeriod: time.Hour}
 
 		jobHealthyMetric = prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
@@ -375,52 +389,92 @@ var _ = Describe("HMTSDBCollector", func() {
 			jobIndex,
 		).Set(float64(jobPersistentDiskPercent))
 
-		totalReceivedTSDBMessagesMetric = prometheus.NewCounter(
+		jobLastHeartbeatTimestampMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "last_heartbeat_timestamp_seconds",
+				Help:      "Number of seconds since 1970 of the last BOSH HM metric timestamp received from a BOSH Job.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+		)
+
+		jobHeartbeatMissingMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "heartbeat_missing",
+				Help:      "BOSH Job heartbeat missing (1 when no BOSH HM metric was received from a BOSH Job for the configured number of heartbeat intervals, 0 otherwise).",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+		)
+
+		totalDiscardedTSDBMessagesMetric = prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Namespace: namespace,
 				Subsystem: "",
-				Name:      "received_tsdb_messages_total",
-				Help:      "Total number of BOSH HM TSDB received messages.",
+				Name:      "discarded_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB discarded messages.",
 				ConstLabels: prometheus.Labels{
 					"environment": environment,
 				},
 			},
 		)
 
-		totalInvalidTSDBMessagesMetric = prometheus.NewCounter(
+		totalOutOfBoundsTSDBMessagesMetric = prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Namespace: namespace,
 				Subsystem: "",
-				Name:      "invalid_tsdb_messages_total",
-				Help:      "Total number of BOSH HM TSDB invalid messages.",
+				Name:      "out_of_bounds_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB messages rejected because their timestamp is too old or too far in the future.",
 				ConstLabels: prometheus.Labels{
 					"environment": environment,
 				},
 			},
 		)
 
-		totalDiscardedTSDBMessagesMetric = prometheus.NewCounter(
+		totalSeriesExpiredMetric = prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Namespace: namespace,
 				Subsystem: "",
-				Name:      "discarded_tsdb_messages_total",
-				Help:      "Total number of BOSH HM TSDB discarded messages.",
+				Name:      "series_expired_total",
+				Help:      "Total number of BOSH Job metric series expired because they were not updated within the metrics TTL.",
 				ConstLabels: prometheus.Labels{
 					"environment": environment,
 				},
 			},
 		)
 
-		lastReceivedTSDBMessageTimestampMetric = prometheus.NewGauge(
+		totalAlertsMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "alerts_total",
+				Help:      "Total number of BOSH HM alerts received.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "severity", "category", "source"},
+		)
+
+		alertLastTimestampMetric = prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: namespace,
 				Subsystem: "",
-				Name:      "last_received_tsdb_message_timestamp",
-				Help:      "Number of seconds since 1970 since last received message from BOSH HM TSDB.",
+				Name:      "alert_last_timestamp_seconds",
+				Help:      "Number of seconds since 1970 of the last BOSH HM alert.",
 				ConstLabels: prometheus.Labels{
 					"environment": environment,
 				},
 			},
+			[]string{"bosh_deployment", "severity", "category", "source"},
 		)
 
 		lastHMTSDBScrapeTimestampMetric = prometheus.NewGauge(
@@ -447,7 +501,20 @@ var _ = Describe("HMTSDBCollector", func() {
 			},
 		)
 
-		hmTSDBCollector = NewHMTSDBCollector(namespace, environment, tsdbListener)
+	})
+
+	JustBeforeEach(func() {
+		hmTSDBCollector, _, tsdbListener = newTestHMTSDBListener(namespace, environment, HMTSDBCollectorConfig{
+			MetricMapper:      metricMapper,
+			PassthroughFilter: passthroughFilter,
+			MetricsTTL:        metricsTTL,
+			TimestampPolicy:   timestampPolicy,
+			HeartbeatPolicy:   heartbeatPolicy,
+		}, HMTSDBListenerConfig{})
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
 	})
 
 	Describe("Describe", func() {
@@ -598,20 +665,42 @@ var _ = Describe("HMTSDBCollector", func() {
 			).Desc())))
 		})
 
-		It("returns a received_tsdb_messages_total metric description", func() {
-			Eventually(descriptions).Should(Receive(Equal(totalReceivedTSDBMessagesMetric.Desc())))
+		It("returns a job_last_heartbeat_timestamp_seconds metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(jobLastHeartbeatTimestampMetric.WithLabelValues(
+				deploymentName,
+				jobName,
+				jobID,
+				jobIndex,
+			).Desc())))
 		})
 
-		It("returns a invalid_tsdb_messages_total metric description", func() {
-			Eventually(descriptions).Should(Receive(Equal(totalInvalidTSDBMessagesMetric.Desc())))
+		It("returns a job_heartbeat_missing metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(jobHeartbeatMissingMetric.WithLabelValues(
+				deploymentName,
+				jobName,
+				jobID,
+				jobIndex,
+			).Desc())))
 		})
 
 		It("returns a discarded_tsdb_messages_total metric description", func() {
 			Eventually(descriptions).Should(Receive(Equal(totalDiscardedTSDBMessagesMetric.Desc())))
 		})
 
-		It("returns a last_tsdb_received_message_timestamp metric description", func() {
-			Eventually(descriptions).Should(Receive(Equal(lastReceivedTSDBMessageTimestampMetric.Desc())))
+		It("returns a out_of_bounds_tsdb_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalOutOfBoundsTSDBMessagesMetric.Desc())))
+		})
+
+		It("returns a series_expired_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalSeriesExpiredMetric.Desc())))
+		})
+
+		It("returns a alerts_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalAlertsMetric.WithLabelValues(deploymentName, "critical", "", "").Desc())))
+		})
+
+		It("returns a alert_last_timestamp_seconds metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(alertLastTimestampMetric.WithLabelValues(deploymentName, "critical", "", "").Desc())))
 		})
 
 		It("returns a last_hm_tsdb_scrape_timestamp metric description", func() {
@@ -653,7 +742,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.healthy message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s", time.Now().Unix(), tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_process_healthy metric", func() {
@@ -669,7 +757,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.load.1m message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.load.1m %d %f %s", time.Now().Unix(), jobLoadAvg01, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_load_avg01 metric", func() {
@@ -685,7 +772,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.cpu.sys message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.cpu.sys %d %f %s", time.Now().Unix(), jobCPUSys, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_cpu_sys metric", func() {
@@ -701,7 +787,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.cpu.user message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.cpu.user %d %f %s", time.Now().Unix(), jobCPUUser, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_cpu_user metric", func() {
@@ -717,7 +802,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.cpu.wait message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.cpu.wait %d %f %s", time.Now().Unix(), jobCPUWait, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_cpu_wait metric", func() {
@@ -733,7 +817,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.mem.kb message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.mem.kb %d %d %s", time.Now().Unix(), jobMemKB, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_mem_kb metric", func() {
@@ -749,7 +832,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.mem.percent message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.mem.percent %d %d %s", time.Now().Unix(), jobMemPercent, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_mem_percent metric", func() {
@@ -765,7 +847,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.swap.kb message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.swap.kb %d %d %s", time.Now().Unix(), jobSwapKB, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_swap_kb metric", func() {
@@ -781,7 +862,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.swap.percent message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.swap.percent %d %d %s", time.Now().Unix(), jobSwapPercent, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_swap_percent metric", func() {
@@ -797,7 +877,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.disk.system.inode_percent message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.disk.system.inode_percent %d %d %s", time.Now().Unix(), jobSystemDiskInodePercent, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_system_disk_inode_percent metric", func() {
@@ -813,7 +892,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.disk.system.percent message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.disk.system.percent %d %d %s", time.Now().Unix(), jobSystemDiskPercent, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_system_disk_percent metric", func() {
@@ -829,7 +907,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.disk.ephemeral.inode_percent message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.disk.ephemeral.inode_percent %d %d %s", time.Now().Unix(), jobEphemeralDiskInodePercent, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_ephemeral_disk_inode_percent metric", func() {
@@ -845,7 +922,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.disk.ephemeral.percent message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.disk.ephemeral.percent %d %d %s", time.Now().Unix(), jobEphemeralDiskPercent, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_ephemeral_disk_percent metric", func() {
@@ -861,7 +937,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.disk.persistent.inode_percent message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.disk.persistent.inode_percent %d %d %s", time.Now().Unix(), jobPersistentDiskInodePercent, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_persistent_disk_inode_percent metric", func() {
@@ -877,7 +952,6 @@ var _ = Describe("HMTSDBCollector", func() {
 		Context("when a system.disk.persistent.percent message is received", func() {
 			BeforeEach(func() {
 				tsdbMessage = fmt.Sprintf("put system.disk.persistent.percent %d %d %s", time.Now().Unix(), jobPersistentDiskPercent, tsdbTags)
-				totalReceivedTSDBMessagesMetric.Inc()
 			})
 
 			It("returns a job_persistent_disk_percent metric", func() {
@@ -890,26 +964,437 @@ var _ = Describe("HMTSDBCollector", func() {
 			})
 		})
 
-		Context("when an invalid tsdb message is received", func() {
-			Context("when does not have the right number of tokens", func() {
+		Context("when a message with a timestamp is received", func() {
+			var (
+				timestamp time.Time
+			)
+
+			BeforeEach(func() {
+				timestamp = time.Unix(time.Now().Unix()-30, 0)
+				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s", timestamp.Unix(), tsdbTags)
+
+				jobLastHeartbeatTimestampMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+				).Set(float64(timestamp.Unix()))
+			})
+
+			It("returns a job_last_heartbeat_timestamp_seconds metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(jobLastHeartbeatTimestampMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+				))))
+			})
+
+			It("returns the job metrics without timestamp", func() {
+				timestampedMetrics := make(chan prometheus.Metric, 100)
+				hmTSDBCollector.Collect(timestampedMetrics)
+				close(timestampedMetrics)
+
+				found := false
+				for metric := range timestampedMetrics {
+					if metric.Desc().String() == jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Desc().String() {
+						dtoMetric := &dto.Metric{}
+						Expect(metric.Write(dtoMetric)).To(Succeed())
+						Expect(dtoMetric.TimestampMs).To(BeNil())
+						found = true
+					}
+				}
+				Expect(found).To(BeTrue())
+			})
+
+			Context("and timestamps are exported", func() {
+				BeforeEach(func() {
+					timestampPolicy.Export = true
+				})
+
+				It("returns the job metrics with the message timestamp", func() {
+					timestampedMetrics := make(chan prometheus.Metric, 100)
+					hmTSDBCollector.Collect(timestampedMetrics)
+					close(timestampedMetrics)
+
+					found := false
+					for metric := range timestampedMetrics {
+						dtoMetric := &dto.Metric{}
+						Expect(metric.Write(dtoMetric)).To(Succeed())
+						if metric.Desc().String() == jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Desc().String() {
+							Expect(dtoMetric.GetTimestampMs()).To(Equal(timestamp.Unix() * 1000))
+							Expect(dtoMetric.GetGauge().GetValue()).To(Equal(float64(1)))
+							found = true
+						}
+					}
+					Expect(found).To(BeTrue())
+				})
+			})
+		})
+
+		Context("when a message with a too old timestamp is received", func() {
+			BeforeEach(func() {
+				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s", time.Now().Add(-time.Hour).Unix(), tsdbTags)
+				totalOutOfBoundsTSDBMessagesMetric.Inc()
+			})
+
+			It("returns a out_of_bounds_tsdb_messages_total metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(totalOutOfBoundsTSDBMessagesMetric)))
+			})
+		})
+
+		Context("when a message older than the current value is received", func() {
+			BeforeEach(func() {
+				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s\n", time.Now().Unix(), tsdbTags) +
+					fmt.Sprintf("put system.healthy %d 0 %s\n", time.Now().Add(-time.Minute).Unix(), tsdbTags)
+				jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(1)
+				totalOutOfBoundsTSDBMessagesMetric.Inc()
+			})
+
+			It("keeps the current value", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(jobHealthyMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+				))))
+			})
+
+			It("returns a out_of_bounds_tsdb_messages_total metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(totalOutOfBoundsTSDBMessagesMetric)))
+			})
+		})
+
+		Context("when a message with a timestamp in the future is received", func() {
+			BeforeEach(func() {
+				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s", time.Now().Add(time.Hour).Unix(), tsdbTags)
+				totalOutOfBoundsTSDBMessagesMetric.Inc()
+			})
+
+			It("returns a out_of_bounds_tsdb_messages_total metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(totalOutOfBoundsTSDBMessagesMetric)))
+			})
+		})
+
+		Context("when the metrics are scraped several times", func() {
+			BeforeEach(func() {
+				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s", time.Now().Unix(), tsdbTags)
+			})
+
+			It("keeps returning the job metrics until they expire", func() {
+				jobHealthy := PrometheusMetric(jobHealthyMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+				))
+
+				// Drain the first scrape up to its last metric.
+				firstMetrics := []prometheus.Metric{}
+				for {
+					var metric prometheus.Metric
+					Eventually(metrics).Should(Receive(&metric))
+					firstMetrics = append(firstMetrics, metric)
+					if metric.Desc().String() == lastHMTSDBScrapeDurationSecondsMetric.Desc().String() {
+						break
+					}
+				}
+				Expect(firstMetrics).To(ContainElement(jobHealthy))
+
+				secondMetrics := make(chan prometheus.Metric, 1000)
+				hmTSDBCollector.Collect(secondMetrics)
+				close(secondMetrics)
+				scrapedMetrics := []prometheus.Metric{}
+				for metric := range secondMetrics {
+					scrapedMetrics = append(scrapedMetrics, metric)
+				}
+				Expect(scrapedMetrics).To(ContainElement(jobHealthy))
+			})
+		})
+
+		Context("when the metrics TTL expires", func() {
+			BeforeEach(func() {
+				metricsTTL = time.Millisecond
+				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s", time.Now().Unix(), tsdbTags)
+				// The job_healthy and the job_last_heartbeat_timestamp_seconds series.
+				totalSeriesExpiredMetric.Add(2)
+			})
+
+			It("returns a series_expired_total metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(totalSeriesExpiredMetric)))
+			})
+
+			It("does not return the expired job metrics", func() {
+				expiredMetrics := make(chan prometheus.Metric, 100)
+				hmTSDBCollector.Collect(expiredMetrics)
+				Consistently(expiredMetrics).ShouldNot(Receive(PrometheusMetric(jobHealthyMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+				))))
+			})
+		})
+
+		Context("when a BOSH Job keeps sending heartbeats", func() {
+			BeforeEach(func() {
+				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s", time.Now().Unix(), tsdbTags)
+				jobHeartbeatMissingMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(0)
+			})
+
+			It("returns a job_heartbeat_missing metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(jobHeartbeatMissingMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+				))))
+			})
+		})
+
+		Context("when a BOSH Job stops sending heartbeats", func() {
+			BeforeEach(func() {
+				heartbeatPolicy = HeartbeatPolicy{Interval: 10 * time.Millisecond, MaxMissed: 2, GracePeriod: time.Hour}
+				tsdbMessage = fmt.Sprintf("put system.load.1m %d %f %s", time.Now().Unix(), jobLoadAvg01, tsdbTags)
+				jobHeartbeatMissingMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(1)
+			})
+
+			It("returns a job_heartbeat_missing metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(jobHeartbeatMissingMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+				))))
+			})
+
+			It("keeps the last job metrics", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(jobLoadAvg01Metric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+				))))
+			})
+
+			Context("and missing BOSH Jobs are marked as unhealthy", func() {
+				BeforeEach(func() {
+					heartbeatPolicy.MarkUnhealthy = true
+					jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(0)
+				})
+
+				It("returns a job_healthy metric", func() {
+					Eventually(metrics).Should(Receive(PrometheusMetric(jobHealthyMetric.WithLabelValues(
+						deploymentName,
+						jobName,
+						jobID,
+						jobIndex,
+					))))
+				})
+			})
+
+			Context("and the grace period ends", func() {
+				BeforeEach(func() {
+					heartbeatPolicy.GracePeriod = time.Millisecond
+				})
+
+				It("does not return a job_heartbeat_missing metric", func() {
+					forgottenMetrics := make(chan prometheus.Metric, 100)
+					hmTSDBCollector.Collect(forgottenMetrics)
+					close(forgottenMetrics)
+					for metric := range forgottenMetrics {
+						Expect(metric.Desc().String()).ToNot(Equal(jobHeartbeatMissingMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Desc().String()))
+					}
+				})
+			})
+		})
+
+		Context("when heartbeat detection is disabled", func() {
+			BeforeEach(func() {
+				heartbeatPolicy = HeartbeatPolicy{}
+				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s", time.Now().Unix(), tsdbTags)
+				jobHeartbeatMissingMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(0)
+			})
+
+			It("does not return a job_heartbeat_missing metric", func() {
+				disabledMetrics := make(chan prometheus.Metric, 100)
+				hmTSDBCollector.Collect(disabledMetrics)
+				close(disabledMetrics)
+				for metric := range disabledMetrics {
+					Expect(metric.Desc().String()).ToNot(Equal(jobHeartbeatMissingMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Desc().String()))
+				}
+			})
+		})
+
+		Context("when a custom metric mapping is configured", func() {
+			var (
+				jobDiskPercentMetric *prometheus.GaugeVec
+			)
+
+			BeforeEach(func() {
+				metricMapper, err = NewMetricMapper([]MetricMapping{
+					{
+						Match:     "system.disk.*.percent",
+						MatchType: MatchTypeGlob,
+						Name:      "job_disk_percent",
+						Help:      "BOSH Job Disk Percent.",
+						Labels:    map[string]string{"disk": "$1"},
+					},
+				}, nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				jobDiskPercentMetric = prometheus.NewGaugeVec(
+					prometheus.GaugeOpts{
+						Namespace: namespace,
+						Subsystem: "job",
+						Name:      "disk_percent",
+						Help:      "BOSH Job Disk Percent.",
+						ConstLabels: prometheus.Labels{
+							"environment": environment,
+						},
+					},
+					[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index", "disk"},
+				)
+
+				jobDiskPercentMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+					"ephemeral",
+				).Set(float64(jobEphemeralDiskPercent))
+
+				tsdbMessage = fmt.Sprintf("put system.disk.ephemeral.percent %d %d %s", time.Now().Unix(), jobEphemeralDiskPercent, tsdbTags)
+			})
+
+			It("returns a job_disk_percent metric", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(jobDiskPercentMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+					"ephemeral",
+				))))
+			})
+		})
+
+		Context("when tag mappings are configured", func() {
+			var (
+				jobMappedHealthyMetric *prometheus.GaugeVec
+			)
+
+			BeforeEach(func() {
+				metricMapper, err = NewMetricMapper(DefaultMetricMappings(), []TagMapping{
+					{Tag: "agent_id", Label: "bosh_agent_id"},
+					{Tag: "role", Default: "unknown"},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				jobMappedHealthyMetric = prometheus.NewGaugeVec(
+					prometheus.GaugeOpts{
+						Namespace: namespace,
+						Subsystem: "job",
+						Name:      "healthy",
+						Help:      "BOSH Job Healthy (1 for healthy, 0 for unhealthy).",
+						ConstLabels: prometheus.Labels{
+							"environment": environment,
+						},
+					},
+					[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index", "bosh_agent_id", "role"},
+				)
+
+				jobMappedHealthyMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+					"fake-agent-id",
+					"unknown",
+				).Set(float64(1))
+
+				tsdbMessage = fmt.Sprintf("put system.healthy %d 1 %s agent_id=fake-agent-id", time.Now().Unix(), tsdbTags)
+			})
+
+			It("returns a job_healthy metric with the mapped tags as labels", func() {
+				Eventually(metrics).Should(Receive(PrometheusMetric(jobMappedHealthyMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+					"fake-agent-id",
+					"unknown",
+				))))
+			})
+		})
+
+		Context("when pass-through mode is enabled", func() {
+			var (
+				passthroughMetric *prometheus.GaugeVec
+			)
+
+			BeforeEach(func() {
+				passthroughFilter, err = NewPassthroughFilter(`system\..*`, `system\.denied\..*`)
+				Expect(err).ToNot(HaveOccurred())
+
+				passthroughMetric = prometheus.NewGaugeVec(
+					prometheus.GaugeOpts{
+						Namespace: namespace,
+						Subsystem: "",
+						Name:      "system_disk_foo_bar",
+						Help:      "BOSH HM TSDB pass-through metric system.disk.foo.bar.",
+						ConstLabels: prometheus.Labels{
+							"environment": environment,
+						},
+					},
+					[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index", "agent_id", "tag_environment"},
+				)
+
+				passthroughMetric.WithLabelValues(
+					deploymentName,
+					jobName,
+					jobID,
+					jobIndex,
+					"fake-agent-id",
+					"fake-environment",
+				).Set(float64(42))
+			})
+
+			Context("when an allowed metric is received", func() {
+				BeforeEach(func() {
+					tsdbMessage = fmt.Sprintf("put system.disk.foo.bar %d 42 %s agent-id=fake-agent-id environment=fake-environment", time.Now().Unix(), tsdbTags)
+				})
+
+				It("returns a pass-through metric", func() {
+					Eventually(metrics).Should(Receive(PrometheusMetric(passthroughMetric.WithLabelValues(
+						deploymentName,
+						jobName,
+						jobID,
+						jobIndex,
+						"fake-agent-id",
+						"fake-environment",
+					))))
+				})
+			})
+
+			Context("when a denied metric is received", func() {
 				BeforeEach(func() {
-					tsdbMessage = fmt.Sprintf("put invalid.tsdb.message %d", time.Now().Unix())
-					totalInvalidTSDBMessagesMetric.Inc()
+					tsdbMessage = fmt.Sprintf("put system.denied.foo %d 42 %s", time.Now().Unix(), tsdbTags)
+					totalDiscardedTSDBMessagesMetric.Inc()
 				})
 
-				It("returns a invalid_tsdb_messages_total metric metric", func() {
-					Eventually(metrics).Should(Receive(PrometheusMetric(totalInvalidTSDBMessagesMetric)))
+				It("returns a discarded_tsdb_messages_total metric", func() {
+					Eventually(metrics).Should(Receive(PrometheusMetric(totalDiscardedTSDBMessagesMetric)))
 				})
 			})
 
-			Context("when the value cannot be converted to a float", func() {
+			Context("when a metric not allowed is received", func() {
 				BeforeEach(func() {
-					tsdbMessage = fmt.Sprintf("put invalid.tsdb.message %d a %s", time.Now().Unix(), tsdbTags)
-					totalInvalidTSDBMessagesMetric.Inc()
+					tsdbMessage = fmt.Sprintf("put custom.foo %d 42 %s", time.Now().Unix(), tsdbTags)
+					totalDiscardedTSDBMessagesMetric.Inc()
 				})
 
-				It("returns a invalid_tsdb_messages_total metric metric", func() {
-					Eventually(metrics).Should(Receive(PrometheusMetric(totalInvalidTSDBMessagesMetric)))
+				It("returns a discarded_tsdb_messages_total metric", func() {
+					Eventually(metrics).Should(Receive(PrometheusMetric(totalDiscardedTSDBMessagesMetric)))
 				})
 			})
 		})
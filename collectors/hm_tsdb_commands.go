@@ -0,0 +1,115 @@
+package collectors
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+const hmCommandResponseTimeout = 10 * time.Second
+
+var hmCommandNames = []string{"dropcaches", "exit", "help", "put", "stats", "version"}
+
+func hmCommand(hmMessage string) string {
+	if i := strings.IndexByte(hmMessage, ' '); i >= 0 {
+		return hmMessage[:i]
+	}
+
+	return hmMessage
+}
+
+func (l *HMTSDBListener) handleHMCommand(conn net.Conn, command string) bool {
+	switch command {
+	case "dropcaches":
+		// There is no cache to drop, answer as OpenTSDB does.
+		return l.writeHMResponse(conn, "Caches dropped.\n")
+	case "exit":
+		return false
+	case "help":
+		return l.writeHMResponse(conn, fmt.Sprintf("available commands: %s\n", strings.Join(hmCommandNames, " ")))
+	case "stats":
+		return l.writeHMResponse(conn, l.hmStats(time.Now()))
+	case "version":
+		return l.writeHMResponse(conn, fmt.Sprintf(
+			"bosh_tsdb_exporter %s built at revision %s (%s)\nBuilt on %s by %s\n",
+			version.Version,
+			version.Revision,
+			version.Branch,
+			version.BuildDate,
+			version.BuildUser,
+		))
+	}
+
+	log.Errorf("BOSH HM TSDB message discarded, unknown command `%s`", command)
+	l.totalInvalidTSDBMessagesMetric.Inc()
+	if command == "" {
+		return true
+	}
+
+	return l.writeHMResponse(conn, fmt.Sprintf("unknown command: %s.  Try `help'.\n", command))
+}
+
+func (l *HMTSDBListener) writeHMResponse(conn net.Conn, response string) bool {
+	conn.SetWriteDeadline(time.Now().Add(hmCommandResponseTimeout))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		log.Errorf("Error writing BOSH HM TSDB response to `%s`: %v", conn.RemoteAddr(), err)
+		return false
+	}
+
+	return true
+}
+
+func (l *HMTSDBListener) hmStats(now time.Time) string {
+	stats := []struct {
+		name      string
+		collector prometheus.Collector
+	}{
+		{"received_tsdb_messages_total", l.totalReceivedTSDBMessagesMetric},
+		{"invalid_tsdb_messages_total", l.totalInvalidTSDBMessagesMetric},
+		{"discarded_tsdb_messages_total", l.collector.totalDiscardedTSDBMessagesMetric},
+		{"out_of_bounds_tsdb_messages_total", l.collector.totalOutOfBoundsTSDBMessagesMetric},
+		{"throttled_tsdb_messages_total", l.totalThrottledTSDBMessagesMetric},
+		{"rejected_tsdb_connections_total", l.totalRejectedTSDBConnectionsMetric},
+		{"tsdb_connections_open", l.openTSDBConnectionsMetric},
+		{"tsdb_connections_total", l.totalTSDBConnectionsMetric},
+	}
+
+	response := ""
+	for _, stat := range stats {
+		response += fmt.Sprintf(
+			"%s %d %s environment=%s\n",
+			prometheus.BuildFQName(l.namespace, "", stat.name),
+			now.Unix(),
+			strconv.FormatFloat(sumMetrics(stat.collector), 'f', -1, 64),
+			l.environment,
+		)
+	}
+
+	return response
+}
+
+func sumMetrics(collector prometheus.Collector) float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+
+	sum := 0.0
+	for metric := range ch {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			continue
+		}
+		sum += m.GetCounter().GetValue() + m.GetGauge().GetValue()
+	}
+
+	return sum
+}
@@ -0,0 +1,139 @@
+package collectors_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("HMTSDBListener commands", func() {
+	var (
+		err             error
+		namespace       string
+		environment     string
+		tsdbListener    net.Listener
+		hmTSDBCollector *HMTSDBCollector
+		hmTSDBListener  *HMTSDBListener
+		conn            net.Conn
+		reader          *bufio.Reader
+
+		totalInvalidTSDBMessagesMetric prometheus.Counter
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+
+		totalInvalidTSDBMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "invalid_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB invalid messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		tsdbListener.Close()
+	})
+
+	JustBeforeEach(func() {
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener(namespace, environment, HMTSDBCollectorConfig{}, HMTSDBListenerConfig{})
+
+		conn, err = net.Dial("tcp", tsdbListener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader = bufio.NewReader(conn)
+	})
+
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		Expect(err).ToNot(HaveOccurred())
+		return line
+	}
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		hmTSDBListener.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	It("answers the version command", func() {
+		fmt.Fprint(conn, "version\n")
+		Expect(readLine()).To(HavePrefix("bosh_tsdb_exporter "))
+		Expect(readLine()).To(HavePrefix("Built on "))
+	})
+
+	It("answers the help command", func() {
+		fmt.Fprint(conn, "help\n")
+		Expect(readLine()).To(Equal("available commands: dropcaches exit help put stats version\n"))
+	})
+
+	It("answers the dropcaches command", func() {
+		fmt.Fprint(conn, "dropcaches\n")
+		Expect(readLine()).To(Equal("Caches dropped.\n"))
+	})
+
+	It("answers the stats command with the exporter counters", func() {
+		fmt.Fprintf(conn, "put system.healthy %d 1 deployment=fake-deployment job=fake-job index=0 id=fake-id\n", time.Now().Unix())
+		fmt.Fprintf(conn, "put fake.metric %d 1 deployment=fake-deployment job=fake-job index=0 id=fake-id\n", time.Now().Unix())
+		fmt.Fprint(conn, "put invalid.metric\n")
+		fmt.Fprint(conn, "stats\n")
+
+		stats := map[string]string{}
+		for i := 0; i < 8; i++ {
+			var name, value, tags string
+			var timestamp int64
+			_, err := fmt.Sscanf(readLine(), "%s %d %s %s\n", &name, &timestamp, &value, &tags)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(Equal("environment=" + environment))
+			stats[name] = value
+		}
+
+		Expect(stats).To(HaveKeyWithValue("test_exporter_received_tsdb_messages_total", "4"))
+		Expect(stats).To(HaveKeyWithValue("test_exporter_invalid_tsdb_messages_total", "1"))
+		Expect(stats).To(HaveKeyWithValue("test_exporter_discarded_tsdb_messages_total", "1"))
+		Expect(stats).To(HaveKeyWithValue("test_exporter_tsdb_connections_open", "1"))
+	})
+
+	It("closes the connection on the exit command", func() {
+		fmt.Fprint(conn, "exit\n")
+		_, err := ioutil.ReadAll(reader)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Context("when the command is unknown", func() {
+		BeforeEach(func() {
+			totalInvalidTSDBMessagesMetric.Inc()
+		})
+
+		It("answers an error and counts the message as invalid", func() {
+			fmt.Fprintf(conn, "get system.healthy %d 1 deployment=fake-deployment job=fake-job index=0 id=fake-id\n", time.Now().Unix())
+			Expect(readLine()).To(Equal("unknown command: get.  Try `help'.\n"))
+
+			Expect(collect()).To(ContainElement(PrometheusMetric(totalInvalidTSDBMessagesMetric)))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(BeEmpty())
+		})
+	})
+})
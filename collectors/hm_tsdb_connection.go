@@ -0,0 +1,37 @@
+package collectors
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type hmConnectionReader struct {
+	conn                         net.Conn
+	idleTimeout                  time.Duration
+	totalReceivedTSDBBytesMetric prometheus.Counter
+}
+
+func (r *hmConnectionReader) Read(p []byte) (int, error) {
+	if r.idleTimeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.idleTimeout))
+	}
+
+	n, err := r.conn.Read(p)
+	r.totalReceivedTSDBBytesMetric.Add(float64(n))
+
+	return n, err
+}
+
+func connectionErrorReason(err error) string {
+	if err == bufio.ErrTooLong {
+		return "line_too_long"
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "idle_timeout"
+	}
+
+	return "read_error"
+}
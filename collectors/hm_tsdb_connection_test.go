@@ -0,0 +1,280 @@
+package collectors_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("HMTSDBListener connections", func() {
+	var (
+		namespace        string
+		environment      string
+		connectionPolicy ConnectionPolicy
+		tsdbListener     net.Listener
+		hmTSDBListener   *HMTSDBListener
+
+		openTSDBConnectionsMetric       prometheus.Gauge
+		totalTSDBConnectionsMetric      prometheus.Counter
+		totalTSDBConnectionErrorsMetric *prometheus.CounterVec
+		totalReceivedTSDBBytesMetric    prometheus.Counter
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		connectionPolicy = ConnectionPolicy{}
+
+		openTSDBConnectionsMetric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "tsdb_connections_open",
+				Help:      "Number of BOSH HM TSDB open connections.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalTSDBConnectionsMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "tsdb_connections_total",
+				Help:      "Total number of BOSH HM TSDB accepted connections.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalTSDBConnectionErrorsMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "tsdb_connection_errors_total",
+				Help:      "Total number of BOSH HM TSDB connections closed on error.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"reason"},
+		)
+
+		totalReceivedTSDBBytesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "received_tsdb_bytes_total",
+				Help:      "Total number of bytes received on the BOSH HM TSDB connections.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	JustBeforeEach(func() {
+		_, hmTSDBListener, tsdbListener = newTestHMTSDBListener(namespace, environment, HMTSDBCollectorConfig{}, HMTSDBListenerConfig{ConnectionPolicy: connectionPolicy})
+	})
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", tsdbListener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		hmTSDBListener.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	Describe("Describe", func() {
+		var descriptions chan *prometheus.Desc
+
+		JustBeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+			go hmTSDBListener.Describe(descriptions)
+		})
+
+		It("returns a tsdb_connections_open metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(openTSDBConnectionsMetric.Desc())))
+		})
+
+		It("returns a tsdb_connections_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalTSDBConnectionsMetric.Desc())))
+		})
+
+		It("returns a tsdb_connection_errors_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalTSDBConnectionErrorsMetric.WithLabelValues("").Desc())))
+		})
+
+		It("returns a received_tsdb_bytes_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalReceivedTSDBBytesMetric.Desc())))
+		})
+	})
+
+	Context("when a connection is open", func() {
+		var (
+			conn    net.Conn
+			message string
+		)
+
+		BeforeEach(func() {
+			message = fmt.Sprintf("put system.healthy %d 1 deployment=fake-deployment job=fake-job index=0 id=fake-id\n", time.Now().Unix())
+			openTSDBConnectionsMetric.Set(1)
+			totalTSDBConnectionsMetric.Inc()
+			totalReceivedTSDBBytesMetric.Add(float64(len(message)))
+		})
+
+		JustBeforeEach(func() {
+			conn = dial()
+			fmt.Fprint(conn, message)
+		})
+
+		AfterEach(func() {
+			conn.Close()
+		})
+
+		It("returns a tsdb_connections_open metric", func() {
+			Eventually(collect).Should(ContainElement(PrometheusMetric(openTSDBConnectionsMetric)))
+		})
+
+		It("returns a tsdb_connections_total metric", func() {
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalTSDBConnectionsMetric)))
+		})
+
+		It("returns a received_tsdb_bytes_total metric", func() {
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalReceivedTSDBBytesMetric)))
+		})
+
+		Context("and then closed", func() {
+			BeforeEach(func() {
+				openTSDBConnectionsMetric.Set(0)
+			})
+
+			It("returns a tsdb_connections_open metric", func() {
+				Eventually(collect).Should(ContainElement(PrometheusMetric(totalReceivedTSDBBytesMetric)))
+				conn.Close()
+				Eventually(collect).Should(ContainElement(PrometheusMetric(openTSDBConnectionsMetric)))
+			})
+		})
+	})
+
+	Context("when a connection stays idle", func() {
+		BeforeEach(func() {
+			connectionPolicy.IdleTimeout = 50 * time.Millisecond
+			totalTSDBConnectionErrorsMetric.WithLabelValues("idle_timeout").Inc()
+		})
+
+		It("closes the connection", func() {
+			conn := dial()
+			defer conn.Close()
+
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalTSDBConnectionErrorsMetric.WithLabelValues("idle_timeout"))))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := conn.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when a line is too long", func() {
+		BeforeEach(func() {
+			totalTSDBConnectionErrorsMetric.WithLabelValues("line_too_long").Inc()
+		})
+
+		It("returns a tsdb_connection_errors_total metric", func() {
+			conn := dial()
+			defer conn.Close()
+			fmt.Fprint(conn, "put "+strings.Repeat("a", 128*1024)+"\n")
+
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalTSDBConnectionErrorsMetric.WithLabelValues("line_too_long"))))
+		})
+	})
+
+	Context("when a Graphite connection is open", func() {
+		var (
+			graphiteListener net.Listener
+			conn             net.Conn
+			message          string
+		)
+
+		BeforeEach(func() {
+			connectionPolicy.IdleTimeout = time.Minute
+			message = fmt.Sprintf("bosh.fake-deployment.fake-job.0.fake-id.system_healthy 1 %d\n", time.Now().Unix())
+			openTSDBConnectionsMetric.Set(1)
+			totalTSDBConnectionsMetric.Inc()
+			totalReceivedTSDBBytesMetric.Add(float64(len(message)))
+		})
+
+		JustBeforeEach(func() {
+			var err error
+			graphiteListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			template, err := ParseGraphiteTemplate("bosh.<deployment>.<job>.<index>.<id>.<metric...>")
+			Expect(err).ToNot(HaveOccurred())
+			NewHMGraphiteCollector(namespace, environment, template, hmTSDBListener, graphiteListener)
+
+			conn, err = net.Dial("tcp", graphiteListener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			fmt.Fprint(conn, message)
+		})
+
+		AfterEach(func() {
+			conn.Close()
+			graphiteListener.Close()
+		})
+
+		It("returns the connection metrics", func() {
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalReceivedTSDBBytesMetric)))
+			Expect(collect()).To(ContainElement(PrometheusMetric(openTSDBConnectionsMetric)))
+			Expect(collect()).To(ContainElement(PrometheusMetric(totalTSDBConnectionsMetric)))
+		})
+
+		Context("and a line is too long", func() {
+			BeforeEach(func() {
+				openTSDBConnectionsMetric.Set(0)
+				totalTSDBConnectionErrorsMetric.WithLabelValues("line_too_long").Inc()
+			})
+
+			It("returns a tsdb_connection_errors_total metric", func() {
+				fmt.Fprint(conn, strings.Repeat("a", 128*1024)+"\n")
+
+				Eventually(collect).Should(ContainElement(PrometheusMetric(totalTSDBConnectionErrorsMetric.WithLabelValues("line_too_long"))))
+				Eventually(collect).Should(ContainElement(PrometheusMetric(openTSDBConnectionsMetric)))
+			})
+		})
+
+		Context("and stays idle", func() {
+			BeforeEach(func() {
+				connectionPolicy.IdleTimeout = 50 * time.Millisecond
+				totalTSDBConnectionErrorsMetric.WithLabelValues("idle_timeout").Inc()
+			})
+
+			It("returns a tsdb_connection_errors_total metric", func() {
+				Eventually(collect).Should(ContainElement(PrometheusMetric(totalTSDBConnectionErrorsMetric.WithLabelValues("idle_timeout"))))
+			})
+		})
+	})
+})
@@ -0,0 +1,279 @@
+package collectors
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+type openTSDBDataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp json.RawMessage   `json:"timestamp"`
+	Value     json.RawMessage   `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type openTSDBPutError struct {
+	DataPoint json.RawMessage `json:"datapoint"`
+	Error     string          `json:"error"`
+}
+
+type openTSDBPutSummary struct {
+	Failed  int `json:"failed"`
+	Success int `json:"success"`
+}
+
+type openTSDBPutDetails struct {
+	Errors  []openTSDBPutError `json:"errors"`
+	Failed  int                `json:"failed"`
+	Success int                `json:"success"`
+}
+
+type openTSDBError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+}
+
+// NewTSDBHTTPServer returns the server of the OpenTSDB HTTP `/api/put` and the
+// BOSH HM `/api/hm/events` endpoints of a HMTSDBListener, only accepting TLS
+// connections when `tlsConfig` is not nil.
+func NewTSDBHTTPServer(listener *HMTSDBListener, tlsConfig *tls.Config) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/api/put", NewHMTSDBHTTPHandler(listener))
+	mux.Handle("/api/hm/events", NewHMJSONHTTPHandler(listener))
+
+	return &http.Server{Handler: mux, TLSConfig: tlsConfig}
+}
+
+// ServeTSDBHTTP serves a TSDB HTTP server on a listener, over TLS when the
+// server has a TLS configuration.
+func ServeTSDBHTTP(server *http.Server, listener net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+// HMTSDBHTTPHandler implements the OpenTSDB HTTP `/api/put` endpoint,
+// publishing the received data points through a HMTSDBListener.
+type HMTSDBHTTPHandler struct {
+	listener *HMTSDBListener
+}
+
+func NewHMTSDBHTTPHandler(listener *HMTSDBListener) *HMTSDBHTTPHandler {
+	return &HMTSDBHTTPHandler{listener: listener}
+}
+
+func (h *HMTSDBHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenTSDBError(w, http.StatusMethodNotAllowed, "Method not allowed", fmt.Sprintf("The HTTP method [%s] is not permitted for this endpoint", r.Method))
+		return
+	}
+
+	body, err := readOpenTSDBBody(w, r)
+	if err == errOpenTSDBBodyTooLarge {
+		writeOpenTSDBError(w, http.StatusRequestEntityTooLarge, "Request entity too large", err.Error())
+		return
+	}
+	if err != nil {
+		writeOpenTSDBError(w, http.StatusBadRequest, "Unable to read the request body", err.Error())
+		return
+	}
+
+	rawDataPoints, err := splitOpenTSDBDataPoints(body)
+	if err != nil {
+		writeOpenTSDBError(w, http.StatusBadRequest, "Unable to parse the given JSON", err.Error())
+		return
+	}
+
+	clientCN := ""
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		clientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	remoteAddr := requestRemoteAddr(r)
+	allowHMMessage, releaseHMSource := h.listener.limitHMSource(remoteAddr)
+	defer releaseHMSource()
+
+	details := openTSDBPutDetails{Errors: []openTSDBPutError{}}
+	for _, rawDataPoint := range rawDataPoints {
+		h.listener.totalReceivedTSDBMessagesMetric.WithLabelValues(clientCN).Inc()
+		h.listener.lastReceivedTSDBMessageTimestampMetric.Set(float64(time.Now().Unix()))
+
+		if !allowHMMessage() {
+			details.Failed++
+			details.Errors = append(details.Errors, openTSDBPutError{DataPoint: rawDataPoint, Error: "Rate limit exceeded"})
+			continue
+		}
+
+		hmMetric, err := parseOpenTSDBDataPoint(rawDataPoint)
+		if err != nil {
+			log.Errorf("BOSH HM TSDB data point discarded, %v: %s", err, rawDataPoint)
+			h.listener.totalInvalidTSDBMessagesMetric.Inc()
+			details.Failed++
+			details.Errors = append(details.Errors, openTSDBPutError{DataPoint: rawDataPoint, Error: err.Error()})
+			continue
+		}
+
+		h.listener.publishHMMetric(h.listener.routeHMMetric(hmMetric, remoteAddr), hmMetric)
+		details.Success++
+	}
+
+	status := http.StatusOK
+	if details.Failed > 0 {
+		status = http.StatusBadRequest
+	}
+
+	if _, ok := r.URL.Query()["details"]; ok {
+		writeOpenTSDBJSON(w, status, details)
+		return
+	}
+
+	if _, ok := r.URL.Query()["summary"]; ok {
+		writeOpenTSDBJSON(w, status, openTSDBPutSummary{Failed: details.Failed, Success: details.Success})
+		return
+	}
+
+	if details.Failed > 0 {
+		writeOpenTSDBError(w, http.StatusBadRequest, "One or more data points had errors", "Please see the TSD logs or append \"details\" to the put request")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const maxOpenTSDBBodySize = 8 * 1024 * 1024
+
+var errOpenTSDBBodyTooLarge = fmt.Errorf("the request body is larger than %d bytes", maxOpenTSDBBodySize)
+
+func readOpenTSDBBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, maxOpenTSDBBodySize)
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, openTSDBBodyError(err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, maxOpenTSDBBodySize+1))
+	if err != nil {
+		return nil, openTSDBBodyError(err)
+	}
+	if len(body) > maxOpenTSDBBodySize {
+		return nil, errOpenTSDBBodyTooLarge
+	}
+
+	return body, nil
+}
+
+func openTSDBBodyError(err error) error {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return errOpenTSDBBodyTooLarge
+	}
+	return err
+}
+
+func splitOpenTSDBDataPoints(body []byte) ([]json.RawMessage, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("Missing message content")
+	}
+
+	if body[0] == '[' {
+		rawDataPoints := []json.RawMessage{}
+		if err := json.Unmarshal(body, &rawDataPoints); err != nil {
+			return nil, err
+		}
+		return rawDataPoints, nil
+	}
+
+	rawDataPoint := json.RawMessage{}
+	if err := json.Unmarshal(body, &rawDataPoint); err != nil {
+		return nil, err
+	}
+
+	return []json.RawMessage{rawDataPoint}, nil
+}
+
+func parseOpenTSDBDataPoint(rawDataPoint json.RawMessage) (HMMetric, error) {
+	dataPoint := openTSDBDataPoint{}
+	if err := json.Unmarshal(rawDataPoint, &dataPoint); err != nil {
+		return HMMetric{}, fmt.Errorf("Unable to parse the data point: %v", err)
+	}
+
+	if dataPoint.Metric == "" {
+		return HMMetric{}, errors.New("Metric name was empty")
+	}
+
+	if len(dataPoint.Tags) == 0 {
+		return HMMetric{}, errors.New("Missing tags")
+	}
+
+	timestamp, err := parseTimestamp(unquoteJSONNumber(dataPoint.Timestamp))
+	if err != nil {
+		return HMMetric{}, fmt.Errorf("Invalid timestamp: %v", err)
+	}
+
+	value, err := strconv.ParseFloat(unquoteJSONNumber(dataPoint.Value), 64)
+	if err != nil {
+		return HMMetric{}, fmt.Errorf("Unable to parse value to a number: %v", err)
+	}
+
+	return newHMMetric(dataPoint.Metric, value, timestamp, dataPoint.Tags), nil
+}
+
+func unquoteJSONNumber(raw json.RawMessage) string {
+	number := strings.TrimSpace(string(raw))
+	if unquoted, err := strconv.Unquote(number); err == nil {
+		return unquoted
+	}
+
+	return number
+}
+
+func writeOpenTSDBError(w http.ResponseWriter, status int, message string, details string) {
+	writeOpenTSDBJSON(w, status, map[string]openTSDBError{
+		"error": {
+			Code:    status,
+			Message: message,
+			Details: details,
+		},
+	})
+}
+
+func writeOpenTSDBJSON(w http.ResponseWriter, status int, body interface{}) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		log.Errorf("Error encoding OpenTSDB response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+func requestRemoteAddr(r *http.Request) net.Addr {
+	remoteAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return remoteAddr
+}
@@ -0,0 +1,296 @@
+package collectors_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("HMTSDBHTTPHandler", func() {
+	var (
+		err             error
+		namespace       string
+		environment     string
+		tsdbListener    net.Listener
+		hmTSDBCollector *HMTSDBCollector
+		hmTSDBListener  *HMTSDBListener
+		handler         *HMTSDBHTTPHandler
+
+		method      string
+		path        string
+		body        []byte
+		gzipEncoded bool
+		recorder    *httptest.ResponseRecorder
+
+		jobHealthyMetric                *prometheus.GaugeVec
+		totalReceivedTSDBMessagesMetric *prometheus.CounterVec
+		totalInvalidTSDBMessagesMetric  prometheus.Counter
+
+		deploymentName = "fake-deployment-name"
+		jobName        = "fake-job-name"
+		jobID          = "fake-job-id"
+		jobIndex       = "0"
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener(namespace, environment, HMTSDBCollectorConfig{}, HMTSDBListenerConfig{})
+		handler = NewHMTSDBHTTPHandler(hmTSDBListener)
+
+		method = "POST"
+		path = "/api/put"
+		gzipEncoded = false
+
+		jobHealthyMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "healthy",
+				Help:      "BOSH Job Healthy (1 for healthy, 0 for unhealthy).",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+		)
+
+		totalReceivedTSDBMessagesMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "received_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB received messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"client_cn"},
+		)
+
+		totalInvalidTSDBMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "invalid_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB invalid messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	JustBeforeEach(func() {
+		requestBody := body
+		if gzipEncoded {
+			buffer := &bytes.Buffer{}
+			gzipWriter := gzip.NewWriter(buffer)
+			_, err = gzipWriter.Write(body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gzipWriter.Close()).To(Succeed())
+			requestBody = buffer.Bytes()
+		}
+
+		request := httptest.NewRequest(method, path, bytes.NewReader(requestBody))
+		if gzipEncoded {
+			request.Header.Set("Content-Encoding", "gzip")
+		}
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+	})
+
+	dataPoint := func(metric string, value string) string {
+		return fmt.Sprintf(
+			`{"metric":"%s","timestamp":%d,"value":%s,"tags":{"deployment":"%s","job":"%s","index":"%s","id":"%s"}}`,
+			metric, time.Now().Unix(), value, deploymentName, jobName, jobIndex, jobID,
+		)
+	}
+
+	collect := func(collector prometheus.Collector) chan prometheus.Metric {
+		metrics := make(chan prometheus.Metric, 100)
+		collector.Collect(metrics)
+		close(metrics)
+		return metrics
+	}
+
+	Context("when a single data point is posted", func() {
+		BeforeEach(func() {
+			body = []byte(dataPoint("system.healthy", "1"))
+			jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(1)
+			totalReceivedTSDBMessagesMetric.WithLabelValues("").Inc()
+		})
+
+		It("returns a 204 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusNoContent))
+			Expect(recorder.Body.String()).To(BeEmpty())
+		})
+
+		It("returns a job_healthy metric", func() {
+			Expect(collect(hmTSDBCollector)).To(Receive(PrometheusMetric(jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+		})
+
+		It("returns a received_tsdb_messages_total metric", func() {
+			metrics := collect(hmTSDBListener)
+			Eventually(metrics).Should(Receive(PrometheusMetric(totalReceivedTSDBMessagesMetric.WithLabelValues(""))))
+		})
+	})
+
+	Context("when an array of data points is posted", func() {
+		BeforeEach(func() {
+			body = []byte(fmt.Sprintf(`[%s, %s]`, dataPoint("system.healthy", `"0"`), dataPoint("system.cpu.sys", "0.5")))
+			jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(0)
+			totalReceivedTSDBMessagesMetric.WithLabelValues("").Add(2)
+		})
+
+		It("returns a 204 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusNoContent))
+		})
+
+		It("returns a job_healthy metric", func() {
+			Eventually(collect(hmTSDBCollector)).Should(Receive(PrometheusMetric(jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+		})
+
+		It("returns a received_tsdb_messages_total metric", func() {
+			Eventually(collect(hmTSDBListener)).Should(Receive(PrometheusMetric(totalReceivedTSDBMessagesMetric.WithLabelValues(""))))
+		})
+	})
+
+	Context("when a gzip encoded data point is posted", func() {
+		BeforeEach(func() {
+			gzipEncoded = true
+			body = []byte(dataPoint("system.healthy", "1"))
+			jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex).Set(1)
+		})
+
+		It("returns a job_healthy metric", func() {
+			Expect(recorder.Code).To(Equal(http.StatusNoContent))
+			Eventually(collect(hmTSDBCollector)).Should(Receive(PrometheusMetric(jobHealthyMetric.WithLabelValues(deploymentName, jobName, jobID, jobIndex))))
+		})
+	})
+
+	Context("when the body is too large", func() {
+		BeforeEach(func() {
+			body = append([]byte(dataPoint("system.healthy", "1")), bytes.Repeat([]byte(" "), 8*1024*1024)...)
+		})
+
+		It("returns a 413 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(BeEmpty())
+		})
+	})
+
+	Context("when the decompressed body is too large", func() {
+		BeforeEach(func() {
+			gzipEncoded = true
+			body = append([]byte(dataPoint("system.healthy", "1")), bytes.Repeat([]byte(" "), 8*1024*1024)...)
+		})
+
+		It("returns a 413 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(jobInstanceIDsOf(hmTSDBCollector)).To(BeEmpty())
+		})
+	})
+
+	Context("when an invalid data point is posted", func() {
+		BeforeEach(func() {
+			body = []byte(fmt.Sprintf(`[%s, %s]`, dataPoint("system.healthy", "1"), dataPoint("system.cpu.sys", `"a"`)))
+			totalInvalidTSDBMessagesMetric.Inc()
+		})
+
+		It("returns a 400 status code with an OpenTSDB error", func() {
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(recorder.Body.String()).To(MatchJSON(`{"error":{"code":400,"message":"One or more data points had errors","details":"Please see the TSD logs or append \"details\" to the put request"}}`))
+		})
+
+		It("returns a invalid_tsdb_messages_total metric", func() {
+			Eventually(collect(hmTSDBListener)).Should(Receive(PrometheusMetric(totalInvalidTSDBMessagesMetric)))
+		})
+
+		Context("and the summary is requested", func() {
+			BeforeEach(func() {
+				path = "/api/put?summary"
+			})
+
+			It("returns a 400 status code with the summary", func() {
+				Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+				Expect(recorder.Body.String()).To(MatchJSON(`{"failed":1,"success":1}`))
+			})
+		})
+
+		Context("and the details are requested", func() {
+			BeforeEach(func() {
+				path = "/api/put?details"
+			})
+
+			It("returns a 400 status code with the details", func() {
+				Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+				Expect(recorder.Body.String()).To(ContainSubstring(`"failed":1`))
+				Expect(recorder.Body.String()).To(ContainSubstring(`"success":1`))
+				Expect(recorder.Body.String()).To(ContainSubstring(`"error":"Unable to parse value to a number`))
+			})
+		})
+	})
+
+	Context("when valid data points are posted and the details are requested", func() {
+		BeforeEach(func() {
+			path = "/api/put?details"
+			body = []byte(dataPoint("system.healthy", "1"))
+		})
+
+		It("returns a 200 status code with the details", func() {
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(MatchJSON(`{"errors":[],"failed":0,"success":1}`))
+		})
+	})
+
+	Context("when the body is not valid JSON", func() {
+		BeforeEach(func() {
+			body = []byte(`{"metric":`)
+		})
+
+		It("returns a 400 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(recorder.Body.String()).To(ContainSubstring(`"message":"Unable to parse the given JSON"`))
+		})
+	})
+
+	Context("when the body is empty", func() {
+		BeforeEach(func() {
+			body = []byte{}
+		})
+
+		It("returns a 400 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("when the method is not POST", func() {
+		BeforeEach(func() {
+			method = "GET"
+			body = []byte{}
+		})
+
+		It("returns a 405 status code", func() {
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+			Expect(recorder.Body.String()).To(MatchJSON(`{"error":{"code":405,"message":"Method not allowed","details":"The HTTP method [GET] is not permitted for this endpoint"}}`))
+		})
+	})
+})
@@ -0,0 +1,446 @@
+package collectors
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+type HMTSDBListenerConfig struct {
+	ConnectionPolicy  ConnectionPolicy
+	HMMetricBus       *HMMetricBus
+	EnvironmentRouter *EnvironmentRouter
+}
+
+// HMTSDBListener accepts the BOSH HM TSDB connections of an environment and
+// publishes the metrics it parses to the HMTSDBCollector of their environment,
+// through a HMMetricBus when configured. The Graphite, HTTP and JSON listeners
+// publish through it, sharing its connection policy.
+type HMTSDBListener struct {
+	namespace                                    string
+	environment                                  string
+	collector                                    *HMTSDBCollector
+	tsdbListener                                 net.Listener
+	environmentRouter                            *EnvironmentRouter
+	hmMetricBus                                  *HMMetricBus
+	connectionPolicy                             ConnectionPolicy
+	connections                                  chan struct{}
+	sourceLimiter                                *sourceLimiter
+	totalReceivedTSDBMessagesMetric              *prometheus.CounterVec
+	totalInvalidTSDBMessagesMetric               prometheus.Counter
+	totalRejectedTSDBConnectionsMetric           *prometheus.CounterVec
+	openTSDBConnectionsMetric                    prometheus.Gauge
+	totalTSDBConnectionsMetric                   prometheus.Counter
+	totalTSDBConnectionErrorsMetric              *prometheus.CounterVec
+	totalReceivedTSDBBytesMetric                 prometheus.Counter
+	totalThrottledTSDBMessagesMetric             prometheus.Counter
+	totalUnresolvedEnvironmentTSDBMessagesMetric prometheus.Counter
+	lastReceivedTSDBMessageTimestampMetric       prometheus.Gauge
+}
+
+func NewHMTSDBListener(
+	namespace string,
+	environment string,
+	config HMTSDBListenerConfig,
+	collector *HMTSDBCollector,
+	tsdbListener net.Listener,
+) *HMTSDBListener {
+	totalReceivedTSDBMessagesMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "received_tsdb_messages_total",
+			Help:      "Total number of BOSH HM TSDB received messages.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+		[]string{"client_cn"},
+	)
+	// Always export the plaintext series, even before the first message.
+	totalReceivedTSDBMessagesMetric.WithLabelValues("")
+
+	totalInvalidTSDBMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "invalid_tsdb_messages_total",
+			Help:      "Total number of BOSH HM TSDB invalid messages.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalRejectedTSDBConnectionsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "rejected_tsdb_connections_total",
+			Help:      "Total number of BOSH HM TSDB rejected connections.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+		[]string{"reason"},
+	)
+
+	openTSDBConnectionsMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "tsdb_connections_open",
+			Help:      "Number of BOSH HM TSDB open connections.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalTSDBConnectionsMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "tsdb_connections_total",
+			Help:      "Total number of BOSH HM TSDB accepted connections.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalTSDBConnectionErrorsMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "tsdb_connection_errors_total",
+			Help:      "Total number of BOSH HM TSDB connections closed on error.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+		[]string{"reason"},
+	)
+
+	totalReceivedTSDBBytesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "received_tsdb_bytes_total",
+			Help:      "Total number of bytes received on the BOSH HM TSDB connections.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalThrottledTSDBMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "throttled_tsdb_messages_total",
+			Help:      "Total number of BOSH HM TSDB messages discarded because their source exceeded the rate limit.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalUnresolvedEnvironmentTSDBMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "unresolved_environment_tsdb_messages_total",
+			Help:      "Total number of BOSH HM TSDB messages kept in the listener environment because their environment could not be resolved or is not allowed.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastReceivedTSDBMessageTimestampMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_received_tsdb_message_timestamp",
+			Help:      "Number of seconds since 1970 since last received message from BOSH HM TSDB.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	listener := &HMTSDBListener{
+		namespace:                                    namespace,
+		environment:                                  environment,
+		collector:                                    collector,
+		tsdbListener:                                 tsdbListener,
+		environmentRouter:                            config.EnvironmentRouter,
+		hmMetricBus:                                  config.HMMetricBus,
+		connectionPolicy:                             config.ConnectionPolicy,
+		totalReceivedTSDBMessagesMetric:              totalReceivedTSDBMessagesMetric,
+		totalInvalidTSDBMessagesMetric:               totalInvalidTSDBMessagesMetric,
+		totalRejectedTSDBConnectionsMetric:           totalRejectedTSDBConnectionsMetric,
+		openTSDBConnectionsMetric:                    openTSDBConnectionsMetric,
+		totalTSDBConnectionsMetric:                   totalTSDBConnectionsMetric,
+		totalTSDBConnectionErrorsMetric:              totalTSDBConnectionErrorsMetric,
+		totalReceivedTSDBBytesMetric:                 totalReceivedTSDBBytesMetric,
+		totalThrottledTSDBMessagesMetric:             totalThrottledTSDBMessagesMetric,
+		totalUnresolvedEnvironmentTSDBMessagesMetric: totalUnresolvedEnvironmentTSDBMessagesMetric,
+		lastReceivedTSDBMessageTimestampMetric:       lastReceivedTSDBMessageTimestampMetric,
+	}
+	if config.ConnectionPolicy.MaxConnections > 0 {
+		listener.connections = make(chan struct{}, config.ConnectionPolicy.MaxConnections)
+	}
+	if config.ConnectionPolicy.LinesPerSecond > 0 {
+		listener.sourceLimiter = newSourceLimiter(config.ConnectionPolicy.LinesPerSecond, config.ConnectionPolicy.burst())
+	}
+
+	// Listeners only used by the Graphite, HTTP or JSON ones have no TSDB
+	// listener of their own.
+	if tsdbListener != nil {
+		go listener.listenHMTSDB()
+	}
+
+	return listener
+}
+
+func (l *HMTSDBListener) Collect(ch chan<- prometheus.Metric) {
+	l.totalReceivedTSDBMessagesMetric.Collect(ch)
+	l.totalInvalidTSDBMessagesMetric.Collect(ch)
+	l.totalRejectedTSDBConnectionsMetric.Collect(ch)
+	l.openTSDBConnectionsMetric.Collect(ch)
+	l.totalTSDBConnectionsMetric.Collect(ch)
+	l.totalTSDBConnectionErrorsMetric.Collect(ch)
+	l.totalReceivedTSDBBytesMetric.Collect(ch)
+	l.totalThrottledTSDBMessagesMetric.Collect(ch)
+	l.totalUnresolvedEnvironmentTSDBMessagesMetric.Collect(ch)
+	l.lastReceivedTSDBMessageTimestampMetric.Collect(ch)
+}
+
+func (l *HMTSDBListener) Describe(ch chan<- *prometheus.Desc) {
+	l.totalReceivedTSDBMessagesMetric.Describe(ch)
+	l.totalInvalidTSDBMessagesMetric.Describe(ch)
+	l.totalRejectedTSDBConnectionsMetric.Describe(ch)
+	l.openTSDBConnectionsMetric.Describe(ch)
+	l.totalTSDBConnectionsMetric.Describe(ch)
+	l.totalTSDBConnectionErrorsMetric.Describe(ch)
+	l.totalReceivedTSDBBytesMetric.Describe(ch)
+	l.totalThrottledTSDBMessagesMetric.Describe(ch)
+	l.totalUnresolvedEnvironmentTSDBMessagesMetric.Describe(ch)
+	l.lastReceivedTSDBMessageTimestampMetric.Describe(ch)
+}
+
+func (l *HMTSDBListener) listenHMTSDB() {
+	for {
+		conn, err := l.tsdbListener.Accept()
+		if err != nil {
+			log.Errorf("Error accepting BOSH HM TSDB connections: %v", err)
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+
+		if !l.acceptHMConnection(conn) {
+			conn.Close()
+			continue
+		}
+		go l.handleHMMessage(conn)
+	}
+}
+
+func (l *HMTSDBListener) acceptHMConnection(conn net.Conn) bool {
+	if !l.connectionPolicy.allowed(remoteIP(conn.RemoteAddr())) {
+		log.Errorf("BOSH HM TSDB connection from `%s` rejected, not in the allowed networks", conn.RemoteAddr())
+		l.totalRejectedTSDBConnectionsMetric.WithLabelValues("not_allowed").Inc()
+		return false
+	}
+
+	if l.connections != nil {
+		select {
+		case l.connections <- struct{}{}:
+		default:
+			log.Errorf("BOSH HM TSDB connection from `%s` rejected, too many connections", conn.RemoteAddr())
+			l.totalRejectedTSDBConnectionsMetric.WithLabelValues("too_many_connections").Inc()
+			return false
+		}
+	}
+
+	return true
+}
+
+func (l *HMTSDBListener) limitHMSource(remoteAddr net.Addr) (func() bool, func()) {
+	if l.sourceLimiter == nil {
+		return func() bool { return true }, func() {}
+	}
+
+	source := remoteIP(remoteAddr).String()
+	bucket := l.sourceLimiter.acquire(source)
+	allow := func() bool {
+		if !l.sourceLimiter.allow(bucket, time.Now()) {
+			l.totalThrottledTSDBMessagesMetric.Inc()
+			return false
+		}
+		return true
+	}
+
+	return allow, func() { l.sourceLimiter.release(source) }
+}
+
+// LimitListener applies the connection policy of the listener to the
+// connections accepted by another ingest listener, such as the Graphite or the
+// HTTP ones. The connection slots are shared with the TSDB listener.
+func (l *HMTSDBListener) LimitListener(listener net.Listener) net.Listener {
+	return &limitedListener{Listener: listener, hmTSDBListener: l}
+}
+
+func (l *HMTSDBListener) handleHMMessage(conn net.Conn) {
+	defer conn.Close()
+	if l.connections != nil {
+		defer func() { <-l.connections }()
+	}
+
+	l.totalTSDBConnectionsMetric.Inc()
+	l.openTSDBConnectionsMetric.Inc()
+	defer l.openTSDBConnectionsMetric.Dec()
+
+	allowHMMessage, releaseHMSource := l.limitHMSource(conn.RemoteAddr())
+	defer releaseHMSource()
+
+	clientCN, err := clientCommonName(conn)
+	if err != nil {
+		log.Errorf("Error establishing BOSH HM TSDB TLS connection from `%s`: %v", conn.RemoteAddr(), err)
+		l.totalTSDBConnectionErrorsMetric.WithLabelValues("tls_handshake").Inc()
+		return
+	}
+
+	totalReceivedTSDBMessagesMetric := l.totalReceivedTSDBMessagesMetric.WithLabelValues(clientCN)
+	scanner := bufio.NewScanner(&hmConnectionReader{
+		conn:                         conn,
+		idleTimeout:                  l.connectionPolicy.IdleTimeout,
+		totalReceivedTSDBBytesMetric: l.totalReceivedTSDBBytesMetric,
+	})
+	for scanner.Scan() {
+		totalReceivedTSDBMessagesMetric.Inc()
+		l.lastReceivedTSDBMessageTimestampMetric.Set(float64(time.Now().Unix()))
+
+		if !allowHMMessage() {
+			continue
+		}
+
+		hmMessage := scanner.Text()
+		if command := hmCommand(hmMessage); command != "put" {
+			if !l.handleHMCommand(conn, command) {
+				return
+			}
+			continue
+		}
+
+		hmMetric, err := parseHMMessage(hmMessage)
+		if err != nil {
+			log.Error(err)
+			l.totalInvalidTSDBMessagesMetric.Inc()
+			continue
+		}
+
+		l.publishHMMetric(l.routeHMMetric(hmMetric, conn.RemoteAddr()), hmMetric)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Error reading BOSH HM TSDB connection from `%s`: %v", conn.RemoteAddr(), err)
+		l.totalTSDBConnectionErrorsMetric.WithLabelValues(connectionErrorReason(err)).Inc()
+	}
+}
+
+// routeHMMetric returns the HMTSDBCollector of the environment of a BOSH HM
+// metric, the listener one when it cannot be resolved.
+func (l *HMTSDBListener) routeHMMetric(hmMetric HMMetric, remoteAddr net.Addr) *HMTSDBCollector {
+	if l.environmentRouter == nil || l.environmentRouter.resolver == nil {
+		return l.collector
+	}
+
+	collector, err := l.environmentRouter.collector(hmMetric, remoteAddr)
+	if err != nil {
+		log.Error(err)
+	}
+	if collector == nil {
+		l.totalUnresolvedEnvironmentTSDBMessagesMetric.Inc()
+		return l.collector
+	}
+
+	return collector
+}
+
+// publishHMMetric publishes a BOSH HM metric in the environment of a
+// HMTSDBCollector once its timestamp is accepted there.
+func (l *HMTSDBListener) publishHMMetric(collector *HMTSDBCollector, hmMetric HMMetric) {
+	if err := collector.validateTimestamp(hmMetric.Timestamp); err != nil {
+		log.Errorf("BOSH HM TSDB metric `%s` rejected: %v", hmMetric.Name, err)
+		return
+	}
+
+	if l.hmMetricBus == nil {
+		collector.Consume(collector.environment, hmMetric)
+		return
+	}
+
+	l.hmMetricBus.Publish(collector.environment, hmMetric)
+}
+
+func parseHMMessage(hmMessage string) (HMMetric, error) {
+	hmMetric := HMMetric{}
+
+	log.Debugf("Parsing BOSH HM TSDB message `%s`", hmMessage)
+
+	tokens := strings.Split(hmMessage, " ")
+	if len(tokens) < 4 {
+		return hmMetric, errors.New(fmt.Sprintf("BOSH HM TSDB message discarded, it has less than 4 tokens: %v", hmMessage))
+	}
+
+	timestamp, err := parseTimestamp(tokens[2])
+	if err != nil {
+		return hmMetric, errors.New(fmt.Sprintf("BOSH HM TSDB message discarded, timestamp `%s` cannot be parsed: %v", tokens[2], err))
+	}
+
+	value, err := strconv.ParseFloat(tokens[3], 64)
+	if err != nil {
+		return hmMetric, errors.New(fmt.Sprintf("BOSH HM TSDB message discarded, value `%s` cannot be parsed as float: %v", tokens[3], err))
+	}
+
+	tags := map[string]string{}
+	for i := 4; i < len(tokens); i++ {
+		tag := strings.SplitN(tokens[i], "=", 2)
+		if len(tag) > 1 {
+			tags[tag[0]] = tag[1]
+		}
+	}
+
+	return newHMMetric(tokens[1], value, timestamp, tags), nil
+}
+
+func formatHMMessage(environment string, hmMetric HMMetric) string {
+	timestamp := strconv.FormatInt(hmMetric.Timestamp.Unix(), 10)
+	if hmMetric.Timestamp.Nanosecond() != 0 {
+		timestamp = strconv.FormatInt(hmMetric.Timestamp.UnixNano()/int64(time.Millisecond), 10)
+	}
+
+	tokens := []string{"put", hmMetric.Name, timestamp, strconv.FormatFloat(hmMetric.Value, 'f', -1, 64)}
+	tags := []string{"environment=" + environment}
+	for key, value := range hmMetric.Tags {
+		if key != "environment" {
+			tags = append(tags, key+"="+value)
+		}
+	}
+	sort.Strings(tags)
+
+	return strings.Join(append(tokens, tags...), " ")
+}
@@ -0,0 +1,167 @@
+package collectors_test
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("HMTSDBListener", func() {
+	var (
+		namespace       string
+		environment     string
+		tsdbListener    net.Listener
+		hmTSDBCollector *HMTSDBCollector
+		hmTSDBListener  *HMTSDBListener
+
+		jobHealthyMetric                       *prometheus.GaugeVec
+		totalReceivedTSDBMessagesMetric        *prometheus.CounterVec
+		totalInvalidTSDBMessagesMetric         prometheus.Counter
+		lastReceivedTSDBMessageTimestampMetric prometheus.Gauge
+
+		tsdbTags = "deployment=fake-deployment-name job=fake-job-name index=0 id=fake-job-id"
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+
+		jobHealthyMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "healthy",
+				Help:      "BOSH Job Healthy (1 for healthy, 0 for unhealthy).",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"},
+		)
+
+		totalReceivedTSDBMessagesMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "received_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB received messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"client_cn"},
+		)
+
+		totalInvalidTSDBMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "invalid_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB invalid messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		lastReceivedTSDBMessageTimestampMetric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "last_received_tsdb_message_timestamp",
+				Help:      "Number of seconds since 1970 since last received message from BOSH HM TSDB.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	JustBeforeEach(func() {
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener(namespace, environment, HMTSDBCollectorConfig{}, HMTSDBListenerConfig{})
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	collect := func(collector prometheus.Collector) []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		collector.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	send := func(tsdbMessages string) {
+		conn, err := net.Dial("tcp", tsdbListener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = conn.Write([]byte(tsdbMessages))
+		Expect(err).ToNot(HaveOccurred())
+		conn.Close()
+	}
+
+	Describe("Describe", func() {
+		var descriptions chan *prometheus.Desc
+
+		JustBeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+			go hmTSDBListener.Describe(descriptions)
+		})
+
+		It("returns a received_tsdb_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalReceivedTSDBMessagesMetric.WithLabelValues("").Desc())))
+		})
+
+		It("returns a invalid_tsdb_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalInvalidTSDBMessagesMetric.Desc())))
+		})
+
+		It("returns a last_received_tsdb_message_timestamp metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(lastReceivedTSDBMessageTimestampMetric.Desc())))
+		})
+	})
+
+	It("publishes the received metrics to its collector", func() {
+		send(fmt.Sprintf("put system.healthy %d 1 %s\n", time.Now().Unix(), tsdbTags))
+
+		jobHealthyMetric.WithLabelValues("fake-deployment-name", "fake-job-name", "fake-job-id", "0").Set(1)
+		Eventually(func() []prometheus.Metric { return collect(hmTSDBCollector) }).Should(ContainElement(PrometheusMetric(jobHealthyMetric.WithLabelValues("fake-deployment-name", "fake-job-name", "fake-job-id", "0"))))
+
+		totalReceivedTSDBMessagesMetric.WithLabelValues("").Inc()
+		Expect(collect(hmTSDBListener)).To(ContainElement(PrometheusMetric(totalReceivedTSDBMessagesMetric.WithLabelValues(""))))
+	})
+
+	Context("when an invalid tsdb message is received", func() {
+		BeforeEach(func() {
+			totalInvalidTSDBMessagesMetric.Inc()
+		})
+
+		It("counts a message that does not have the right number of tokens", func() {
+			send(fmt.Sprintf("put invalid.tsdb.message %d\n", time.Now().Unix()))
+			Eventually(func() []prometheus.Metric { return collect(hmTSDBListener) }).Should(ContainElement(PrometheusMetric(totalInvalidTSDBMessagesMetric)))
+		})
+
+		It("counts a message whose timestamp cannot be parsed", func() {
+			send(fmt.Sprintf("put invalid.tsdb.message a 1 %s\n", tsdbTags))
+			Eventually(func() []prometheus.Metric { return collect(hmTSDBListener) }).Should(ContainElement(PrometheusMetric(totalInvalidTSDBMessagesMetric)))
+		})
+
+		It("counts a message whose value cannot be converted to a float", func() {
+			send(fmt.Sprintf("put invalid.tsdb.message %d a %s\n", time.Now().Unix(), tsdbTags))
+			Eventually(func() []prometheus.Metric { return collect(hmTSDBListener) }).Should(ContainElement(PrometheusMetric(totalInvalidTSDBMessagesMetric)))
+		})
+	})
+})
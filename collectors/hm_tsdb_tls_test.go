@@ -0,0 +1,352 @@
+package collectors_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+func newTestCertificate(commonName string, parent *testCertificate, isCA bool) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parentCertificate, parentKey := template, key
+	if parent != nil {
+		parentCertificate, parentKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCertificate, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+	certificate, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+var _ = Describe("NewTSDBTLSConfig", func() {
+	var (
+		err          error
+		tmpDir       string
+		certFile     string
+		keyFile      string
+		clientCAFile string
+		tlsConfig    *tls.Config
+	)
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", "hm_tsdb_tls")
+		Expect(err).ToNot(HaveOccurred())
+
+		ca := newTestCertificate("fake-ca", nil, true)
+		server := newTestCertificate("fake-server", ca, false)
+
+		certFile = filepath.Join(tmpDir, "cert.pem")
+		Expect(ioutil.WriteFile(certFile, server.certPEM, 0600)).To(Succeed())
+		keyFile = filepath.Join(tmpDir, "key.pem")
+		Expect(ioutil.WriteFile(keyFile, server.keyPEM, 0600)).To(Succeed())
+		clientCAFile = filepath.Join(tmpDir, "client_ca.pem")
+		Expect(ioutil.WriteFile(clientCAFile, ca.certPEM, 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	JustBeforeEach(func() {
+		tlsConfig, err = NewTSDBTLSConfig(certFile, keyFile, clientCAFile)
+	})
+
+	It("requires client certificates", func() {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tlsConfig.Certificates).To(HaveLen(1))
+		Expect(tlsConfig.ClientAuth).To(Equal(tls.RequireAndVerifyClientCert))
+	})
+
+	Context("when there is no client CA", func() {
+		BeforeEach(func() {
+			clientCAFile = ""
+		})
+
+		It("does not require client certificates", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tlsConfig.ClientAuth).To(Equal(tls.NoClientCert))
+		})
+	})
+
+	Context("when the key is missing", func() {
+		BeforeEach(func() {
+			keyFile = ""
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the client CA is not valid", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(clientCAFile, []byte("fake-ca"), 0600)).To(Succeed())
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("HMTSDBCollector with TLS", func() {
+	var (
+		namespace       string
+		environment     string
+		ca              *testCertificate
+		clientCert      *testCertificate
+		tsdbListener    net.Listener
+		hmTSDBCollector *HMTSDBCollector
+		hmTSDBListener  *HMTSDBListener
+
+		totalReceivedTSDBMessagesMetric *prometheus.CounterVec
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+
+		ca = newTestCertificate("fake-ca", nil, true)
+		server := newTestCertificate("fake-server", ca, false)
+		clientCert = newTestCertificate("fake-hm", ca, false)
+
+		serverCertificate, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+		Expect(err).ToNot(HaveOccurred())
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca.certificate)
+
+		tsdbListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		tsdbListener = tls.NewListener(tsdbListener, &tls.Config{
+			Certificates: []tls.Certificate{serverCertificate},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})
+
+		totalReceivedTSDBMessagesMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "received_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB received messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"client_cn"},
+		)
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	JustBeforeEach(func() {
+		metricMapper, err := NewMetricMapper(DefaultMetricMappings(), nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		hmTSDBCollector = NewHMTSDBCollector(namespace, environment, HMTSDBCollectorConfig{MetricMapper: metricMapper})
+		hmTSDBListener = NewHMTSDBListener(namespace, environment, HMTSDBListenerConfig{}, hmTSDBCollector, tsdbListener)
+	})
+
+	send := func(certificates []tls.Certificate) {
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(ca.certificate)
+
+		conn, err := tls.Dial("tcp", tsdbListener.Addr().String(), &tls.Config{
+			Certificates: certificates,
+			RootCAs:      rootCAs,
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "put system.healthy %d 1 deployment=fake-deployment job=fake-job index=0 id=fake-id\n", time.Now().Unix())
+	}
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		hmTSDBListener.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	It("counts the received messages by client certificate common name", func() {
+		clientCertificate, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+		Expect(err).ToNot(HaveOccurred())
+		send([]tls.Certificate{clientCertificate})
+
+		totalReceivedTSDBMessagesMetric.WithLabelValues("fake-hm").Inc()
+		Eventually(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(Equal([]string{"fake-id"}))
+		Expect(collect()).To(ContainElement(PrometheusMetric(totalReceivedTSDBMessagesMetric.WithLabelValues("fake-hm"))))
+	})
+
+	It("rejects the clients without certificate", func() {
+		send(nil)
+
+		Consistently(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("TSDB HTTP server with TLS", func() {
+	var (
+		ca              *testCertificate
+		clientCert      *testCertificate
+		httpListener    net.Listener
+		tsdbListener    net.Listener
+		hmTSDBCollector *HMTSDBCollector
+		hmTSDBListener  *HMTSDBListener
+		putBody         string
+
+		totalReceivedTSDBMessagesMetric *prometheus.CounterVec
+	)
+
+	BeforeEach(func() {
+		ca = newTestCertificate("fake-ca", nil, true)
+		server := newTestCertificate("fake-server", ca, false)
+		clientCert = newTestCertificate("fake-hm", ca, false)
+
+		serverCertificate, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+		Expect(err).ToNot(HaveOccurred())
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca.certificate)
+
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener("test_exporter", "test_environment", HMTSDBCollectorConfig{}, HMTSDBListenerConfig{})
+
+		httpListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		httpServer := NewTSDBHTTPServer(hmTSDBListener, &tls.Config{
+			Certificates: []tls.Certificate{serverCertificate},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})
+		go ServeTSDBHTTP(httpServer, httpListener)
+
+		putBody = fmt.Sprintf(`{"metric":"system.healthy","timestamp":%d,"value":1,"tags":{"deployment":"fake-deployment","job":"fake-job","index":"0","id":"fake-id"}}`, time.Now().Unix())
+
+		totalReceivedTSDBMessagesMetric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "test_exporter",
+				Subsystem: "",
+				Name:      "received_tsdb_messages_total",
+				Help:      "Total number of BOSH HM TSDB received messages.",
+				ConstLabels: prometheus.Labels{
+					"environment": "test_environment",
+				},
+			},
+			[]string{"client_cn"},
+		)
+	})
+
+	AfterEach(func() {
+		httpListener.Close()
+		tsdbListener.Close()
+	})
+
+	It("counts the posted data points by client certificate common name", func() {
+		clientCertificate, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+		Expect(err).ToNot(HaveOccurred())
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(ca.certificate)
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{clientCertificate},
+			RootCAs:      rootCAs,
+		}}}
+		response, err := client.Post("https://"+httpListener.Addr().String()+"/api/put", "application/json", strings.NewReader(putBody))
+		Expect(err).ToNot(HaveOccurred())
+		response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusNoContent))
+
+		Expect(jobInstanceIDsOf(hmTSDBCollector)).To(Equal([]string{"fake-id"}))
+
+		totalReceivedTSDBMessagesMetric.WithLabelValues("fake-hm").Inc()
+		ch := make(chan prometheus.Metric, 100)
+		hmTSDBListener.Collect(ch)
+		close(ch)
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		Expect(metrics).To(ContainElement(PrometheusMetric(totalReceivedTSDBMessagesMetric.WithLabelValues("fake-hm"))))
+	})
+
+	It("refuses the plaintext requests", func() {
+		response, err := http.Post("http://"+httpListener.Addr().String()+"/api/put", "application/json", strings.NewReader(putBody))
+		if err == nil {
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+		}
+
+		Consistently(func() []string { return jobInstanceIDsOf(hmTSDBCollector) }).Should(BeEmpty())
+	})
+})
+
+func jobInstanceIDsOf(collector *HMTSDBCollector) []string {
+	ids := []string{}
+	if collector == nil {
+		return ids
+	}
+	for _, jobInstance := range collector.JobInstances() {
+		ids = append(ids, jobInstance.ID)
+	}
+	return ids
+}
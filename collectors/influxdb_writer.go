@@ -0,0 +1,324 @@
+package collectors
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+const influxDBMaxBatchPoints = 5000
+
+var (
+	influxDBMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxDBTagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+)
+
+// InfluxDBConfig configures the InfluxDB write endpoint an InfluxDBWriter
+// writes to.
+type InfluxDBConfig struct {
+	URL        string
+	Username   string
+	Password   string
+	Token      string
+	Timeout    time.Duration
+	BufferSize int
+}
+
+func (c InfluxDBConfig) bufferSize() int {
+	if c.BufferSize > 0 {
+		return c.BufferSize
+	}
+
+	return 10000
+}
+
+// InfluxDBWriter writes the BOSH HM metrics to an InfluxDB write endpoint in
+// line protocol, naming the measurements and tags after the Prometheus
+// metrics and labels of the metric mappings.
+type InfluxDBWriter struct {
+	namespace                              string
+	config                                 InfluxDBConfig
+	metricMapper                           *MetricMapper
+	passthroughFilter                      *PassthroughFilter
+	httpClient                             *http.Client
+	mutex                                  sync.Mutex
+	lines                                  []string
+	totalInfluxDBWrittenPointsMetric       prometheus.Counter
+	totalInfluxDBFailedPointsMetric        prometheus.Counter
+	totalInfluxDBDroppedPointsMetric       prometheus.Counter
+	lastInfluxDBWriteTimestampMetric       prometheus.Gauge
+	lastInfluxDBWriteDurationSecondsMetric prometheus.Gauge
+}
+
+// NewInfluxDBWriter returns an InfluxDBWriter writing to the `config`
+// endpoint the BOSH HM metrics mapped by `metricMapper` or allowed by
+// `passthroughFilter`, if not nil.
+func NewInfluxDBWriter(
+	namespace string,
+	environment string,
+	metricMapper *MetricMapper,
+	passthroughFilter *PassthroughFilter,
+	config InfluxDBConfig,
+) (*InfluxDBWriter, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL `%s`: %v", config.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid InfluxDB URL `%s`: scheme must be http or https", config.URL)
+	}
+	if config.Username != "" && config.Token != "" {
+		return nil, errors.New("InfluxDB basic auth and token are mutually exclusive")
+	}
+
+	totalInfluxDBWrittenPointsMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "influxdb_written_points_total",
+			Help:      "Total number of points written to InfluxDB.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalInfluxDBFailedPointsMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "influxdb_failed_points_total",
+			Help:      "Total number of points dropped because the InfluxDB write request failed.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalInfluxDBDroppedPointsMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "influxdb_dropped_points_total",
+			Help:      "Total number of points dropped because the InfluxDB buffer was full.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastInfluxDBWriteTimestampMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_influxdb_write_timestamp",
+			Help:      "Number of seconds since 1970 since last successful InfluxDB write request.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastInfluxDBWriteDurationSecondsMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_influxdb_write_duration_seconds",
+			Help:      "Duration of the last successful InfluxDB write request.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	return &InfluxDBWriter{
+		namespace:                              namespace,
+		config:                                 config,
+		metricMapper:                           metricMapper,
+		passthroughFilter:                      passthroughFilter,
+		httpClient:                             &http.Client{Timeout: config.Timeout},
+		lines:                                  []string{},
+		totalInfluxDBWrittenPointsMetric:       totalInfluxDBWrittenPointsMetric,
+		totalInfluxDBFailedPointsMetric:        totalInfluxDBFailedPointsMetric,
+		totalInfluxDBDroppedPointsMetric:       totalInfluxDBDroppedPointsMetric,
+		lastInfluxDBWriteTimestampMetric:       lastInfluxDBWriteTimestampMetric,
+		lastInfluxDBWriteDurationSecondsMetric: lastInfluxDBWriteDurationSecondsMetric,
+	}, nil
+}
+
+func (w *InfluxDBWriter) SinkName() string {
+	return "influxdb"
+}
+
+// Consume buffers a BOSH HM metric as a line protocol point until the next
+// flush.
+func (w *InfluxDBWriter) Consume(environment string, hmMetric HMMetric) {
+	line, ok := w.line(environment, hmMetric)
+	if !ok {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.lines) >= w.config.bufferSize() {
+		w.totalInfluxDBDroppedPointsMetric.Inc()
+		return
+	}
+	w.lines = append(w.lines, line)
+}
+
+// Flush writes the buffered points, in batches of at most 5000 points.
+func (w *InfluxDBWriter) Flush() error {
+	w.mutex.Lock()
+	lines := w.lines
+	w.lines = []string{}
+	w.mutex.Unlock()
+
+	errs := []string{}
+	for len(lines) > 0 {
+		batch := lines
+		if len(batch) > influxDBMaxBatchPoints {
+			batch = batch[:influxDBMaxBatchPoints]
+		}
+		lines = lines[len(batch):]
+
+		begun := time.Now()
+		if err := w.write(batch); err != nil {
+			w.totalInfluxDBFailedPointsMetric.Add(float64(len(batch)))
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		w.totalInfluxDBWrittenPointsMetric.Add(float64(len(batch)))
+		w.lastInfluxDBWriteTimestampMetric.Set(float64(time.Now().Unix()))
+		w.lastInfluxDBWriteDurationSecondsMetric.Set(time.Since(begun).Seconds())
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (w *InfluxDBWriter) FlushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.Flush(); err != nil {
+			log.Errorf("Error writing metrics to `%s`: %v", w.config.URL, err)
+		}
+		<-ticker.C
+	}
+}
+
+func (w *InfluxDBWriter) Collect(ch chan<- prometheus.Metric) {
+	w.totalInfluxDBWrittenPointsMetric.Collect(ch)
+	w.totalInfluxDBFailedPointsMetric.Collect(ch)
+	w.totalInfluxDBDroppedPointsMetric.Collect(ch)
+	w.lastInfluxDBWriteTimestampMetric.Collect(ch)
+	w.lastInfluxDBWriteDurationSecondsMetric.Collect(ch)
+}
+
+func (w *InfluxDBWriter) Describe(ch chan<- *prometheus.Desc) {
+	w.totalInfluxDBWrittenPointsMetric.Describe(ch)
+	w.totalInfluxDBFailedPointsMetric.Describe(ch)
+	w.totalInfluxDBDroppedPointsMetric.Describe(ch)
+	w.lastInfluxDBWriteTimestampMetric.Describe(ch)
+	w.lastInfluxDBWriteDurationSecondsMetric.Describe(ch)
+}
+
+func (w *InfluxDBWriter) line(environment string, hmMetric HMMetric) (string, bool) {
+	if math.IsNaN(hmMetric.Value) || math.IsInf(hmMetric.Value, 0) {
+		return "", false
+	}
+
+	var measurement string
+	var tagNames, tagValues []string
+	if mapping, labelValues, ok := w.metricMapper.Map(hmMetric.Name); ok {
+		measurement = prometheus.BuildFQName(w.namespace, "", mapping.Name)
+		tagNames = concatStrings(jobLabelNames, mapping.LabelNames(), w.metricMapper.TagLabelNames())
+		tagValues = concatStrings(
+			[]string{hmMetric.Deployment, hmMetric.Job, hmMetric.Id, hmMetric.Index},
+			labelValues,
+			w.metricMapper.TagLabelValues(hmMetric.Tags),
+		)
+	} else if w.passthroughFilter != nil && w.passthroughFilter.Allowed(hmMetric.Name) {
+		measurement = prometheus.BuildFQName(w.namespace, "", sanitizeMetricName(hmMetric.Name))
+		var err error
+		tagNames, tagValues, err = passthroughLabels(hmMetric, w.metricMapper)
+		if err != nil {
+			return "", false
+		}
+	} else {
+		return "", false
+	}
+
+	tags := map[string]string{"environment": environment}
+	for i, tagName := range tagNames {
+		tags[tagName] = tagValues[i]
+	}
+	sortedTagNames := make([]string, 0, len(tags))
+	for tagName := range tags {
+		sortedTagNames = append(sortedTagNames, tagName)
+	}
+	sort.Strings(sortedTagNames)
+
+	line := influxDBMeasurementEscaper.Replace(measurement)
+	for _, tagName := range sortedTagNames {
+		// InfluxDB does not accept empty tag values.
+		if tags[tagName] == "" {
+			continue
+		}
+		line += "," + influxDBTagEscaper.Replace(tagName) + "=" + influxDBTagEscaper.Replace(tags[tagName])
+	}
+	line += " value=" + strconv.FormatFloat(hmMetric.Value, 'g', -1, 64)
+	line += " " + strconv.FormatInt(hmMetric.Timestamp.UnixNano(), 10)
+
+	return line, true
+}
+
+func (w *InfluxDBWriter) write(lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "bosh_tsdb_exporter/"+version.Version)
+	if w.config.Username != "" {
+		req.SetBasicAuth(w.config.Username, w.config.Password)
+	}
+	if w.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.config.Token)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
@@ -0,0 +1,274 @@
+package collectors_test
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("InfluxDBWriter", func() {
+	var (
+		err               error
+		namespace         string
+		environment       string
+		config            InfluxDBConfig
+		status            int
+		server            *httptest.Server
+		requests          chan *http.Request
+		bodies            chan []byte
+		metricMapper      *MetricMapper
+		passthroughFilter *PassthroughFilter
+		influxDBWriter    *InfluxDBWriter
+
+		totalInfluxDBWrittenPointsMetric prometheus.Counter
+		totalInfluxDBFailedPointsMetric  prometheus.Counter
+		totalInfluxDBDroppedPointsMetric prometheus.Counter
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		status = http.StatusNoContent
+		config = InfluxDBConfig{Timeout: time.Second}
+		passthroughFilter = nil
+
+		metricMapper, err = NewMetricMapper(
+			append(DefaultMetricMappings(), MetricMapping{
+				Match:     `system\.disk\.(.*)\.percent`,
+				MatchType: MatchTypeRegex,
+				Name:      "job_disk_percent",
+				Labels:    map[string]string{"disk": "$1"},
+			}),
+			[]TagMapping{{Tag: "az", Label: "bosh_az", Default: "z1"}},
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		totalInfluxDBWrittenPointsMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "influxdb_written_points_total",
+				Help:      "Total number of points written to InfluxDB.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalInfluxDBFailedPointsMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "influxdb_failed_points_total",
+				Help:      "Total number of points dropped because the InfluxDB write request failed.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalInfluxDBDroppedPointsMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "influxdb_dropped_points_total",
+				Help:      "Total number of points dropped because the InfluxDB buffer was full.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		server, requests, bodies = serveHTTPEndpoint(status)
+		config.URL = server.URL + "/write?db=bosh"
+		influxDBWriter, err = NewInfluxDBWriter(namespace, environment, metricMapper, passthroughFilter, config)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		influxDBWriter.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	hmMetric := func(name string, value float64, tags map[string]string) HMMetric {
+		hmMetric := HMMetric{
+			Name:       name,
+			Value:      value,
+			Deployment: "fake-deployment",
+			Job:        "fake-job",
+			Index:      "0",
+			Id:         "fake-id",
+			Tags: map[string]string{
+				"deployment": "fake-deployment",
+				"job":        "fake-job",
+				"index":      "0",
+				"id":         "fake-id",
+			},
+			Timestamp: time.Unix(1510000000, 0),
+		}
+		for key, value := range tags {
+			hmMetric.Tags[key] = value
+		}
+		return hmMetric
+	}
+
+	flushedLines := func() []string {
+		Expect(influxDBWriter.Flush()).To(Succeed())
+
+		var body []byte
+		Expect(bodies).To(Receive(&body))
+		return strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	}
+
+	Describe("Describe", func() {
+		var descriptions chan *prometheus.Desc
+
+		JustBeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+			go influxDBWriter.Describe(descriptions)
+		})
+
+		It("returns a influxdb_written_points_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalInfluxDBWrittenPointsMetric.Desc())))
+		})
+
+		It("returns a influxdb_failed_points_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalInfluxDBFailedPointsMetric.Desc())))
+		})
+
+		It("returns a influxdb_dropped_points_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalInfluxDBDroppedPointsMetric.Desc())))
+		})
+	})
+
+	It("writes the mapped metrics in line protocol", func() {
+		influxDBWriter.Consume(environment, hmMetric("system.healthy", 1, map[string]string{"az": "z2"}))
+		influxDBWriter.Consume(environment, hmMetric("system.disk.data.percent", 12.5, nil))
+
+		Expect(flushedLines()).To(Equal([]string{
+			"test_exporter_job_healthy,bosh_az=z2,bosh_deployment=fake-deployment,bosh_job_id=fake-id,bosh_job_index=0,bosh_job_name=fake-job,environment=test_environment value=1 1510000000000000000",
+			"test_exporter_job_disk_percent,bosh_az=z1,bosh_deployment=fake-deployment,bosh_job_id=fake-id,bosh_job_index=0,bosh_job_name=fake-job,disk=data,environment=test_environment value=12.5 1510000000000000000",
+		}))
+
+		var request *http.Request
+		Expect(requests).To(Receive(&request))
+		Expect(request.Method).To(Equal("POST"))
+		Expect(request.URL.Path).To(Equal("/write"))
+		Expect(request.URL.Query().Get("db")).To(Equal("bosh"))
+
+		totalInfluxDBWrittenPointsMetric.Add(2)
+		Expect(collect()).To(ContainElement(PrometheusMetric(totalInfluxDBWrittenPointsMetric)))
+	})
+
+	It("ignores the metrics not mapped and the non-finite values", func() {
+		influxDBWriter.Consume(environment, hmMetric("custom.metric", 1, nil))
+		influxDBWriter.Consume(environment, hmMetric("system.healthy", math.NaN(), nil))
+
+		Expect(influxDBWriter.Flush()).To(Succeed())
+		Expect(requests).ToNot(Receive())
+	})
+
+	It("escapes the tags", func() {
+		influxDBWriter.Consume("test environment", hmMetric("system.healthy", 1, map[string]string{"az": "z=1,2"}))
+
+		Expect(flushedLines()).To(Equal([]string{
+			`test_exporter_job_healthy,bosh_az=z\=1\,2,bosh_deployment=fake-deployment,bosh_job_id=fake-id,bosh_job_index=0,bosh_job_name=fake-job,environment=test\ environment value=1 1510000000000000000`,
+		}))
+	})
+
+	Context("when there is a pass-through filter", func() {
+		BeforeEach(func() {
+			passthroughFilter, err = NewPassthroughFilter(`custom\..*`, "")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("writes the pass-through metrics", func() {
+			influxDBWriter.Consume(environment, hmMetric("custom.metric", 2, map[string]string{"foo": "bar"}))
+
+			Expect(flushedLines()).To(Equal([]string{
+				"test_exporter_custom_metric,bosh_az=z1,bosh_deployment=fake-deployment,bosh_job_id=fake-id,bosh_job_index=0,bosh_job_name=fake-job,environment=test_environment,foo=bar value=2 1510000000000000000",
+			}))
+		})
+	})
+
+	Context("when there is a token", func() {
+		BeforeEach(func() {
+			config.Token = "fake-token"
+		})
+
+		It("authenticates with the token", func() {
+			influxDBWriter.Consume(environment, hmMetric("system.healthy", 1, nil))
+			Expect(influxDBWriter.Flush()).To(Succeed())
+
+			var request *http.Request
+			Expect(requests).To(Receive(&request))
+			Expect(request.Header.Get("Authorization")).To(Equal("Token fake-token"))
+		})
+	})
+
+	Context("when the buffer is full", func() {
+		BeforeEach(func() {
+			config.BufferSize = 1
+			totalInfluxDBDroppedPointsMetric.Inc()
+		})
+
+		It("drops the points", func() {
+			influxDBWriter.Consume(environment, hmMetric("system.healthy", 1, nil))
+			influxDBWriter.Consume(environment, hmMetric("system.healthy", 0, nil))
+
+			Expect(flushedLines()).To(HaveLen(1))
+			Expect(collect()).To(ContainElement(PrometheusMetric(totalInfluxDBDroppedPointsMetric)))
+		})
+	})
+
+	Context("when InfluxDB fails", func() {
+		BeforeEach(func() {
+			status = http.StatusInternalServerError
+			totalInfluxDBFailedPointsMetric.Inc()
+		})
+
+		It("returns an error and drops the points", func() {
+			influxDBWriter.Consume(environment, hmMetric("system.healthy", 1, nil))
+
+			Expect(influxDBWriter.Flush()).ToNot(Succeed())
+			Expect(collect()).To(ContainElement(PrometheusMetric(totalInfluxDBFailedPointsMetric)))
+		})
+	})
+
+	Context("when both basic auth and a token are set", func() {
+		It("returns an error", func() {
+			_, err := NewInfluxDBWriter(namespace, environment, metricMapper, nil, InfluxDBConfig{URL: server.URL, Username: "fake-username", Token: "fake-token"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the URL is not valid", func() {
+		It("returns an error", func() {
+			_, err := NewInfluxDBWriter(namespace, environment, metricMapper, nil, InfluxDBConfig{URL: "fake-url"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
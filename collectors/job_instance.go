@@ -0,0 +1,149 @@
+package collectors
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HeartbeatPolicy controls how BOSH Job instances that stopped sending
+// metrics are detected.
+type HeartbeatPolicy struct {
+	Interval      time.Duration
+	MaxMissed     int
+	GracePeriod   time.Duration
+	MarkUnhealthy bool
+}
+
+func (p HeartbeatPolicy) enabled() bool {
+	return p.Interval > 0 && p.MaxMissed > 0
+}
+
+func (p HeartbeatPolicy) missingAfter() time.Duration {
+	return p.Interval * time.Duration(p.MaxMissed)
+}
+
+// JobInstance is a BOSH Job instance that sent metrics to the exporter.
+type JobInstance struct {
+	Deployment string
+	Job        string
+	Index      string
+	ID         string
+	Tags       map[string]string
+	LastSeen   time.Time
+	Reporting  bool
+}
+
+func (i *JobInstance) labelValues() []string {
+	return []string{i.Deployment, i.Job, i.ID, i.Index}
+}
+
+func jobInstanceKey(hmMetric HMMetric) string {
+	return strings.Join([]string{hmMetric.Deployment, hmMetric.Job, hmMetric.Id, hmMetric.Index}, "\xff")
+}
+
+// JobInstances returns the tracked BOSH Job instances, sorted by deployment,
+// job, index and id.
+func (c *HMTSDBCollector) JobInstances() []JobInstance {
+	now := time.Now()
+
+	c.jobMetricsMutex.Lock()
+	instances := make([]JobInstance, 0, len(c.jobInstances))
+	for _, instance := range c.jobInstances {
+		jobInstance := *instance
+		jobInstance.Reporting = c.jobInstanceReporting(instance, now)
+		instances = append(instances, jobInstance)
+	}
+	c.jobMetricsMutex.Unlock()
+
+	sort.Slice(instances, func(i, j int) bool {
+		a, b := instances[i], instances[j]
+		if a.Deployment != b.Deployment {
+			return a.Deployment < b.Deployment
+		}
+		if a.Job != b.Job {
+			return a.Job < b.Job
+		}
+		if a.Index != b.Index {
+			return a.Index < b.Index
+		}
+		return a.ID < b.ID
+	})
+
+	return instances
+}
+
+// trackJobInstance records that a BOSH Job instance sent a metric. Callers
+// must hold the job metrics lock.
+func (c *HMTSDBCollector) trackJobInstance(hmMetric HMMetric, now time.Time) {
+	key := jobInstanceKey(hmMetric)
+	instance, ok := c.jobInstances[key]
+	if !ok {
+		instance = &JobInstance{
+			Deployment: hmMetric.Deployment,
+			Job:        hmMetric.Job,
+			Index:      hmMetric.Index,
+			ID:         hmMetric.Id,
+		}
+		c.jobInstances[key] = instance
+	}
+	instance.Tags = hmMetric.Tags
+	instance.LastSeen = now
+}
+
+func (c *HMTSDBCollector) jobInstanceReporting(instance *JobInstance, now time.Time) bool {
+	window := c.metricsTTL
+	if c.heartbeatPolicy.enabled() {
+		window = c.heartbeatPolicy.missingAfter()
+	}
+
+	return window <= 0 || now.Sub(instance.LastSeen) <= window
+}
+
+// updateJobInstances refreshes the heartbeat missing series of the tracked
+// instances, forgetting the ones that are not reporting anymore (after the
+// grace period when the missing heartbeat detection is enabled). Callers must
+// hold the job metrics lock.
+func (c *HMTSDBCollector) updateJobInstances(now time.Time) {
+	for key, instance := range c.jobInstances {
+		reporting := c.jobInstanceReporting(instance, now)
+		if !reporting && (!c.heartbeatPolicy.enabled() || now.Sub(instance.LastSeen) > c.heartbeatPolicy.missingAfter()+c.heartbeatPolicy.GracePeriod) {
+			c.jobHeartbeatMissingMetric.remove(instance.labelValues())
+			for _, series := range c.jobStateMetric.withPrefix(instance.labelValues()) {
+				c.jobStateMetric.remove(series.labelValues)
+			}
+			delete(c.jobInstances, key)
+			continue
+		}
+
+		if !c.heartbeatPolicy.enabled() {
+			continue
+		}
+
+		if reporting {
+			c.jobHeartbeatMissingMetric.set(instance.labelValues(), 0, time.Time{}, now)
+			continue
+		}
+
+		c.jobHeartbeatMissingMetric.set(instance.labelValues(), 1, time.Time{}, now)
+		if c.heartbeatPolicy.MarkUnhealthy {
+			c.markJobInstanceUnhealthy(instance, now)
+		}
+	}
+}
+
+func (c *HMTSDBCollector) markJobInstanceUnhealthy(instance *JobInstance, now time.Time) {
+	mapping, labelValues, ok := c.metricMapper.Map("system.healthy")
+	if !ok {
+		return
+	}
+
+	c.jobMetricsByName[prometheus.BuildFQName(c.namespace, "", mapping.Name)].set(
+		concatStrings(instance.labelValues(), labelValues, c.metricMapper.TagLabelValues(instance.Tags)),
+		0,
+		now,
+		now,
+	)
+}
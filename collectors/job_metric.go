@@ -0,0 +1,103 @@
+package collectors
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type jobSeries struct {
+	labelValues []string
+	value       float64
+	timestamp   time.Time
+	updatedAt   time.Time
+}
+
+// jobMetric holds the series of a mapped BOSH Job metric. It is not safe for
+// concurrent use, callers must hold the collector job metrics lock.
+type jobMetric struct {
+	fqName     string
+	desc       *prometheus.Desc
+	valueType  prometheus.ValueType
+	labelNames []string
+	series     map[string]*jobSeries
+}
+
+func newJobMetric(fqName string, help string, valueType prometheus.ValueType, labelNames []string, environment string) *jobMetric {
+	return &jobMetric{
+		fqName: fqName,
+		desc: prometheus.NewDesc(
+			fqName,
+			help,
+			labelNames,
+			prometheus.Labels{"environment": environment},
+		),
+		valueType:  valueType,
+		labelNames: labelNames,
+		series:     map[string]*jobSeries{},
+	}
+}
+
+func (m *jobMetric) set(labelValues []string, value float64, timestamp time.Time, updatedAt time.Time) bool {
+	key := strings.Join(labelValues, "\xff")
+	series, ok := m.series[key]
+	if !ok {
+		series = &jobSeries{labelValues: labelValues}
+		m.series[key] = series
+	} else if timestamp.Before(series.timestamp) {
+		return false
+	}
+	series.value = value
+	series.timestamp = timestamp
+	series.updatedAt = updatedAt
+
+	return true
+}
+
+func (m *jobMetric) get(labelValues []string) (*jobSeries, bool) {
+	series, ok := m.series[strings.Join(labelValues, "\xff")]
+	return series, ok
+}
+
+func (m *jobMetric) withPrefix(labelValues []string) []*jobSeries {
+	prefix := strings.Join(labelValues, "\xff") + "\xff"
+	series := []*jobSeries{}
+	for key, s := range m.series {
+		if strings.HasPrefix(key, prefix) {
+			series = append(series, s)
+		}
+	}
+
+	return series
+}
+
+func (m *jobMetric) remove(labelValues []string) {
+	delete(m.series, strings.Join(labelValues, "\xff"))
+}
+
+func (m *jobMetric) metrics(exportTimestamps bool) []prometheus.Metric {
+	metrics := make([]prometheus.Metric, 0, len(m.series))
+	for _, series := range m.series {
+		var metric prometheus.Metric
+		metric = prometheus.MustNewConstMetric(m.desc, m.valueType, series.value, series.labelValues...)
+		if exportTimestamps && !series.timestamp.IsZero() {
+			metric = timestampedMetric{Metric: metric, timestamp: series.timestamp}
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+func (m *jobMetric) expire(before time.Time) int {
+	expired := 0
+	for key, series := range m.series {
+		if series.updatedAt.Before(before) {
+			delete(m.series, key)
+			expired++
+		}
+	}
+
+	return expired
+}
@@ -0,0 +1,331 @@
+package collectors
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	MatchTypeExact = "exact"
+	MatchTypeGlob  = "glob"
+	MatchTypeRegex = "regex"
+
+	MetricTypeGauge   = "gauge"
+	MetricTypeCounter = "counter"
+	MetricTypeUntyped = "untyped"
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	jobLabelNames = []string{"bosh_deployment", "bosh_job_name", "bosh_job_id", "bosh_job_index"}
+)
+
+type MetricMapping struct {
+	Match     string            `yaml:"match"`
+	MatchType string            `yaml:"match_type,omitempty"`
+	Name      string            `yaml:"name"`
+	Help      string            `yaml:"help,omitempty"`
+	Type      string            `yaml:"type,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+type MetricMappingsConfig struct {
+	Mappings []MetricMapping `yaml:"mappings,omitempty"`
+	Tags     []TagMapping    `yaml:"tags,omitempty"`
+}
+
+func DefaultMetricMappings() []MetricMapping {
+	return []MetricMapping{
+		{Match: "system.healthy", Name: "job_healthy", Help: "BOSH Job Healthy (1 for healthy, 0 for unhealthy)."},
+		{Match: "system.load.1m", Name: "job_load_avg01", Help: "BOSH Job Load avg01."},
+		{Match: "system.cpu.sys", Name: "job_cpu_sys", Help: "BOSH Job CPU System."},
+		{Match: "system.cpu.user", Name: "job_cpu_user", Help: "BOSH Job CPU User."},
+		{Match: "system.cpu.wait", Name: "job_cpu_wait", Help: "BOSH Job CPU Wait."},
+		{Match: "system.mem.kb", Name: "job_mem_kb", Help: "BOSH Job Memory KB."},
+		{Match: "system.mem.percent", Name: "job_mem_percent", Help: "BOSH Job Memory Percent."},
+		{Match: "system.swap.kb", Name: "job_swap_kb", Help: "BOSH Job Swap KB."},
+		{Match: "system.swap.percent", Name: "job_swap_percent", Help: "BOSH Job Swap Percent."},
+		{Match: "system.disk.system.inode_percent", Name: "job_system_disk_inode_percent", Help: "BOSH Job System Disk Inode Percent."},
+		{Match: "system.disk.system.percent", Name: "job_system_disk_percent", Help: "BOSH Job System Disk Percent."},
+		{Match: "system.disk.ephemeral.inode_percent", Name: "job_ephemeral_disk_inode_percent", Help: "BOSH Job Ephemeral Disk Inode Percent."},
+		{Match: "system.disk.ephemeral.percent", Name: "job_ephemeral_disk_percent", Help: "BOSH Job Ephemeral Disk Percent."},
+		{Match: "system.disk.persistent.inode_percent", Name: "job_persistent_disk_inode_percent", Help: "BOSH Job Persistent Disk Inode Percent."},
+		{Match: "system.disk.persistent.percent", Name: "job_persistent_disk_percent", Help: "BOSH Job Persistent Disk Percent."},
+	}
+}
+
+// LoadMetricMappingsFile reads a YAML (or JSON) mapping file.
+func LoadMetricMappingsFile(path string) (MetricMappingsConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return MetricMappingsConfig{}, err
+	}
+
+	return ParseMetricMappings(content)
+}
+
+func ParseMetricMappings(content []byte) (MetricMappingsConfig, error) {
+	config := MetricMappingsConfig{}
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return config, fmt.Errorf("Error parsing metric mappings: %v", err)
+	}
+
+	if len(config.Mappings) == 0 {
+		config.Mappings = DefaultMetricMappings()
+	}
+
+	return config, nil
+}
+
+type metricMatcher struct {
+	mapping MetricMapping
+	regex   *regexp.Regexp
+}
+
+type MetricMapper struct {
+	matchers    []metricMatcher
+	tagMappings map[string]TagMapping
+	tagLabels   []TagMapping
+}
+
+func NewMetricMapper(mappings []MetricMapping, tagMappings []TagMapping) (*MetricMapper, error) {
+	mapper := &MetricMapper{tagMappings: map[string]TagMapping{}}
+	byName := map[string]MetricMapping{}
+	tagLabelNames := map[string]bool{}
+
+	for i, tagMapping := range tagMappings {
+		if err := tagMapping.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid tag mapping #%d: %v", i+1, err)
+		}
+		if _, ok := mapper.tagMappings[tagMapping.Tag]; ok {
+			return nil, fmt.Errorf("Invalid tag mapping #%d: tag `%s` is already mapped", i+1, tagMapping.Tag)
+		}
+		mapper.tagMappings[tagMapping.Tag] = tagMapping
+
+		if tagMapping.Drop {
+			continue
+		}
+		if tagLabelNames[tagMapping.LabelName()] {
+			return nil, fmt.Errorf("Invalid tag mapping #%d: label `%s` is already mapped", i+1, tagMapping.LabelName())
+		}
+		tagLabelNames[tagMapping.LabelName()] = true
+		mapper.tagLabels = append(mapper.tagLabels, tagMapping)
+	}
+
+	for i, mapping := range mappings {
+		if mapping.MatchType == "" {
+			mapping.MatchType = MatchTypeExact
+		}
+		if mapping.Type == "" {
+			mapping.Type = MetricTypeGauge
+		}
+		if mapping.Help == "" {
+			mapping.Help = fmt.Sprintf("BOSH HM TSDB metric %s.", mapping.Name)
+		}
+
+		if err := mapping.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid metric mapping #%d: %v", i+1, err)
+		}
+		for labelName := range mapping.Labels {
+			if tagLabelNames[labelName] {
+				return nil, fmt.Errorf("Invalid metric mapping #%d: label `%s` is already mapped from a tag", i+1, labelName)
+			}
+		}
+
+		if previous, ok := byName[mapping.Name]; ok {
+			if previous.Help != mapping.Help || previous.Type != mapping.Type || !equalStrings(previous.LabelNames(), mapping.LabelNames()) {
+				return nil, fmt.Errorf("Invalid metric mapping #%d: metric `%s` is already mapped with a different help, type or labels", i+1, mapping.Name)
+			}
+		} else {
+			byName[mapping.Name] = mapping
+		}
+
+		matcher := metricMatcher{mapping: mapping}
+		switch mapping.MatchType {
+		case MatchTypeGlob:
+			matcher.regex = globToRegexp(mapping.Match)
+		case MatchTypeRegex:
+			regex, err := regexp.Compile("^(?:" + mapping.Match + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("Invalid metric mapping #%d: %v", i+1, err)
+			}
+			matcher.regex = regex
+		}
+		mapper.matchers = append(mapper.matchers, matcher)
+	}
+
+	return mapper, nil
+}
+
+// Mappings returns the mappings (with defaults filled in) in the order they
+// are evaluated.
+func (m *MetricMapper) Mappings() []MetricMapping {
+	mappings := make([]MetricMapping, len(m.matchers))
+	for i, matcher := range m.matchers {
+		mappings[i] = matcher.mapping
+	}
+
+	return mappings
+}
+
+// Map returns the first mapping matching a TSDB metric name, together with the
+// values of its extra labels (in LabelNames order).
+func (m *MetricMapper) Map(name string) (MetricMapping, []string, bool) {
+	for _, matcher := range m.matchers {
+		mapping := matcher.mapping
+		labelNames := mapping.LabelNames()
+		labelValues := make([]string, len(labelNames))
+
+		if matcher.regex == nil {
+			if name != mapping.Match {
+				continue
+			}
+			for i, labelName := range labelNames {
+				labelValues[i] = mapping.Labels[labelName]
+			}
+			return mapping, labelValues, true
+		}
+
+		submatches := matcher.regex.FindStringSubmatchIndex(name)
+		if submatches == nil {
+			continue
+		}
+		for i, labelName := range labelNames {
+			labelValues[i] = string(matcher.regex.ExpandString(nil, mapping.Labels[labelName], name, submatches))
+		}
+		return mapping, labelValues, true
+	}
+
+	return MetricMapping{}, nil, false
+}
+
+// TagLabelNames returns the names of the labels mapped from tags, in the order
+// of the tag mappings.
+func (m *MetricMapper) TagLabelNames() []string {
+	labelNames := make([]string, len(m.tagLabels))
+	for i, tagMapping := range m.tagLabels {
+		labelNames[i] = tagMapping.LabelName()
+	}
+
+	return labelNames
+}
+
+// TagLabelValues returns the values of the labels mapped from tags (in
+// TagLabelNames order), using the mapping defaults for missing tags.
+func (m *MetricMapper) TagLabelValues(tags map[string]string) []string {
+	labelValues := make([]string, len(m.tagLabels))
+	for i, tagMapping := range m.tagLabels {
+		value, ok := tags[tagMapping.Tag]
+		if !ok {
+			value = tagMapping.Default
+		}
+		labelValues[i] = value
+	}
+
+	return labelValues
+}
+
+// LabelNames returns the sorted names of the extra labels of a mapping.
+func (m MetricMapping) LabelNames() []string {
+	labelNames := make([]string, 0, len(m.Labels))
+	for labelName := range m.Labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+
+	return labelNames
+}
+
+func (m MetricMapping) ValueType() prometheus.ValueType {
+	switch m.Type {
+	case MetricTypeCounter:
+		return prometheus.CounterValue
+	case MetricTypeUntyped:
+		return prometheus.UntypedValue
+	}
+
+	return prometheus.GaugeValue
+}
+
+func (m MetricMapping) validate() error {
+	if m.Match == "" {
+		return errors.New("`match` is required")
+	}
+
+	switch m.MatchType {
+	case MatchTypeExact, MatchTypeGlob, MatchTypeRegex:
+	default:
+		return fmt.Errorf("unknown match_type `%s`", m.MatchType)
+	}
+
+	if !metricNameRE.MatchString(m.Name) {
+		return fmt.Errorf("`%s` is not a valid metric name", m.Name)
+	}
+
+	switch m.Type {
+	case MetricTypeGauge, MetricTypeCounter, MetricTypeUntyped:
+	default:
+		return fmt.Errorf("unknown type `%s`", m.Type)
+	}
+
+	for labelName := range m.Labels {
+		if !labelNameRE.MatchString(labelName) || strings.HasPrefix(labelName, "__") {
+			return fmt.Errorf("`%s` is not a valid label name", labelName)
+		}
+		if labelName == "environment" || containsString(jobLabelNames, labelName) {
+			return fmt.Errorf("label `%s` is reserved", labelName)
+		}
+	}
+
+	return nil
+}
+
+func globToRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+
+	return regexp.MustCompile("^" + strings.Join(parts, "([^.]*)") + "$")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func concatStrings(lists ...[]string) []string {
+	result := []string{}
+	for _, list := range lists {
+		result = append(result, list...)
+	}
+
+	return result
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
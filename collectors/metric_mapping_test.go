@@ -0,0 +1,267 @@
+package collectors_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+)
+
+var _ = Describe("MetricMapping", func() {
+	Describe("DefaultMetricMappings", func() {
+		It("returns a valid mapping for each supported BOSH HM TSDB metric", func() {
+			metricMapper, err := NewMetricMapper(DefaultMetricMappings(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metricMapper.Mappings()).To(HaveLen(15))
+
+			mapping, labelValues, ok := metricMapper.Map("system.healthy")
+			Expect(ok).To(BeTrue())
+			Expect(mapping.Name).To(Equal("job_healthy"))
+			Expect(mapping.ValueType()).To(Equal(prometheus.GaugeValue))
+			Expect(labelValues).To(BeEmpty())
+		})
+	})
+
+	Describe("ParseMetricMappings", func() {
+		It("parses YAML mappings", func() {
+			config, err := ParseMetricMappings([]byte(`
+mappings:
+- match: system.cpu.*
+  match_type: glob
+  name: job_cpu
+  type: gauge
+  labels:
+    mode: $1
+tags:
+- tag: agent_id
+  label: bosh_agent_id
+- tag: role
+  default: unknown
+- tag: noisy
+  drop: true
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.Mappings).To(Equal([]MetricMapping{
+				{
+					Match:     "system.cpu.*",
+					MatchType: MatchTypeGlob,
+					Name:      "job_cpu",
+					Type:      MetricTypeGauge,
+					Labels:    map[string]string{"mode": "$1"},
+				},
+			}))
+			Expect(config.Tags).To(Equal([]TagMapping{
+				{Tag: "agent_id", Label: "bosh_agent_id"},
+				{Tag: "role", Default: "unknown"},
+				{Tag: "noisy", Drop: true},
+			}))
+		})
+
+		It("parses JSON mappings", func() {
+			config, err := ParseMetricMappings([]byte(`{"mappings": [{"match": "system.healthy", "name": "job_healthy"}]}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.Mappings).To(Equal([]MetricMapping{{Match: "system.healthy", Name: "job_healthy"}}))
+		})
+
+		It("returns an error when there are unknown fields", func() {
+			_, err := ParseMetricMappings([]byte(`{"mappings": [{"match": "system.healthy", "metric": "job_healthy"}]}`))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("uses the default mappings when there are no mappings", func() {
+			config, err := ParseMetricMappings([]byte(`tags: [{"tag": "agent_id"}]`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.Mappings).To(Equal(DefaultMetricMappings()))
+			Expect(config.Tags).To(Equal([]TagMapping{{Tag: "agent_id"}}))
+		})
+	})
+
+	Describe("LoadMetricMappingsFile", func() {
+		var (
+			mappingFile *os.File
+		)
+
+		BeforeEach(func() {
+			var err error
+			mappingFile, err = ioutil.TempFile("", "metric_mappings")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = mappingFile.WriteString("mappings:\n- match: system.healthy\n  name: job_healthy\n")
+			Expect(err).ToNot(HaveOccurred())
+			mappingFile.Close()
+		})
+
+		AfterEach(func() {
+			os.Remove(mappingFile.Name())
+		})
+
+		It("loads the mappings from the file", func() {
+			config, err := LoadMetricMappingsFile(mappingFile.Name())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.Mappings).To(Equal([]MetricMapping{{Match: "system.healthy", Name: "job_healthy"}}))
+		})
+
+		It("returns an error when the file does not exist", func() {
+			_, err := LoadMetricMappingsFile(mappingFile.Name() + ".missing")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("NewMetricMapper", func() {
+		It("fills in the mapping defaults", func() {
+			metricMapper, err := NewMetricMapper([]MetricMapping{{Match: "system.healthy", Name: "job_healthy"}}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metricMapper.Mappings()).To(Equal([]MetricMapping{
+				{
+					Match:     "system.healthy",
+					MatchType: MatchTypeExact,
+					Name:      "job_healthy",
+					Help:      "BOSH HM TSDB metric job_healthy.",
+					Type:      MetricTypeGauge,
+				},
+			}))
+		})
+
+		It("returns an error when the metric name is not valid", func() {
+			_, err := NewMetricMapper([]MetricMapping{{Match: "system.healthy", Name: "job.healthy"}}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a label name is not valid", func() {
+			_, err := NewMetricMapper([]MetricMapping{{Match: "system.healthy", Name: "job_healthy", Labels: map[string]string{"fake-label": "1"}}}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a label name is reserved", func() {
+			_, err := NewMetricMapper([]MetricMapping{{Match: "system.healthy", Name: "job_healthy", Labels: map[string]string{"bosh_job_name": "1"}}}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the type is unknown", func() {
+			_, err := NewMetricMapper([]MetricMapping{{Match: "system.healthy", Name: "job_healthy", Type: "histogram"}}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the regex is not valid", func() {
+			_, err := NewMetricMapper([]MetricMapping{{Match: "system.(", MatchType: MatchTypeRegex, Name: "job_healthy"}}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a tag label name is not valid", func() {
+			_, err := NewMetricMapper(DefaultMetricMappings(), []TagMapping{{Tag: "agent-id"}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a tag label name is reserved", func() {
+			_, err := NewMetricMapper(DefaultMetricMappings(), []TagMapping{{Tag: "agent_id", Label: "environment"}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a BOSH job tag is mapped", func() {
+			_, err := NewMetricMapper(DefaultMetricMappings(), []TagMapping{{Tag: "deployment", Label: "deployment"}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when two tags are mapped to the same label", func() {
+			_, err := NewMetricMapper(DefaultMetricMappings(), []TagMapping{{Tag: "agent_id"}, {Tag: "agent-id", Label: "agent_id"}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a dropped tag has a label", func() {
+			_, err := NewMetricMapper(DefaultMetricMappings(), []TagMapping{{Tag: "agent_id", Label: "agent", Drop: true}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when a mapping label is also mapped from a tag", func() {
+			_, err := NewMetricMapper(
+				[]MetricMapping{{Match: "system.healthy", Name: "job_healthy", Labels: map[string]string{"role": "fake"}}},
+				[]TagMapping{{Tag: "role"}},
+			)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the same metric is mapped with different labels", func() {
+			_, err := NewMetricMapper([]MetricMapping{
+				{Match: "system.disk.system.percent", Name: "job_disk_percent", Labels: map[string]string{"disk": "system"}},
+				{Match: "system.disk.ephemeral.percent", Name: "job_disk_percent"},
+			}, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("TagLabelNames and TagLabelValues", func() {
+		var (
+			metricMapper *MetricMapper
+		)
+
+		BeforeEach(func() {
+			var err error
+			metricMapper, err = NewMetricMapper(DefaultMetricMappings(), []TagMapping{
+				{Tag: "agent_id", Label: "bosh_agent_id"},
+				{Tag: "noisy", Drop: true},
+				{Tag: "role", Default: "unknown"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the mapped label names in order", func() {
+			Expect(metricMapper.TagLabelNames()).To(Equal([]string{"bosh_agent_id", "role"}))
+		})
+
+		It("returns the tag values or their defaults", func() {
+			Expect(metricMapper.TagLabelValues(map[string]string{"agent_id": "fake-agent-id", "noisy": "1"})).To(Equal([]string{"fake-agent-id", "unknown"}))
+		})
+	})
+
+	Describe("Map", func() {
+		var (
+			metricMapper *MetricMapper
+		)
+
+		BeforeEach(func() {
+			var err error
+			metricMapper, err = NewMetricMapper([]MetricMapping{
+				{Match: "system.disk.system.percent", Name: "job_disk_percent", Labels: map[string]string{"disk": "system"}},
+				{Match: "system.disk.*.percent", MatchType: MatchTypeGlob, Name: "job_disk_percent", Labels: map[string]string{"disk": "$1"}},
+				{Match: `system\.load\.(?P<period>\d+)m`, MatchType: MatchTypeRegex, Name: "job_load", Type: MetricTypeUntyped, Labels: map[string]string{"period": "${period}m"}},
+			}, nil)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("maps exact matches", func() {
+			mapping, labelValues, ok := metricMapper.Map("system.disk.system.percent")
+			Expect(ok).To(BeTrue())
+			Expect(mapping.Name).To(Equal("job_disk_percent"))
+			Expect(labelValues).To(Equal([]string{"system"}))
+		})
+
+		It("maps glob matches", func() {
+			mapping, labelValues, ok := metricMapper.Map("system.disk.ephemeral.percent")
+			Expect(ok).To(BeTrue())
+			Expect(mapping.Name).To(Equal("job_disk_percent"))
+			Expect(labelValues).To(Equal([]string{"ephemeral"}))
+		})
+
+		It("does not match several segments with a glob", func() {
+			_, _, ok := metricMapper.Map("system.disk.ephemeral.inode.percent")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("maps regex matches", func() {
+			mapping, labelValues, ok := metricMapper.Map("system.load.15m")
+			Expect(ok).To(BeTrue())
+			Expect(mapping.Name).To(Equal("job_load"))
+			Expect(mapping.ValueType()).To(Equal(prometheus.UntypedValue))
+			Expect(labelValues).To(Equal([]string{"15m"}))
+		})
+
+		It("does not map unknown metrics", func() {
+			_, _, ok := metricMapper.Map("system.unknown")
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
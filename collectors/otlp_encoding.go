@@ -0,0 +1,75 @@
+package collectors
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/golang/protobuf/proto"
+)
+
+type otlpExportRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics" json:"resourceMetrics"`
+}
+
+func (m *otlpExportRequest) Reset()         { *m = otlpExportRequest{} }
+func (m *otlpExportRequest) String() string { return proto.CompactTextString(m) }
+func (*otlpExportRequest) ProtoMessage()    {}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `protobuf:"bytes,1,opt,name=resource" json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics" json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `protobuf:"bytes,1,rep,name=attributes" json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpScope    `protobuf:"bytes,1,opt,name=scope" json:"scope"`
+	Metrics []*otlpMetric `protobuf:"bytes,2,rep,name=metrics" json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `protobuf:"bytes,1,opt,name=name,proto3" json:"name"`
+	Version string `protobuf:"bytes,2,opt,name=version,proto3" json:"version"`
+}
+
+type otlpMetric struct {
+	Name  string     `protobuf:"bytes,1,opt,name=name,proto3" json:"name"`
+	Gauge *otlpGauge `protobuf:"bytes,5,opt,name=gauge" json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpDataPoint `protobuf:"bytes,1,rep,name=data_points" json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	TimeUnixNano uint64 `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3" json:"timeUnixNano,string"`
+	// AsDouble is a pointer for a zero value to still be encoded.
+	AsDouble   *otlpDouble     `protobuf:"fixed64,4,opt,name=as_double" json:"asDouble"`
+	Attributes []*otlpKeyValue `protobuf:"bytes,7,rep,name=attributes" json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string        `protobuf:"bytes,1,opt,name=key,proto3" json:"key"`
+	Value *otlpAnyValue `protobuf:"bytes,2,opt,name=value" json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,proto3" json:"stringValue"`
+}
+
+type otlpDouble float64
+
+func (d otlpDouble) MarshalJSON() ([]byte, error) {
+	switch value := float64(d); {
+	case math.IsNaN(value):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(value, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(value, -1):
+		return []byte(`"-Infinity"`), nil
+	default:
+		return json.Marshal(value)
+	}
+}
@@ -0,0 +1,331 @@
+package collectors
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+// OTLP resource attributes identifying the BOSH Job instance of a metric.
+const (
+	otlpEnvironmentAttribute   = "deployment.environment"
+	otlpDeploymentAttribute    = "bosh.deployment"
+	otlpJobAttribute           = "bosh.job"
+	otlpInstanceIDAttribute    = "bosh.instance.id"
+	otlpInstanceIndexAttribute = "bosh.instance.index"
+)
+
+const (
+	otlpEncodingProtobuf         = "protobuf"
+	otlpEncodingJSON             = "json"
+	otlpProtobufContentType      = "application/x-protobuf"
+	otlpJSONContentType          = "application/json"
+	otlpInstrumentationScopeName = "bosh_tsdb_exporter"
+)
+
+var otlpIdentityTags = map[string]bool{
+	"deployment": true,
+	"job":        true,
+	"index":      true,
+	"id":         true,
+}
+
+// OTLPConfig configures the OTLP/HTTP endpoint an OTLPExporter sends to.
+type OTLPConfig struct {
+	URL      string
+	Encoding string
+	Headers  map[string]string
+	Timeout  time.Duration
+}
+
+func (c OTLPConfig) encoding() string {
+	if c.Encoding != "" {
+		return c.Encoding
+	}
+
+	return otlpEncodingProtobuf
+}
+
+type otlpPendingMetric struct {
+	environment string
+	hmMetric    HMMetric
+}
+
+// OTLPExporter sends the BOSH HM metrics to an OpenTelemetry OTLP/HTTP
+// endpoint as gauges, with the BOSH Job instance identity as resource
+// attributes.
+type OTLPExporter struct {
+	config                              OTLPConfig
+	httpClient                          *http.Client
+	mutex                               sync.Mutex
+	pending                             map[string]otlpPendingMetric
+	totalOTLPExportedDataPointsMetric   prometheus.Counter
+	totalOTLPFailedDataPointsMetric     prometheus.Counter
+	lastOTLPExportTimestampMetric       prometheus.Gauge
+	lastOTLPExportDurationSecondsMetric prometheus.Gauge
+}
+
+// NewOTLPExporter returns an OTLPExporter sending to the `config` endpoint.
+func NewOTLPExporter(
+	namespace string,
+	environment string,
+	config OTLPConfig,
+) (*OTLPExporter, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP URL `%s`: %v", config.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid OTLP URL `%s`: scheme must be http or https", config.URL)
+	}
+	if config.encoding() != otlpEncodingProtobuf && config.encoding() != otlpEncodingJSON {
+		return nil, fmt.Errorf("invalid OTLP encoding `%s`: must be %s or %s", config.Encoding, otlpEncodingProtobuf, otlpEncodingJSON)
+	}
+
+	totalOTLPExportedDataPointsMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "otlp_exported_data_points_total",
+			Help:      "Total number of data points sent to the OTLP endpoint.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalOTLPFailedDataPointsMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "otlp_failed_data_points_total",
+			Help:      "Total number of data points dropped because the OTLP request failed.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastOTLPExportTimestampMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_otlp_export_timestamp",
+			Help:      "Number of seconds since 1970 since last successful OTLP request.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastOTLPExportDurationSecondsMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_otlp_export_duration_seconds",
+			Help:      "Duration of the last successful OTLP request.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	return &OTLPExporter{
+		config:                              config,
+		httpClient:                          &http.Client{Timeout: config.Timeout},
+		pending:                             map[string]otlpPendingMetric{},
+		totalOTLPExportedDataPointsMetric:   totalOTLPExportedDataPointsMetric,
+		totalOTLPFailedDataPointsMetric:     totalOTLPFailedDataPointsMetric,
+		lastOTLPExportTimestampMetric:       lastOTLPExportTimestampMetric,
+		lastOTLPExportDurationSecondsMetric: lastOTLPExportDurationSecondsMetric,
+	}, nil
+}
+
+func (e *OTLPExporter) SinkName() string {
+	return "otlp"
+}
+
+// Consume records a BOSH HM metric to be sent on the next push, replacing the
+// previous value of its series.
+func (e *OTLPExporter) Consume(environment string, hmMetric HMMetric) {
+	key := strings.Join([]string{environment, hmMetric.Deployment, hmMetric.Job, hmMetric.Id, hmMetric.Index, hmMetric.Name}, "\xff")
+	for _, attribute := range otlpDataPointAttributes(hmMetric) {
+		key += "\xff" + attribute.Key + "=" + attribute.Value.StringValue
+	}
+
+	e.mutex.Lock()
+	e.pending[key] = otlpPendingMetric{environment: environment, hmMetric: hmMetric}
+	e.mutex.Unlock()
+}
+
+// Push sends the metrics recorded since the previous push, they are dropped
+// when the request fails.
+func (e *OTLPExporter) Push() error {
+	e.mutex.Lock()
+	pending := e.pending
+	e.pending = map[string]otlpPendingMetric{}
+	e.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	request := otlpRequest(pending)
+
+	var body []byte
+	contentType := otlpProtobufContentType
+	if e.config.encoding() == otlpEncodingJSON {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			e.totalOTLPFailedDataPointsMetric.Add(float64(len(pending)))
+			return err
+		}
+		contentType = otlpJSONContentType
+	} else {
+		var err error
+		if body, err = proto.Marshal(request); err != nil {
+			e.totalOTLPFailedDataPointsMetric.Add(float64(len(pending)))
+			return err
+		}
+	}
+
+	begun := time.Now()
+	if err := e.send(body, contentType); err != nil {
+		e.totalOTLPFailedDataPointsMetric.Add(float64(len(pending)))
+		return err
+	}
+
+	e.totalOTLPExportedDataPointsMetric.Add(float64(len(pending)))
+	e.lastOTLPExportTimestampMetric.Set(float64(time.Now().Unix()))
+	e.lastOTLPExportDurationSecondsMetric.Set(time.Since(begun).Seconds())
+
+	return nil
+}
+
+func (e *OTLPExporter) PushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := e.Push(); err != nil {
+			log.Errorf("Error pushing metrics to `%s`: %v", e.config.URL, err)
+		}
+		<-ticker.C
+	}
+}
+
+func (e *OTLPExporter) Collect(ch chan<- prometheus.Metric) {
+	e.totalOTLPExportedDataPointsMetric.Collect(ch)
+	e.totalOTLPFailedDataPointsMetric.Collect(ch)
+	e.lastOTLPExportTimestampMetric.Collect(ch)
+	e.lastOTLPExportDurationSecondsMetric.Collect(ch)
+}
+
+func (e *OTLPExporter) Describe(ch chan<- *prometheus.Desc) {
+	e.totalOTLPExportedDataPointsMetric.Describe(ch)
+	e.totalOTLPFailedDataPointsMetric.Describe(ch)
+	e.lastOTLPExportTimestampMetric.Describe(ch)
+	e.lastOTLPExportDurationSecondsMetric.Describe(ch)
+}
+
+func (e *OTLPExporter) send(body []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPost, e.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "bosh_tsdb_exporter/"+version.Version)
+	for name, value := range e.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+func otlpRequest(pending map[string]otlpPendingMetric) *otlpExportRequest {
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	request := &otlpExportRequest{ResourceMetrics: []*otlpResourceMetrics{}}
+	var resourceKey, metricName string
+	for _, key := range keys {
+		environment, hmMetric := pending[key].environment, pending[key].hmMetric
+
+		if key := strings.Join([]string{environment, hmMetric.Deployment, hmMetric.Job, hmMetric.Id, hmMetric.Index}, "\xff"); len(request.ResourceMetrics) == 0 || key != resourceKey {
+			resourceKey, metricName = key, ""
+			request.ResourceMetrics = append(request.ResourceMetrics, &otlpResourceMetrics{
+				Resource: &otlpResource{
+					Attributes: []*otlpKeyValue{
+						otlpAttribute(otlpEnvironmentAttribute, environment),
+						otlpAttribute(otlpDeploymentAttribute, hmMetric.Deployment),
+						otlpAttribute(otlpJobAttribute, hmMetric.Job),
+						otlpAttribute(otlpInstanceIDAttribute, hmMetric.Id),
+						otlpAttribute(otlpInstanceIndexAttribute, hmMetric.Index),
+					},
+				},
+				ScopeMetrics: []*otlpScopeMetrics{{
+					Scope: &otlpScope{Name: otlpInstrumentationScopeName, Version: version.Version},
+				}},
+			})
+		}
+
+		scopeMetrics := request.ResourceMetrics[len(request.ResourceMetrics)-1].ScopeMetrics[0]
+		if len(scopeMetrics.Metrics) == 0 || hmMetric.Name != metricName {
+			metricName = hmMetric.Name
+			scopeMetrics.Metrics = append(scopeMetrics.Metrics, &otlpMetric{Name: hmMetric.Name, Gauge: &otlpGauge{}})
+		}
+
+		value := otlpDouble(hmMetric.Value)
+		gauge := scopeMetrics.Metrics[len(scopeMetrics.Metrics)-1].Gauge
+		gauge.DataPoints = append(gauge.DataPoints, &otlpDataPoint{
+			Attributes:   otlpDataPointAttributes(hmMetric),
+			TimeUnixNano: uint64(hmMetric.Timestamp.UnixNano()),
+			AsDouble:     &value,
+		})
+	}
+
+	return request
+}
+
+func otlpDataPointAttributes(hmMetric HMMetric) []*otlpKeyValue {
+	attributes := []*otlpKeyValue{}
+	for key, value := range hmMetric.Tags {
+		if !otlpIdentityTags[key] {
+			attributes = append(attributes, otlpAttribute(key, value))
+		}
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Key < attributes[j].Key })
+
+	return attributes
+}
+
+func otlpAttribute(key string, value string) *otlpKeyValue {
+	return &otlpKeyValue{Key: key, Value: &otlpAnyValue{StringValue: value}}
+}
@@ -0,0 +1,465 @@
+package collectors_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+type otlpTestDataPoint struct {
+	resource   map[string]string
+	scope      string
+	name       string
+	attributes map[string]string
+	time       uint64
+	value      float64
+}
+
+// The OTLP `ExportMetricsServiceRequest` protobuf messages, limited to gauges
+// of string attributes.
+type otlpTestExportRequest struct {
+	ResourceMetrics []*struct {
+		Resource *struct {
+			Attributes []*otlpTestKeyValue `protobuf:"bytes,1,rep,name=attributes"`
+		} `protobuf:"bytes,1,opt,name=resource"`
+		ScopeMetrics []*struct {
+			Scope *struct {
+				Name string `protobuf:"bytes,1,opt,name=name,proto3"`
+			} `protobuf:"bytes,1,opt,name=scope"`
+			Metrics []*struct {
+				Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+				Gauge *struct {
+					DataPoints []*struct {
+						TimeUnixNano uint64              `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+						AsDouble     float64             `protobuf:"fixed64,4,opt,name=as_double,proto3"`
+						Attributes   []*otlpTestKeyValue `protobuf:"bytes,7,rep,name=attributes"`
+					} `protobuf:"bytes,1,rep,name=data_points"`
+				} `protobuf:"bytes,5,opt,name=gauge"`
+			} `protobuf:"bytes,2,rep,name=metrics"`
+		} `protobuf:"bytes,2,rep,name=scope_metrics"`
+	} `protobuf:"bytes,1,rep,name=resource_metrics"`
+}
+
+func (m *otlpTestExportRequest) Reset()         { *m = otlpTestExportRequest{} }
+func (m *otlpTestExportRequest) String() string { return proto.CompactTextString(m) }
+func (*otlpTestExportRequest) ProtoMessage()    {}
+
+type otlpTestKeyValue struct {
+	Key   string `protobuf:"bytes,1,opt,name=key,proto3"`
+	Value *struct {
+		StringValue string `protobuf:"bytes,1,opt,name=string_value,proto3"`
+	} `protobuf:"bytes,2,opt,name=value"`
+}
+
+func otlpTestAttributes(keyValues []*otlpTestKeyValue) map[string]string {
+	attributes := map[string]string{}
+	for _, keyValue := range keyValues {
+		attributes[keyValue.Key] = keyValue.Value.StringValue
+	}
+	return attributes
+}
+
+// decodeOTLPProtobufRequest flattens an OTLP `ExportMetricsServiceRequest`
+// protobuf message made of gauges into its data points.
+func decodeOTLPProtobufRequest(body []byte) ([]otlpTestDataPoint, error) {
+	request := &otlpTestExportRequest{}
+	if err := proto.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	dataPoints := []otlpTestDataPoint{}
+	for _, resourceMetrics := range request.ResourceMetrics {
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			for _, metric := range scopeMetrics.Metrics {
+				for _, dataPoint := range metric.Gauge.DataPoints {
+					dataPoints = append(dataPoints, otlpTestDataPoint{
+						resource:   otlpTestAttributes(resourceMetrics.Resource.Attributes),
+						scope:      scopeMetrics.Scope.Name,
+						name:       metric.Name,
+						attributes: otlpTestAttributes(dataPoint.Attributes),
+						time:       dataPoint.TimeUnixNano,
+						value:      dataPoint.AsDouble,
+					})
+				}
+			}
+		}
+	}
+
+	return dataPoints, nil
+}
+
+// otlpTestGoldenProtobufRequest is the wire encoding of an upstream
+// `ExportMetricsServiceRequest` holding a single gauge data point. Each tag is
+// annotated with its field number in opentelemetry-proto.
+const otlpTestGoldenProtobufRequest = "" +
+	"\x0a\x86\x02" + // ExportMetricsServiceRequest.resource_metrics = 1
+	"\x0a\xa9\x01" + // ResourceMetrics.resource = 1
+	"\x0a\x2c" + // Resource.attributes = 1
+	"\x0a\x16" + "deployment.environment" + // KeyValue.key = 1
+	"\x12\x12" + "\x0a\x10" + "test_environment" + // KeyValue.value = 2, AnyValue.string_value = 1
+	"\x0a\x24" +
+	"\x0a\x0f" + "bosh.deployment" +
+	"\x12\x11" + "\x0a\x0f" + "fake-deployment" +
+	"\x0a\x16" +
+	"\x0a\x08" + "bosh.job" +
+	"\x12\x0a" + "\x0a\x08" + "fake-job" +
+	"\x0a\x1f" +
+	"\x0a\x10" + "bosh.instance.id" +
+	"\x12\x0b" + "\x0a\x09" + "fake-id-1" +
+	"\x0a\x1a" +
+	"\x0a\x13" + "bosh.instance.index" +
+	"\x12\x03" + "\x0a\x01" + "0" +
+	"\x12\x58" + // ResourceMetrics.scope_metrics = 2
+	"\x0a\x14" + // ScopeMetrics.scope = 1
+	"\x0a\x12" + "bosh_tsdb_exporter" + // InstrumentationScope.name = 1
+	"\x12\x40" + // ScopeMetrics.metrics = 2
+	"\x0a\x1a" + "system.disk.system.percent" + // Metric.name = 1
+	"\x2a\x22" + // Metric.gauge = 5
+	"\x0a\x20" + // Gauge.data_points = 1
+	"\x19" + "\x00\x00\xd7\xea\xff\x98\xf4\x14" + // NumberDataPoint.time_unix_nano = 3, fixed64
+	"\x21" + "\x00\x00\x00\x00\x00\x00\x24\x40" + // NumberDataPoint.as_double = 4, fixed64
+	"\x3a\x0c" + // NumberDataPoint.attributes = 7
+	"\x0a\x05" + "mount" +
+	"\x12\x03" + "\x0a\x01" + "/"
+
+type otlpTestJSONKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// decodeOTLPJSONRequest flattens an OTLP/HTTP JSON request made of gauges
+// into its data points.
+func decodeOTLPJSONRequest(body []byte) ([]otlpTestDataPoint, error) {
+	var request struct {
+		ResourceMetrics []struct {
+			Resource struct {
+				Attributes []otlpTestJSONKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeMetrics []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				Metrics []struct {
+					Name  string `json:"name"`
+					Gauge struct {
+						DataPoints []struct {
+							Attributes   []otlpTestJSONKeyValue `json:"attributes"`
+							TimeUnixNano string                 `json:"timeUnixNano"`
+							AsDouble     float64                `json:"asDouble"`
+						} `json:"dataPoints"`
+					} `json:"gauge"`
+				} `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+
+	attributesMap := func(keyValues []otlpTestJSONKeyValue) map[string]string {
+		attributes := map[string]string{}
+		for _, keyValue := range keyValues {
+			attributes[keyValue.Key] = keyValue.Value.StringValue
+		}
+		return attributes
+	}
+
+	dataPoints := []otlpTestDataPoint{}
+	for _, resourceMetrics := range request.ResourceMetrics {
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			for _, metric := range scopeMetrics.Metrics {
+				for _, dataPoint := range metric.Gauge.DataPoints {
+					time, err := strconv.ParseUint(dataPoint.TimeUnixNano, 10, 64)
+					if err != nil {
+						return nil, err
+					}
+					dataPoints = append(dataPoints, otlpTestDataPoint{
+						resource:   attributesMap(resourceMetrics.Resource.Attributes),
+						scope:      scopeMetrics.Scope.Name,
+						name:       metric.Name,
+						attributes: attributesMap(dataPoint.Attributes),
+						time:       time,
+						value:      dataPoint.AsDouble,
+					})
+				}
+			}
+		}
+	}
+
+	return dataPoints, nil
+}
+
+// serveHTTPEndpoint starts a fake HTTP endpoint answering `status`,
+// returning the requests and bodies it receives.
+func serveHTTPEndpoint(status int) (*httptest.Server, chan *http.Request, chan []byte) {
+	requests := make(chan *http.Request, 100)
+	bodies := make(chan []byte, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		w.WriteHeader(status)
+	}))
+
+	return server, requests, bodies
+}
+
+var _ = Describe("OTLPExporter", func() {
+	var (
+		err          error
+		namespace    string
+		environment  string
+		config       OTLPConfig
+		status       int
+		server       *httptest.Server
+		requests     chan *http.Request
+		bodies       chan []byte
+		otlpExporter *OTLPExporter
+		timestamp    time.Time
+
+		totalOTLPExportedDataPointsMetric prometheus.Counter
+		totalOTLPFailedDataPointsMetric   prometheus.Counter
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		status = http.StatusOK
+		config = OTLPConfig{Timeout: time.Second}
+		timestamp = time.Unix(1510000000, 0)
+
+		totalOTLPExportedDataPointsMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "otlp_exported_data_points_total",
+				Help:      "Total number of data points sent to the OTLP endpoint.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalOTLPFailedDataPointsMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "otlp_failed_data_points_total",
+				Help:      "Total number of data points dropped because the OTLP request failed.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		server, requests, bodies = serveHTTPEndpoint(status)
+		config.URL = server.URL + "/v1/metrics"
+		otlpExporter, err = NewOTLPExporter(namespace, environment, config)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		otlpExporter.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	hmMetric := func(name string, value float64, id string, tags map[string]string) HMMetric {
+		hmMetric := HMMetric{
+			Name:       name,
+			Value:      value,
+			Deployment: "fake-deployment",
+			Job:        "fake-job",
+			Index:      "0",
+			Id:         id,
+			Tags: map[string]string{
+				"deployment": "fake-deployment",
+				"job":        "fake-job",
+				"index":      "0",
+				"id":         id,
+			},
+			Timestamp: timestamp,
+		}
+		for key, value := range tags {
+			hmMetric.Tags[key] = value
+		}
+		return hmMetric
+	}
+
+	exportMetrics := func() {
+		otlpExporter.Consume(environment, hmMetric("system.healthy", 1, "fake-id-1", nil))
+		otlpExporter.Consume(environment, hmMetric("system.disk.system.percent", 10, "fake-id-1", map[string]string{"mount": "/"}))
+		otlpExporter.Consume(environment, hmMetric("system.healthy", 0, "fake-id-2", nil))
+	}
+
+	expectedDataPoints := func() []otlpTestDataPoint {
+		resource := func(id string) map[string]string {
+			return map[string]string{
+				"deployment.environment": environment,
+				"bosh.deployment":        "fake-deployment",
+				"bosh.job":               "fake-job",
+				"bosh.instance.id":       id,
+				"bosh.instance.index":    "0",
+			}
+		}
+
+		return []otlpTestDataPoint{
+			{resource: resource("fake-id-1"), scope: "bosh_tsdb_exporter", name: "system.disk.system.percent", attributes: map[string]string{"mount": "/"}, time: 1510000000000000000, value: 10},
+			{resource: resource("fake-id-1"), scope: "bosh_tsdb_exporter", name: "system.healthy", attributes: map[string]string{}, time: 1510000000000000000, value: 1},
+			{resource: resource("fake-id-2"), scope: "bosh_tsdb_exporter", name: "system.healthy", attributes: map[string]string{}, time: 1510000000000000000, value: 0},
+		}
+	}
+
+	Describe("Describe", func() {
+		var descriptions chan *prometheus.Desc
+
+		JustBeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+			go otlpExporter.Describe(descriptions)
+		})
+
+		It("returns a otlp_exported_data_points_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalOTLPExportedDataPointsMetric.Desc())))
+		})
+
+		It("returns a otlp_failed_data_points_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalOTLPFailedDataPointsMetric.Desc())))
+		})
+	})
+
+	It("pushes the metrics as protobuf gauges with the BOSH identity as resource attributes", func() {
+		exportMetrics()
+		Expect(otlpExporter.Push()).To(Succeed())
+
+		var request *http.Request
+		Expect(requests).To(Receive(&request))
+		Expect(request.Method).To(Equal("POST"))
+		Expect(request.URL.Path).To(Equal("/v1/metrics"))
+		Expect(request.Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+
+		var body []byte
+		Expect(bodies).To(Receive(&body))
+		dataPoints, err := decodeOTLPProtobufRequest(body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dataPoints).To(Equal(expectedDataPoints()))
+
+		totalOTLPExportedDataPointsMetric.Add(3)
+		Expect(collect()).To(ContainElement(PrometheusMetric(totalOTLPExportedDataPointsMetric)))
+	})
+
+	It("encodes the data points with the OTLP protobuf field numbers", func() {
+		otlpExporter.Consume(environment, hmMetric("system.disk.system.percent", 10, "fake-id-1", map[string]string{"mount": "/"}))
+		Expect(otlpExporter.Push()).To(Succeed())
+		Expect(requests).To(Receive())
+
+		var body []byte
+		Expect(bodies).To(Receive(&body))
+		Expect(string(body)).To(Equal(otlpTestGoldenProtobufRequest))
+	})
+
+	It("only pushes the last value of every series received since the previous push", func() {
+		otlpExporter.Consume(environment, hmMetric("system.healthy", 0, "fake-id-1", nil))
+		otlpExporter.Consume(environment, hmMetric("system.healthy", 1, "fake-id-1", nil))
+		Expect(otlpExporter.Push()).To(Succeed())
+		Expect(requests).To(Receive())
+
+		var body []byte
+		Expect(bodies).To(Receive(&body))
+		dataPoints, err := decodeOTLPProtobufRequest(body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dataPoints).To(HaveLen(1))
+		Expect(dataPoints[0].value).To(Equal(1.0))
+
+		Expect(otlpExporter.Push()).To(Succeed())
+		Expect(requests).ToNot(Receive())
+	})
+
+	Context("when the encoding is json", func() {
+		BeforeEach(func() {
+			config.Encoding = "json"
+		})
+
+		It("pushes the metrics as json", func() {
+			exportMetrics()
+			Expect(otlpExporter.Push()).To(Succeed())
+
+			var request *http.Request
+			Expect(requests).To(Receive(&request))
+			Expect(request.Header.Get("Content-Type")).To(Equal("application/json"))
+
+			var body []byte
+			Expect(bodies).To(Receive(&body))
+			dataPoints, err := decodeOTLPJSONRequest(body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dataPoints).To(Equal(expectedDataPoints()))
+		})
+	})
+
+	Context("when there are headers", func() {
+		BeforeEach(func() {
+			config.Headers = map[string]string{"Authorization": "Bearer fake-token"}
+		})
+
+		It("sends them", func() {
+			exportMetrics()
+			Expect(otlpExporter.Push()).To(Succeed())
+
+			var request *http.Request
+			Expect(requests).To(Receive(&request))
+			Expect(request.Header.Get("Authorization")).To(Equal("Bearer fake-token"))
+		})
+	})
+
+	Context("when the endpoint fails", func() {
+		BeforeEach(func() {
+			status = http.StatusInternalServerError
+			totalOTLPFailedDataPointsMetric.Add(3)
+		})
+
+		It("returns an error and drops the data points", func() {
+			exportMetrics()
+			Expect(otlpExporter.Push()).ToNot(Succeed())
+			Expect(collect()).To(ContainElement(PrometheusMetric(totalOTLPFailedDataPointsMetric)))
+		})
+	})
+
+	Context("when the URL is not valid", func() {
+		It("returns an error", func() {
+			_, err := NewOTLPExporter(namespace, environment, OTLPConfig{URL: "fake-url"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the encoding is not valid", func() {
+		It("returns an error", func() {
+			_, err := NewOTLPExporter(namespace, environment, OTLPConfig{URL: server.URL, Encoding: "fake-encoding"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
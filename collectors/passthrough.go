@@ -0,0 +1,188 @@
+package collectors
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var invalidNameCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+var descFQNameRE = regexp.MustCompile(`^Desc{fqName: "([^"]*)"`)
+
+var jobTagLabelNames = map[string]string{
+	"deployment": "bosh_deployment",
+	"job":        "bosh_job_name",
+	"id":         "bosh_job_id",
+	"index":      "bosh_job_index",
+}
+
+// PassthroughFilter decides which BOSH HM TSDB metrics without a mapping are
+// exported as generic gauges instead of being discarded.
+type PassthroughFilter struct {
+	allow *regexp.Regexp
+	deny  *regexp.Regexp
+}
+
+// NewPassthroughFilter builds a filter from an allowlist and a denylist regular
+// expression, both matched against the whole BOSH HM TSDB metric name.
+func NewPassthroughFilter(allow string, deny string) (*PassthroughFilter, error) {
+	filter := &PassthroughFilter{}
+
+	allowRE, err := compileMetricNameRegexp(allow)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pass-through allow regex: %v", err)
+	}
+	filter.allow = allowRE
+
+	denyRE, err := compileMetricNameRegexp(deny)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pass-through deny regex: %v", err)
+	}
+	filter.deny = denyRE
+
+	return filter, nil
+}
+
+func compileMetricNameRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func (f *PassthroughFilter) Allowed(name string) bool {
+	if f.allow != nil && !f.allow.MatchString(name) {
+		return false
+	}
+
+	if f.deny != nil && f.deny.MatchString(name) {
+		return false
+	}
+
+	return true
+}
+
+// ReservedMetricNames is a prometheus.Registerer keeping the names of the
+// metrics described by the collectors it registers, so pass-through metrics
+// never collide with them.
+type ReservedMetricNames struct {
+	prometheus.Registerer
+	mutex sync.RWMutex
+	names map[string]bool
+}
+
+func NewReservedMetricNames(registerer prometheus.Registerer) *ReservedMetricNames {
+	return &ReservedMetricNames{
+		Registerer: registerer,
+		names:      map[string]bool{},
+	}
+}
+
+func (r *ReservedMetricNames) Register(collector prometheus.Collector) error {
+	if err := r.Registerer.Register(collector); err != nil {
+		return err
+	}
+
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		collector.Describe(descs)
+		close(descs)
+	}()
+
+	names := []string{}
+	for desc := range descs {
+		if match := descFQNameRE.FindStringSubmatch(desc.String()); match != nil {
+			names = append(names, match[1])
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, name := range names {
+		r.names[name] = true
+	}
+
+	return nil
+}
+
+func (r *ReservedMetricNames) MustRegister(collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		if err := r.Register(collector); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *ReservedMetricNames) reserved(name string) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.names[name]
+}
+
+func passthroughLabels(hmMetric HMMetric, metricMapper *MetricMapper) ([]string, []string, error) {
+	labelNames := append([]string{}, jobLabelNames...)
+	labelValues := []string{hmMetric.Deployment, hmMetric.Job, hmMetric.Id, hmMetric.Index}
+
+	tagLabels := map[string]string{}
+	for tag, value := range hmMetric.Tags {
+		if _, ok := jobTagLabelNames[tag]; ok {
+			continue
+		}
+		if _, ok := metricMapper.tagMappings[tag]; ok {
+			continue
+		}
+		labelName := sanitizeLabelName(tag)
+		if _, ok := tagLabels[labelName]; ok {
+			return nil, nil, fmt.Errorf("several tags are exported as label `%s`", labelName)
+		}
+		tagLabels[labelName] = value
+	}
+
+	tagLabelValues := metricMapper.TagLabelValues(hmMetric.Tags)
+	for i, labelName := range metricMapper.TagLabelNames() {
+		if _, ok := tagLabels[labelName]; ok {
+			return nil, nil, fmt.Errorf("several tags are exported as label `%s`", labelName)
+		}
+		tagLabels[labelName] = tagLabelValues[i]
+	}
+
+	tagLabelNames := make([]string, 0, len(tagLabels))
+	for labelName := range tagLabels {
+		tagLabelNames = append(tagLabelNames, labelName)
+	}
+	sort.Strings(tagLabelNames)
+
+	for _, labelName := range tagLabelNames {
+		labelNames = append(labelNames, labelName)
+		labelValues = append(labelValues, tagLabels[labelName])
+	}
+
+	return labelNames, labelValues, nil
+}
+
+func sanitizeMetricName(name string) string {
+	return invalidNameCharRE.ReplaceAllString(name, "_")
+}
+
+func sanitizeLabelName(name string) string {
+	labelName := invalidNameCharRE.ReplaceAllString(name, "_")
+	if labelName == "" || (labelName[0] >= '0' && labelName[0] <= '9') {
+		labelName = "_" + labelName
+	}
+
+	if strings.HasPrefix(labelName, "__") || labelName == "environment" || containsString(jobLabelNames, labelName) {
+		labelName = "tag_" + strings.TrimLeft(labelName, "_")
+	}
+
+	return labelName
+}
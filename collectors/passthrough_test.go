@@ -0,0 +1,109 @@
+package collectors_test
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+)
+
+var _ = Describe("PassthroughFilter", func() {
+	Describe("NewPassthroughFilter", func() {
+		It("returns an error when the allow regex is not valid", func() {
+			_, err := NewPassthroughFilter("system.(", "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the deny regex is not valid", func() {
+			_, err := NewPassthroughFilter("", "system.(")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Allowed", func() {
+		It("allows every metric when there are no regexes", func() {
+			filter, err := NewPassthroughFilter("", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filter.Allowed("system.disk.foo.bar")).To(BeTrue())
+		})
+
+		It("only allows metrics matching the whole allow regex", func() {
+			filter, err := NewPassthroughFilter(`system\.disk\..*`, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filter.Allowed("system.disk.foo.bar")).To(BeTrue())
+			Expect(filter.Allowed("custom.system.disk.foo")).To(BeFalse())
+		})
+
+		It("denies metrics matching the deny regex", func() {
+			filter, err := NewPassthroughFilter(`system\..*`, `system\.disk\.foo\..*`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filter.Allowed("system.disk.foo.bar")).To(BeFalse())
+			Expect(filter.Allowed("system.disk.bar.foo")).To(BeTrue())
+		})
+	})
+})
+
+var _ = Describe("HMTSDBCollector in pass-through mode", func() {
+	var (
+		registry        *prometheus.Registry
+		tsdbListener    net.Listener
+		hmTSDBCollector *HMTSDBCollector
+		hmTSDBListener  *HMTSDBListener
+	)
+
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+		reservedMetricNames := NewReservedMetricNames(registry)
+
+		passthroughFilter, err := NewPassthroughFilter("", "")
+		Expect(err).ToNot(HaveOccurred())
+		hmMetricBus := NewHMMetricBus("test_exporter", "test_environment", 100)
+
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener("test_exporter", "test_environment", HMTSDBCollectorConfig{
+			PassthroughFilter:   passthroughFilter,
+			ReservedMetricNames: reservedMetricNames,
+		}, HMTSDBListenerConfig{})
+		reservedMetricNames.MustRegister(hmTSDBCollector, hmTSDBListener, hmMetricBus)
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	gatheredValue := func(name string) float64 {
+		metricFamilies, err := registry.Gather()
+		Expect(err).ToNot(HaveOccurred())
+		for _, metricFamily := range metricFamilies {
+			if metricFamily.GetName() == name {
+				metric := metricFamily.GetMetric()[0]
+				if metric.GetCounter() != nil {
+					return metric.GetCounter().GetValue()
+				}
+				return metric.GetGauge().GetValue()
+			}
+		}
+		return -1
+	}
+
+	It("discards the metrics colliding with the exporter metrics or labels", func() {
+		conn, err := net.Dial("tcp", tsdbListener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		tags := "deployment=fake-deployment job=fake-job index=0 id=fake-id"
+		fmt.Fprintf(conn, "put received.tsdb.messages.total %d 42 %s\n", time.Now().Unix(), tags)
+		fmt.Fprintf(conn, "put sink.consumed.metrics.total %d 42 %s\n", time.Now().Unix(), tags)
+		fmt.Fprintf(conn, "put system.disk.foo %d 42 %s a.b=1 a_b=2\n", time.Now().Unix(), tags)
+		fmt.Fprintf(conn, "put system.disk.foo.bar %d 42 %s\n", time.Now().Unix(), tags)
+
+		Eventually(func() float64 { return gatheredValue("test_exporter_system_disk_foo_bar") }).Should(Equal(float64(42)))
+		Expect(gatheredValue("test_exporter_discarded_tsdb_messages_total")).To(Equal(float64(3)))
+		Expect(gatheredValue("test_exporter_system_disk_foo")).To(Equal(float64(-1)))
+	})
+})
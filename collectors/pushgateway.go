@@ -0,0 +1,294 @@
+package collectors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	pushgatewayEnvironmentLabel = "environment"
+	pushgatewayDeploymentLabel  = "bosh_deployment"
+)
+
+type pushgatewayGroup struct {
+	grouping       map[string]string
+	metricFamilies []*dto.MetricFamily
+}
+
+func (g *pushgatewayGroup) Gather() ([]*dto.MetricFamily, error) {
+	return g.metricFamilies, nil
+}
+
+func (g *pushgatewayGroup) key() string {
+	key := ""
+	for _, labelName := range []string{pushgatewayEnvironmentLabel, pushgatewayDeploymentLabel} {
+		if labelValue, ok := g.grouping[labelName]; ok {
+			key += "/" + labelName + "/" + url.QueryEscape(labelValue)
+		}
+	}
+
+	return key
+}
+
+func pushgatewayGroups(metricFamilies []*dto.MetricFamily, defaultEnvironment string, groupByDeployment bool) map[string]*pushgatewayGroup {
+	groups := map[string]*pushgatewayGroup{}
+	for _, metricFamily := range metricFamilies {
+		groupMetricFamilies := map[string]*dto.MetricFamily{}
+		for _, metric := range metricFamily.Metric {
+			grouping := map[string]string{pushgatewayEnvironmentLabel: defaultEnvironment}
+			labels := []*dto.LabelPair{}
+			for _, label := range metric.Label {
+				switch {
+				case label.GetName() == pushgatewayEnvironmentLabel && label.GetValue() != "":
+					grouping[pushgatewayEnvironmentLabel] = label.GetValue()
+				case label.GetName() == pushgatewayDeploymentLabel && groupByDeployment && label.GetValue() != "":
+					grouping[pushgatewayDeploymentLabel] = label.GetValue()
+				default:
+					labels = append(labels, label)
+				}
+			}
+
+			group := &pushgatewayGroup{grouping: grouping}
+			key := group.key()
+			if existingGroup, ok := groups[key]; ok {
+				group = existingGroup
+			} else {
+				groups[key] = group
+			}
+
+			groupMetricFamily, ok := groupMetricFamilies[key]
+			if !ok {
+				groupMetricFamily = &dto.MetricFamily{
+					Name: metricFamily.Name,
+					Help: metricFamily.Help,
+					Type: metricFamily.Type,
+				}
+				groupMetricFamilies[key] = groupMetricFamily
+				group.metricFamilies = append(group.metricFamilies, groupMetricFamily)
+			}
+
+			groupMetricFamily.Metric = append(groupMetricFamily.Metric, &dto.Metric{
+				Label:     labels,
+				Gauge:     metric.Gauge,
+				Counter:   metric.Counter,
+				Summary:   metric.Summary,
+				Untyped:   metric.Untyped,
+				Histogram: metric.Histogram,
+			})
+		}
+	}
+
+	return groups
+}
+
+// PushgatewayPusher pushes the gathered metrics to a Prometheus Pushgateway,
+// one group per environment, and per deployment if requested.
+type PushgatewayPusher struct {
+	sync.Mutex
+	url                                      string
+	job                                      string
+	environment                              string
+	groupByDeployment                        bool
+	httpClient                               *http.Client
+	gatherer                                 prometheus.Gatherer
+	pushedGroups                             map[string]*pushgatewayGroup
+	totalPushgatewayPushErrorsMetric         prometheus.Counter
+	pushgatewayGroupsMetric                  prometheus.Gauge
+	lastPushgatewayPushTimestampMetric       prometheus.Gauge
+	lastPushgatewayPushDurationSecondsMetric prometheus.Gauge
+}
+
+// NewPushgatewayPusher returns a PushgatewayPusher pushing the metrics
+// gathered from `gatherer` under the `job` job.
+func NewPushgatewayPusher(
+	namespace string,
+	environment string,
+	pushgatewayURL string,
+	job string,
+	groupByDeployment bool,
+	timeout time.Duration,
+	gatherer prometheus.Gatherer,
+) (*PushgatewayPusher, error) {
+	u, err := url.Parse(pushgatewayURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Pushgateway URL `%s`: %v", pushgatewayURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid Pushgateway URL `%s`: scheme must be http or https", pushgatewayURL)
+	}
+	if job == "" || strings.Contains(job, "/") {
+		return nil, fmt.Errorf("invalid Pushgateway job `%s`", job)
+	}
+
+	totalPushgatewayPushErrorsMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "pushgateway_push_errors_total",
+			Help:      "Total number of errors pushing or deleting a group of metrics on the Pushgateway.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	pushgatewayGroupsMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "pushgateway_groups",
+			Help:      "Number of groups of metrics pushed to the Pushgateway.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastPushgatewayPushTimestampMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_pushgateway_push_timestamp",
+			Help:      "Number of seconds since 1970 since last successful push to the Pushgateway.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastPushgatewayPushDurationSecondsMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_pushgateway_push_duration_seconds",
+			Help:      "Duration of the last successful push to the Pushgateway.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	return &PushgatewayPusher{
+		url:                                      strings.TrimSuffix(pushgatewayURL, "/"),
+		job:                                      job,
+		environment:                              environment,
+		groupByDeployment:                        groupByDeployment,
+		httpClient:                               &http.Client{Timeout: timeout},
+		gatherer:                                 gatherer,
+		pushedGroups:                             map[string]*pushgatewayGroup{},
+		totalPushgatewayPushErrorsMetric:         totalPushgatewayPushErrorsMetric,
+		pushgatewayGroupsMetric:                  pushgatewayGroupsMetric,
+		lastPushgatewayPushTimestampMetric:       lastPushgatewayPushTimestampMetric,
+		lastPushgatewayPushDurationSecondsMetric: lastPushgatewayPushDurationSecondsMetric,
+	}, nil
+}
+
+// Push gathers the metrics, replaces every group on the Pushgateway with them
+// and deletes the groups pushed before that no longer have any metric.
+func (p *PushgatewayPusher) Push() error {
+	p.Lock()
+	defer p.Unlock()
+
+	begun := time.Now()
+
+	metricFamilies, err := p.gatherer.Gather()
+	if err != nil {
+		// Gather returns the metrics it could gather along with the error.
+		log.Errorf("Error gathering metrics for the Pushgateway: %v", err)
+	}
+
+	groups := pushgatewayGroups(metricFamilies, p.environment, p.groupByDeployment)
+	if len(groups) == 0 {
+		return errors.New("no metrics to push to the Pushgateway")
+	}
+
+	errs := []string{}
+	for _, key := range pushgatewayGroupKeys(groups) {
+		group := groups[key]
+		if err := p.pusher(group).Gatherer(group).Push(); err != nil {
+			p.totalPushgatewayPushErrorsMetric.Inc()
+			errs = append(errs, err.Error())
+			continue
+		}
+		p.pushedGroups[key] = group
+	}
+
+	for _, key := range pushgatewayGroupKeys(p.pushedGroups) {
+		if _, ok := groups[key]; ok {
+			continue
+		}
+
+		// Failed deletions are kept to be retried on the next push.
+		if err := p.pusher(p.pushedGroups[key]).Delete(); err != nil {
+			p.totalPushgatewayPushErrorsMetric.Inc()
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(p.pushedGroups, key)
+	}
+
+	p.pushgatewayGroupsMetric.Set(float64(len(p.pushedGroups)))
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	p.lastPushgatewayPushTimestampMetric.Set(float64(time.Now().Unix()))
+	p.lastPushgatewayPushDurationSecondsMetric.Set(time.Since(begun).Seconds())
+
+	return nil
+}
+
+func (p *PushgatewayPusher) PushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.Push(); err != nil {
+			log.Errorf("Error pushing metrics to `%s`: %v", p.url, err)
+		}
+		<-ticker.C
+	}
+}
+
+func (p *PushgatewayPusher) Collect(ch chan<- prometheus.Metric) {
+	p.totalPushgatewayPushErrorsMetric.Collect(ch)
+	p.pushgatewayGroupsMetric.Collect(ch)
+	p.lastPushgatewayPushTimestampMetric.Collect(ch)
+	p.lastPushgatewayPushDurationSecondsMetric.Collect(ch)
+}
+
+func (p *PushgatewayPusher) Describe(ch chan<- *prometheus.Desc) {
+	p.totalPushgatewayPushErrorsMetric.Describe(ch)
+	p.pushgatewayGroupsMetric.Describe(ch)
+	p.lastPushgatewayPushTimestampMetric.Describe(ch)
+	p.lastPushgatewayPushDurationSecondsMetric.Describe(ch)
+}
+
+func (p *PushgatewayPusher) pusher(group *pushgatewayGroup) *push.Pusher {
+	pusher := push.New(p.url, p.job).Client(p.httpClient)
+	for labelName, labelValue := range group.grouping {
+		pusher.Grouping(labelName, labelValue)
+	}
+
+	return pusher
+}
+
+func pushgatewayGroupKeys(groups map[string]*pushgatewayGroup) []string {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,320 @@
+package collectors_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+type pushgatewayTestRequest struct {
+	method   string
+	job      string
+	grouping map[string]string
+	metrics  map[string][]map[string]string
+}
+
+// servePushgateway starts a fake Pushgateway answering `status`, returning
+// the requests it receives.
+func servePushgateway(status int) (*httptest.Server, chan pushgatewayTestRequest) {
+	requests := make(chan pushgatewayTestRequest, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := pushgatewayTestRequest{
+			method:   r.Method,
+			grouping: map[string]string{},
+			metrics:  map[string][]map[string]string{},
+		}
+
+		components := strings.Split(strings.TrimPrefix(r.URL.Path, "/metrics/job/"), "/")
+		request.job = components[0]
+		for i := 1; i+1 < len(components); i += 2 {
+			request.grouping[components[i]] = components[i+1]
+		}
+
+		decoder := expfmt.NewDecoder(r.Body, expfmt.FmtProtoDelim)
+		for {
+			metricFamily := &dto.MetricFamily{}
+			if err := decoder.Decode(metricFamily); err != nil {
+				if err != io.EOF {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				break
+			}
+			for _, metric := range metricFamily.Metric {
+				labels := map[string]string{}
+				for _, label := range metric.Label {
+					labels[label.GetName()] = label.GetValue()
+				}
+				request.metrics[metricFamily.GetName()] = append(request.metrics[metricFamily.GetName()], labels)
+			}
+		}
+
+		requests <- request
+		w.WriteHeader(status)
+	}))
+
+	return server, requests
+}
+
+var _ = Describe("PushgatewayPusher", func() {
+	var (
+		err               error
+		namespace         string
+		environment       string
+		job               string
+		groupByDeployment bool
+		timeout           time.Duration
+		status            int
+		server            *httptest.Server
+		requests          chan pushgatewayTestRequest
+		registry          *prometheus.Registry
+		jobHealthyMetric  *prometheus.GaugeVec
+		pushgatewayPusher *PushgatewayPusher
+
+		totalPushgatewayPushErrorsMetric prometheus.Counter
+		pushgatewayGroupsMetric          prometheus.Gauge
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		job = "bosh_tsdb_exporter"
+		groupByDeployment = false
+		timeout = 10 * time.Second
+		status = http.StatusAccepted
+
+		registry = prometheus.NewRegistry()
+		jobHealthyMetric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "job",
+				Name:      "healthy",
+				Help:      "BOSH Job Healthy.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+			[]string{"bosh_deployment", "bosh_job_name"},
+		)
+		jobHealthyMetric.WithLabelValues("fake-deployment-1", "fake-job").Set(1)
+		jobHealthyMetric.WithLabelValues("fake-deployment-2", "fake-job").Set(1)
+		registry.MustRegister(jobHealthyMetric)
+		registry.MustRegister(prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "build_info",
+				Help:      "Build info.",
+			},
+		))
+
+		totalPushgatewayPushErrorsMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "pushgateway_push_errors_total",
+				Help:      "Total number of errors pushing or deleting a group of metrics on the Pushgateway.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		pushgatewayGroupsMetric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "pushgateway_groups",
+				Help:      "Number of groups of metrics pushed to the Pushgateway.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		server, requests = servePushgateway(status)
+		pushgatewayPusher, err = NewPushgatewayPusher(namespace, environment, server.URL, job, groupByDeployment, timeout, registry)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		pushgatewayPusher.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	receivedRequests := func() []pushgatewayTestRequest {
+		received := []pushgatewayTestRequest{}
+		for {
+			select {
+			case request := <-requests:
+				received = append(received, request)
+			default:
+				return received
+			}
+		}
+	}
+
+	Describe("Describe", func() {
+		var descriptions chan *prometheus.Desc
+
+		JustBeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+			go pushgatewayPusher.Describe(descriptions)
+		})
+
+		It("returns a pushgateway_push_errors_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalPushgatewayPushErrorsMetric.Desc())))
+		})
+
+		It("returns a pushgateway_groups metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(pushgatewayGroupsMetric.Desc())))
+		})
+	})
+
+	It("pushes the metrics grouped by environment without the grouping labels", func() {
+		Expect(pushgatewayPusher.Push()).To(Succeed())
+
+		received := receivedRequests()
+		Expect(received).To(HaveLen(1))
+		Expect(received[0].method).To(Equal("PUT"))
+		Expect(received[0].job).To(Equal(job))
+		Expect(received[0].grouping).To(Equal(map[string]string{"environment": environment}))
+		Expect(received[0].metrics).To(HaveKeyWithValue("test_exporter_build_info", []map[string]string{{}}))
+		Expect(received[0].metrics).To(HaveKeyWithValue("test_exporter_job_healthy", ConsistOf(
+			map[string]string{"bosh_deployment": "fake-deployment-1", "bosh_job_name": "fake-job"},
+			map[string]string{"bosh_deployment": "fake-deployment-2", "bosh_job_name": "fake-job"},
+		)))
+
+		pushgatewayGroupsMetric.Set(1)
+		Expect(collect()).To(ContainElement(PrometheusMetric(pushgatewayGroupsMetric)))
+	})
+
+	Context("when grouping by deployment", func() {
+		BeforeEach(func() {
+			groupByDeployment = true
+		})
+
+		It("pushes a group per deployment", func() {
+			Expect(pushgatewayPusher.Push()).To(Succeed())
+
+			groups := map[string]pushgatewayTestRequest{}
+			for _, request := range receivedRequests() {
+				groups[request.grouping["bosh_deployment"]] = request
+			}
+			Expect(groups).To(HaveLen(3))
+			Expect(groups[""].grouping).To(Equal(map[string]string{"environment": environment}))
+			Expect(groups[""].metrics).To(Equal(map[string][]map[string]string{"test_exporter_build_info": {{}}}))
+			Expect(groups["fake-deployment-1"].grouping).To(Equal(map[string]string{"environment": environment, "bosh_deployment": "fake-deployment-1"}))
+			Expect(groups["fake-deployment-1"].metrics).To(Equal(map[string][]map[string]string{"test_exporter_job_healthy": {{"bosh_job_name": "fake-job"}}}))
+			Expect(groups["fake-deployment-2"].metrics).To(Equal(map[string][]map[string]string{"test_exporter_job_healthy": {{"bosh_job_name": "fake-job"}}}))
+		})
+
+		It("deletes the groups that disappear", func() {
+			Expect(pushgatewayPusher.Push()).To(Succeed())
+			receivedRequests()
+
+			jobHealthyMetric.DeleteLabelValues("fake-deployment-2", "fake-job")
+			Expect(pushgatewayPusher.Push()).To(Succeed())
+
+			deleted := []map[string]string{}
+			for _, request := range receivedRequests() {
+				if request.method == "DELETE" {
+					Expect(request.job).To(Equal(job))
+					deleted = append(deleted, request.grouping)
+				}
+			}
+			Expect(deleted).To(Equal([]map[string]string{{"environment": environment, "bosh_deployment": "fake-deployment-2"}}))
+
+			pushgatewayGroupsMetric.Set(2)
+			Expect(collect()).To(ContainElement(PrometheusMetric(pushgatewayGroupsMetric)))
+		})
+	})
+
+	Context("when the Pushgateway answers 200", func() {
+		BeforeEach(func() {
+			status = http.StatusOK
+		})
+
+		It("pushes the metrics", func() {
+			Expect(pushgatewayPusher.Push()).To(Succeed())
+		})
+	})
+
+	Context("when the Pushgateway fails", func() {
+		BeforeEach(func() {
+			status = http.StatusInternalServerError
+			totalPushgatewayPushErrorsMetric.Inc()
+		})
+
+		It("returns an error", func() {
+			Expect(pushgatewayPusher.Push()).ToNot(Succeed())
+			Expect(collect()).To(ContainElement(PrometheusMetric(totalPushgatewayPushErrorsMetric)))
+		})
+	})
+
+	Context("when the Pushgateway does not answer in time", func() {
+		var (
+			unblock    chan struct{}
+			slowServer *httptest.Server
+			slowPusher *PushgatewayPusher
+		)
+
+		BeforeEach(func() {
+			unblock = make(chan struct{})
+			slowServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-unblock
+			}))
+			slowPusher, err = NewPushgatewayPusher(namespace, environment, slowServer.URL, job, groupByDeployment, 100*time.Millisecond, registry)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			close(unblock)
+			slowServer.Close()
+		})
+
+		It("returns an error", func() {
+			begun := time.Now()
+			Expect(slowPusher.Push()).ToNot(Succeed())
+			Expect(time.Since(begun)).To(BeNumerically("<", 5*time.Second))
+		})
+	})
+
+	Context("when the URL is not valid", func() {
+		It("returns an error", func() {
+			_, err := NewPushgatewayPusher(namespace, environment, "fake-url", job, groupByDeployment, timeout, registry)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the job is not valid", func() {
+		It("returns an error", func() {
+			_, err := NewPushgatewayPusher(namespace, environment, server.URL, "fake/job", groupByDeployment, timeout, registry)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,359 @@
+package collectors
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+// RemoteWriteConfig configures the Prometheus remote write endpoint a
+// RemoteWriter pushes to.
+type RemoteWriteConfig struct {
+	URL         string
+	Username    string
+	Password    string
+	BearerToken string
+	Timeout     time.Duration
+	QueueSize   int
+	MaxRetries  int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (c RemoteWriteConfig) queueSize() int {
+	if c.QueueSize > 0 {
+		return c.QueueSize
+	}
+
+	return 1
+}
+
+func (c RemoteWriteConfig) minBackoff() time.Duration {
+	if c.MinBackoff > 0 {
+		return c.MinBackoff
+	}
+
+	return time.Second
+}
+
+func (c RemoteWriteConfig) maxBackoff() time.Duration {
+	if c.MaxBackoff > 0 {
+		return c.MaxBackoff
+	}
+
+	return 30 * time.Second
+}
+
+type remoteWriteRequest struct {
+	body    []byte
+	samples int
+}
+
+type remoteWriteError struct {
+	err         error
+	recoverable bool
+}
+
+func (e remoteWriteError) Error() string {
+	return e.err.Error()
+}
+
+// RemoteWriter pushes the gathered metrics to a Prometheus remote write
+// endpoint, for Prometheus servers that cannot scrape the exporter.
+type RemoteWriter struct {
+	config                               RemoteWriteConfig
+	gatherer                             prometheus.Gatherer
+	httpClient                           *http.Client
+	queue                                chan remoteWriteRequest
+	done                                 chan struct{}
+	totalRemoteWriteSentSamplesMetric    prometheus.Counter
+	totalRemoteWriteRetriesMetric        prometheus.Counter
+	totalRemoteWriteFailedMetric         prometheus.Counter
+	totalRemoteWriteDroppedMetric        prometheus.Counter
+	remoteWriteQueueLengthMetric         prometheus.Gauge
+	lastRemoteWriteTimestampMetric       prometheus.Gauge
+	lastRemoteWriteDurationSecondsMetric prometheus.Gauge
+}
+
+// NewRemoteWriter returns a RemoteWriter pushing the metrics gathered from
+// `gatherer`.
+func NewRemoteWriter(
+	namespace string,
+	environment string,
+	config RemoteWriteConfig,
+	gatherer prometheus.Gatherer,
+) (*RemoteWriter, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote write URL `%s`: %v", config.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid remote write URL `%s`: scheme must be http or https", config.URL)
+	}
+	if config.Username != "" && config.BearerToken != "" {
+		return nil, errors.New("remote write basic auth and bearer token are mutually exclusive")
+	}
+
+	totalRemoteWriteSentSamplesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "remote_write_sent_samples_total",
+			Help:      "Total number of samples sent to the remote write endpoint.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalRemoteWriteRetriesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "remote_write_retries_total",
+			Help:      "Total number of remote write requests retried after a recoverable error.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalRemoteWriteFailedMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "remote_write_failed_requests_total",
+			Help:      "Total number of remote write requests dropped after failing.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	totalRemoteWriteDroppedMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "remote_write_dropped_requests_total",
+			Help:      "Total number of remote write requests dropped because the queue was full.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	remoteWriteQueueLengthMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "remote_write_queue_length",
+			Help:      "Number of remote write requests waiting to be sent.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastRemoteWriteTimestampMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_remote_write_timestamp",
+			Help:      "Number of seconds since 1970 since last successful remote write request.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	lastRemoteWriteDurationSecondsMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "",
+			Name:      "last_remote_write_duration_seconds",
+			Help:      "Duration of the last successful remote write request.",
+			ConstLabels: prometheus.Labels{
+				"environment": environment,
+			},
+		},
+	)
+
+	remoteWriter := &RemoteWriter{
+		config:                               config,
+		gatherer:                             gatherer,
+		httpClient:                           &http.Client{Timeout: config.Timeout},
+		queue:                                make(chan remoteWriteRequest, config.queueSize()),
+		done:                                 make(chan struct{}),
+		totalRemoteWriteSentSamplesMetric:    totalRemoteWriteSentSamplesMetric,
+		totalRemoteWriteRetriesMetric:        totalRemoteWriteRetriesMetric,
+		totalRemoteWriteFailedMetric:         totalRemoteWriteFailedMetric,
+		totalRemoteWriteDroppedMetric:        totalRemoteWriteDroppedMetric,
+		remoteWriteQueueLengthMetric:         remoteWriteQueueLengthMetric,
+		lastRemoteWriteTimestampMetric:       lastRemoteWriteTimestampMetric,
+		lastRemoteWriteDurationSecondsMetric: lastRemoteWriteDurationSecondsMetric,
+	}
+
+	go remoteWriter.run()
+
+	return remoteWriter, nil
+}
+
+// Push gathers the metrics and queues them for the remote write endpoint,
+// dropping the oldest queued request when the queue is full.
+func (w *RemoteWriter) Push() error {
+	metricFamilies, err := w.gatherer.Gather()
+	if err != nil {
+		// Gather returns the metrics it could gather along with the error.
+		log.Errorf("Error gathering metrics for remote write: %v", err)
+	}
+
+	samples := remoteWriteSamples(metricFamilies, time.Now().UnixNano()/int64(time.Millisecond))
+	if len(samples) == 0 {
+		return errors.New("no metrics to remote write")
+	}
+
+	body, err := encodeWriteRequest(samples)
+	if err != nil {
+		return fmt.Errorf("error encoding the remote write request: %v", err)
+	}
+
+	request := remoteWriteRequest{
+		body:    body,
+		samples: len(samples),
+	}
+	for {
+		select {
+		case w.queue <- request:
+			return nil
+		default:
+		}
+
+		select {
+		case <-w.queue:
+			w.totalRemoteWriteDroppedMetric.Inc()
+		default:
+		}
+	}
+}
+
+func (w *RemoteWriter) PushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.Push(); err != nil {
+			log.Errorf("Error pushing metrics to `%s`: %v", w.config.URL, err)
+		}
+		<-ticker.C
+	}
+}
+
+func (w *RemoteWriter) Close() {
+	close(w.done)
+}
+
+func (w *RemoteWriter) Collect(ch chan<- prometheus.Metric) {
+	w.remoteWriteQueueLengthMetric.Set(float64(len(w.queue)))
+
+	w.totalRemoteWriteSentSamplesMetric.Collect(ch)
+	w.totalRemoteWriteRetriesMetric.Collect(ch)
+	w.totalRemoteWriteFailedMetric.Collect(ch)
+	w.totalRemoteWriteDroppedMetric.Collect(ch)
+	w.remoteWriteQueueLengthMetric.Collect(ch)
+	w.lastRemoteWriteTimestampMetric.Collect(ch)
+	w.lastRemoteWriteDurationSecondsMetric.Collect(ch)
+}
+
+func (w *RemoteWriter) Describe(ch chan<- *prometheus.Desc) {
+	w.totalRemoteWriteSentSamplesMetric.Describe(ch)
+	w.totalRemoteWriteRetriesMetric.Describe(ch)
+	w.totalRemoteWriteFailedMetric.Describe(ch)
+	w.totalRemoteWriteDroppedMetric.Describe(ch)
+	w.remoteWriteQueueLengthMetric.Describe(ch)
+	w.lastRemoteWriteTimestampMetric.Describe(ch)
+	w.lastRemoteWriteDurationSecondsMetric.Describe(ch)
+}
+
+func (w *RemoteWriter) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case request := <-w.queue:
+			w.sendWithRetries(request)
+		}
+	}
+}
+
+func (w *RemoteWriter) sendWithRetries(request remoteWriteRequest) {
+	backoff := w.config.minBackoff()
+	for attempt := 0; ; attempt++ {
+		begun := time.Now()
+		err := w.send(request.body)
+		if err == nil {
+			w.totalRemoteWriteSentSamplesMetric.Add(float64(request.samples))
+			w.lastRemoteWriteTimestampMetric.Set(float64(time.Now().Unix()))
+			w.lastRemoteWriteDurationSecondsMetric.Set(time.Since(begun).Seconds())
+			return
+		}
+
+		if remoteWriteErr, ok := err.(remoteWriteError); !ok || !remoteWriteErr.recoverable || attempt >= w.config.MaxRetries {
+			log.Errorf("Error sending %d samples to `%s`, dropped: %v", request.samples, w.config.URL, err)
+			w.totalRemoteWriteFailedMetric.Inc()
+			return
+		}
+
+		log.Errorf("Error sending %d samples to `%s`, retrying in %s: %v", request.samples, w.config.URL, backoff, err)
+		w.totalRemoteWriteRetriesMetric.Inc()
+		select {
+		case <-w.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > w.config.maxBackoff() {
+			backoff = w.config.maxBackoff()
+		}
+	}
+}
+
+func (w *RemoteWriter) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "bosh_tsdb_exporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.config.Username != "" {
+		req.SetBasicAuth(w.config.Username, w.config.Password)
+	}
+	if w.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.config.BearerToken)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return remoteWriteError{err: err, recoverable: true}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return remoteWriteError{
+		err:         fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message)),
+		recoverable: resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests,
+	}
+}
@@ -0,0 +1,113 @@
+package collectors
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type remoteWriteSample struct {
+	labels    []*dto.LabelPair
+	value     float64
+	timestamp int64
+}
+
+func remoteWriteSamples(metricFamilies []*dto.MetricFamily, timestamp int64) []remoteWriteSample {
+	samples := []remoteWriteSample{}
+	for _, metricFamily := range metricFamilies {
+		name := metricFamily.GetName()
+		for _, metric := range metricFamily.Metric {
+			sampleTimestamp := timestamp
+			if metric.TimestampMs != nil {
+				sampleTimestamp = metric.GetTimestampMs()
+			}
+
+			sample := func(suffix string, value float64, extraLabels ...*dto.LabelPair) {
+				labels := []*dto.LabelPair{{Name: proto.String("__name__"), Value: proto.String(name + suffix)}}
+				labels = append(labels, metric.Label...)
+				labels = append(labels, extraLabels...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+				samples = append(samples, remoteWriteSample{labels: labels, value: value, timestamp: sampleTimestamp})
+			}
+
+			switch metricFamily.GetType() {
+			case dto.MetricType_COUNTER:
+				sample("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				sample("", metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				sample("", metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, quantile := range metric.GetSummary().Quantile {
+					sample("", quantile.GetValue(), &dto.LabelPair{
+						Name:  proto.String("quantile"),
+						Value: proto.String(strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)),
+					})
+				}
+				sample("_sum", metric.GetSummary().GetSampleSum())
+				sample("_count", float64(metric.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				for _, bucket := range metric.GetHistogram().Bucket {
+					sample("_bucket", float64(bucket.GetCumulativeCount()), &dto.LabelPair{
+						Name:  proto.String("le"),
+						Value: proto.String(strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)),
+					})
+				}
+				sample("_bucket", float64(metric.GetHistogram().GetSampleCount()), &dto.LabelPair{
+					Name:  proto.String("le"),
+					Value: proto.String("+Inf"),
+				})
+				sample("_sum", metric.GetHistogram().GetSampleSum())
+				sample("_count", float64(metric.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+
+	return samples
+}
+
+type prompbWriteRequest struct {
+	Timeseries []*prompbTimeSeries `protobuf:"bytes,1,rep,name=timeseries"`
+}
+
+func (m *prompbWriteRequest) Reset()         { *m = prompbWriteRequest{} }
+func (m *prompbWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*prompbWriteRequest) ProtoMessage()    {}
+
+type prompbTimeSeries struct {
+	Labels  []*prompbLabel  `protobuf:"bytes,1,rep,name=labels"`
+	Samples []*prompbSample `protobuf:"bytes,2,rep,name=samples"`
+}
+
+type prompbLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+type prompbSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func encodeWriteRequest(samples []remoteWriteSample) ([]byte, error) {
+	writeRequest := &prompbWriteRequest{}
+	for _, sample := range samples {
+		timeSeries := &prompbTimeSeries{
+			Samples: []*prompbSample{{Value: sample.value, Timestamp: sample.timestamp}},
+		}
+		for _, label := range sample.labels {
+			timeSeries.Labels = append(timeSeries.Labels, &prompbLabel{Name: label.GetName(), Value: label.GetValue()})
+		}
+		writeRequest.Timeseries = append(writeRequest.Timeseries, timeSeries)
+	}
+
+	data, err := proto.Marshal(writeRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return snappy.Encode(nil, data), nil
+}
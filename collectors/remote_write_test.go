@@ -0,0 +1,474 @@
+package collectors_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+type remoteWriteTestSample struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// The Prometheus remote write `WriteRequest` protobuf messages, as defined by
+// the Prometheus `prompb` package.
+type testWriteRequest struct {
+	Timeseries []*testTimeSeries `protobuf:"bytes,1,rep,name=timeseries"`
+}
+
+func (m *testWriteRequest) Reset()         { *m = testWriteRequest{} }
+func (m *testWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*testWriteRequest) ProtoMessage()    {}
+
+type testTimeSeries struct {
+	Labels  []*testLabel  `protobuf:"bytes,1,rep,name=labels"`
+	Samples []*testSample `protobuf:"bytes,2,rep,name=samples"`
+}
+
+type testLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+type testSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func decodeWriteRequest(body []byte) ([]remoteWriteTestSample, error) {
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+
+	writeRequest := &testWriteRequest{}
+	if err := proto.Unmarshal(data, writeRequest); err != nil {
+		return nil, err
+	}
+
+	samples := []remoteWriteTestSample{}
+	for _, timeSeries := range writeRequest.Timeseries {
+		labels := map[string]string{}
+		for _, label := range timeSeries.Labels {
+			labels[label.Name] = label.Value
+		}
+		for _, sample := range timeSeries.Samples {
+			samples = append(samples, remoteWriteTestSample{labels: labels, value: sample.Value, timestamp: sample.Timestamp})
+		}
+	}
+
+	return samples, nil
+}
+
+var _ = Describe("RemoteWriter", func() {
+	var (
+		err          error
+		namespace    string
+		environment  string
+		config       RemoteWriteConfig
+		registry     *prometheus.Registry
+		server       *httptest.Server
+		statusCodes  []int
+		requestsLock sync.Mutex
+		requests     []*http.Request
+		bodies       [][]byte
+		remoteWriter *RemoteWriter
+
+		totalRemoteWriteSentSamplesMetric    prometheus.Counter
+		totalRemoteWriteRetriesMetric        prometheus.Counter
+		totalRemoteWriteFailedMetric         prometheus.Counter
+		totalRemoteWriteDroppedMetric        prometheus.Counter
+		remoteWriteQueueLengthMetric         prometheus.Gauge
+		lastRemoteWriteTimestampMetric       prometheus.Gauge
+		lastRemoteWriteDurationSecondsMetric prometheus.Gauge
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		statusCodes = []int{}
+		requests = []*http.Request{}
+		bodies = [][]byte{}
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+
+			requestsLock.Lock()
+			requests = append(requests, r)
+			bodies = append(bodies, body)
+			statusCode := http.StatusNoContent
+			if len(requests) <= len(statusCodes) {
+				statusCode = statusCodes[len(requests)-1]
+			}
+			requestsLock.Unlock()
+
+			w.WriteHeader(statusCode)
+		}))
+
+		config = RemoteWriteConfig{
+			URL:        server.URL + "/api/v1/write",
+			Timeout:    time.Second,
+			QueueSize:  10,
+			MaxRetries: 3,
+			MinBackoff: 10 * time.Millisecond,
+			MaxBackoff: 20 * time.Millisecond,
+		}
+
+		registry = prometheus.NewRegistry()
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "test_gauge",
+			Help:        "Test gauge.",
+			ConstLabels: prometheus.Labels{"foo": "bar"},
+		})
+		gauge.Set(42)
+		registry.MustRegister(gauge)
+		histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "test_histogram",
+			Help:    "Test histogram.",
+			Buckets: []float64{1},
+		})
+		histogram.Observe(0.5)
+		histogram.Observe(2)
+		registry.MustRegister(histogram)
+
+		totalRemoteWriteSentSamplesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "remote_write_sent_samples_total",
+				Help:      "Total number of samples sent to the remote write endpoint.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalRemoteWriteRetriesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "remote_write_retries_total",
+				Help:      "Total number of remote write requests retried after a recoverable error.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalRemoteWriteFailedMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "remote_write_failed_requests_total",
+				Help:      "Total number of remote write requests dropped after failing.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		totalRemoteWriteDroppedMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "remote_write_dropped_requests_total",
+				Help:      "Total number of remote write requests dropped because the queue was full.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		remoteWriteQueueLengthMetric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "remote_write_queue_length",
+				Help:      "Number of remote write requests waiting to be sent.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		lastRemoteWriteTimestampMetric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "last_remote_write_timestamp",
+				Help:      "Number of seconds since 1970 since last successful remote write request.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+
+		lastRemoteWriteDurationSecondsMetric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "",
+				Name:      "last_remote_write_duration_seconds",
+				Help:      "Duration of the last successful remote write request.",
+				ConstLabels: prometheus.Labels{
+					"environment": environment,
+				},
+			},
+		)
+	})
+
+	AfterEach(func() {
+		if remoteWriter != nil {
+			remoteWriter.Close()
+		}
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		remoteWriter, err = NewRemoteWriter(namespace, environment, config, registry)
+	})
+
+	receivedRequests := func() int {
+		requestsLock.Lock()
+		defer requestsLock.Unlock()
+		return len(requests)
+	}
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		remoteWriter.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	// metricValue returns the value of the collected metric with the
+	// description of `expected`, as the retries and failures counters can have
+	// the same value.
+	metricValue := func(expected prometheus.Metric) float64 {
+		for _, metric := range collect() {
+			if metric.Desc().String() == expected.Desc().String() {
+				m := &dto.Metric{}
+				Expect(metric.Write(m)).To(Succeed())
+				return m.GetCounter().GetValue() + m.GetGauge().GetValue()
+			}
+		}
+		return -1
+	}
+
+	Describe("Describe", func() {
+		var descriptions chan *prometheus.Desc
+
+		JustBeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+			go remoteWriter.Describe(descriptions)
+		})
+
+		It("returns a remote_write_sent_samples_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalRemoteWriteSentSamplesMetric.Desc())))
+		})
+
+		It("returns a remote_write_retries_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalRemoteWriteRetriesMetric.Desc())))
+		})
+
+		It("returns a remote_write_failed_requests_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalRemoteWriteFailedMetric.Desc())))
+		})
+
+		It("returns a remote_write_dropped_requests_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalRemoteWriteDroppedMetric.Desc())))
+		})
+
+		It("returns a remote_write_queue_length metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(remoteWriteQueueLengthMetric.Desc())))
+		})
+
+		It("returns a last_remote_write_timestamp metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(lastRemoteWriteTimestampMetric.Desc())))
+		})
+
+		It("returns a last_remote_write_duration_seconds metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(lastRemoteWriteDurationSecondsMetric.Desc())))
+		})
+	})
+
+	Describe("Push", func() {
+		It("sends the metrics as a snappy compressed WriteRequest", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(remoteWriter.Push()).To(Succeed())
+			Eventually(receivedRequests).Should(Equal(1))
+
+			requestsLock.Lock()
+			request, body := requests[0], bodies[0]
+			requestsLock.Unlock()
+
+			Expect(request.Method).To(Equal("POST"))
+			Expect(request.URL.Path).To(Equal("/api/v1/write"))
+			Expect(request.Header.Get("Content-Encoding")).To(Equal("snappy"))
+			Expect(request.Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+			Expect(request.Header.Get("X-Prometheus-Remote-Write-Version")).To(Equal("0.1.0"))
+
+			samples, err := decodeWriteRequest(body)
+			Expect(err).ToNot(HaveOccurred())
+
+			values := map[string]float64{}
+			for _, sample := range samples {
+				Expect(sample.timestamp).To(BeNumerically("~", time.Now().UnixNano()/int64(time.Millisecond), 60000))
+				values[fmt.Sprintf("%s{foo=%q,le=%q}", sample.labels["__name__"], sample.labels["foo"], sample.labels["le"])] = sample.value
+			}
+			Expect(values).To(Equal(map[string]float64{
+				`test_gauge{foo="bar",le=""}`:             42,
+				`test_histogram_bucket{foo="",le="1"}`:    1,
+				`test_histogram_bucket{foo="",le="+Inf"}`: 2,
+				`test_histogram_sum{foo="",le=""}`:        2.5,
+				`test_histogram_count{foo="",le=""}`:      2,
+			}))
+
+			totalRemoteWriteSentSamplesMetric.Add(5)
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalRemoteWriteSentSamplesMetric)))
+		})
+
+		Context("when there is basic auth", func() {
+			BeforeEach(func() {
+				config.Username = "fake-username"
+				config.Password = "fake-password"
+			})
+
+			It("authenticates the requests", func() {
+				Expect(remoteWriter.Push()).To(Succeed())
+				Eventually(receivedRequests).Should(Equal(1))
+
+				requestsLock.Lock()
+				defer requestsLock.Unlock()
+				username, password, ok := requests[0].BasicAuth()
+				Expect(ok).To(BeTrue())
+				Expect(username).To(Equal("fake-username"))
+				Expect(password).To(Equal("fake-password"))
+			})
+		})
+
+		Context("when there is a bearer token", func() {
+			BeforeEach(func() {
+				config.BearerToken = "fake-token"
+			})
+
+			It("authenticates the requests", func() {
+				Expect(remoteWriter.Push()).To(Succeed())
+				Eventually(receivedRequests).Should(Equal(1))
+
+				requestsLock.Lock()
+				defer requestsLock.Unlock()
+				Expect(requests[0].Header.Get("Authorization")).To(Equal("Bearer fake-token"))
+			})
+		})
+
+		Context("when the endpoint fails with a recoverable error", func() {
+			BeforeEach(func() {
+				statusCodes = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+			})
+
+			It("retries the request", func() {
+				Expect(remoteWriter.Push()).To(Succeed())
+
+				Eventually(func() float64 { return metricValue(totalRemoteWriteSentSamplesMetric) }).Should(Equal(5.0))
+				Expect(metricValue(totalRemoteWriteRetriesMetric)).To(Equal(2.0))
+				Expect(metricValue(totalRemoteWriteFailedMetric)).To(Equal(0.0))
+				Expect(receivedRequests()).To(Equal(3))
+			})
+		})
+
+		Context("when the endpoint keeps failing", func() {
+			BeforeEach(func() {
+				config.MaxRetries = 1
+				statusCodes = []int{http.StatusInternalServerError, http.StatusInternalServerError}
+			})
+
+			It("drops the request once the retries are exhausted", func() {
+				Expect(remoteWriter.Push()).To(Succeed())
+
+				Eventually(func() float64 { return metricValue(totalRemoteWriteFailedMetric) }).Should(Equal(1.0))
+				Expect(metricValue(totalRemoteWriteRetriesMetric)).To(Equal(1.0))
+				Expect(metricValue(totalRemoteWriteSentSamplesMetric)).To(Equal(0.0))
+				Expect(receivedRequests()).To(Equal(2))
+			})
+		})
+
+		Context("when the endpoint fails with an unrecoverable error", func() {
+			BeforeEach(func() {
+				statusCodes = []int{http.StatusBadRequest}
+			})
+
+			It("drops the request without retrying", func() {
+				Expect(remoteWriter.Push()).To(Succeed())
+
+				Eventually(func() float64 { return metricValue(totalRemoteWriteFailedMetric) }).Should(Equal(1.0))
+				Expect(metricValue(totalRemoteWriteRetriesMetric)).To(Equal(0.0))
+				Consistently(receivedRequests).Should(Equal(1))
+			})
+		})
+
+		Context("when the queue is full", func() {
+			BeforeEach(func() {
+				config.QueueSize = 1
+				config.MinBackoff = time.Minute
+				config.MaxBackoff = time.Minute
+				statusCodes = []int{http.StatusServiceUnavailable}
+				totalRemoteWriteDroppedMetric.Inc()
+				remoteWriteQueueLengthMetric.Set(1)
+			})
+
+			It("drops the oldest requests", func() {
+				Expect(remoteWriter.Push()).To(Succeed())
+				Eventually(receivedRequests).Should(Equal(1))
+
+				Expect(remoteWriter.Push()).To(Succeed())
+				Expect(remoteWriter.Push()).To(Succeed())
+
+				metrics := collect()
+				Expect(metrics).To(ContainElement(PrometheusMetric(totalRemoteWriteDroppedMetric)))
+				Expect(metrics).To(ContainElement(PrometheusMetric(remoteWriteQueueLengthMetric)))
+			})
+		})
+	})
+
+	Context("when the URL is not valid", func() {
+		BeforeEach(func() {
+			config.URL = "fake-url"
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when both basic auth and a bearer token are set", func() {
+		BeforeEach(func() {
+			config.Username = "fake-username"
+			config.BearerToken = "fake-token"
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,172 @@
+package collectors
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// TargetGroup is a Prometheus file_sd and HTTP SD target group.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// ServiceDiscovery builds Prometheus targets from the BOSH Jobs sending
+// metrics.
+type ServiceDiscovery struct {
+	targetPort        int
+	boshDNSNetwork    string
+	environmentRouter *EnvironmentRouter
+	directorCollector *DirectorCollector
+}
+
+func NewServiceDiscovery(
+	targetPort int,
+	boshDNSNetwork string,
+	environmentRouter *EnvironmentRouter,
+	directorCollector *DirectorCollector,
+) *ServiceDiscovery {
+	return &ServiceDiscovery{
+		targetPort:        targetPort,
+		boshDNSNetwork:    boshDNSNetwork,
+		environmentRouter: environmentRouter,
+		directorCollector: directorCollector,
+	}
+}
+
+// TargetGroups returns a target group for every reporting instance of every
+// environment, labelled with its environment and its BOSH deployment, job,
+// index and id, sorted by environment, deployment, job, index and id.
+func (s *ServiceDiscovery) TargetGroups() []TargetGroup {
+	targetGroups := []TargetGroup{}
+	for _, hmTSDBCollector := range s.environmentRouter.Collectors() {
+		targetGroups = append(targetGroups, s.environmentTargetGroups(hmTSDBCollector)...)
+	}
+
+	return targetGroups
+}
+
+func (s *ServiceDiscovery) environmentTargetGroups(hmTSDBCollector *HMTSDBCollector) []TargetGroup {
+	// The BOSH Director only knows the VMs of its own environment.
+	var ips map[string]string
+	if s.directorCollector != nil && s.directorCollector.environment == hmTSDBCollector.environment {
+		ips = map[string]string{}
+		for _, vm := range s.directorCollector.VMs() {
+			if len(vm.IPs) > 0 {
+				ips[reportingKey(vm.Deployment, vm.JobName, vm.ID)] = vm.IPs[0]
+			}
+		}
+	}
+
+	targetGroups := []TargetGroup{}
+	for _, jobInstance := range hmTSDBCollector.JobInstances() {
+		if !jobInstance.Reporting {
+			continue
+		}
+
+		host := s.boshDNSName(jobInstance)
+		if ips != nil {
+			ip, ok := ips[reportingKey(jobInstance.Deployment, jobInstance.Job, jobInstance.ID)]
+			if !ok {
+				continue
+			}
+			host = ip
+		}
+
+		targetGroups = append(targetGroups, TargetGroup{
+			Targets: []string{net.JoinHostPort(host, strconv.Itoa(s.targetPort))},
+			Labels: map[string]string{
+				"environment":     hmTSDBCollector.environment,
+				"bosh_deployment": jobInstance.Deployment,
+				"bosh_job_name":   jobInstance.Job,
+				"bosh_job_index":  jobInstance.Index,
+				"bosh_job_id":     jobInstance.ID,
+			},
+		})
+	}
+
+	return targetGroups
+}
+
+func (s *ServiceDiscovery) boshDNSName(jobInstance JobInstance) string {
+	labels := []string{jobInstance.ID, jobInstance.Job, s.boshDNSNetwork, jobInstance.Deployment, "bosh"}
+	for i, label := range labels {
+		labels[i] = boshDNSLabel(label)
+	}
+
+	return strings.Join(labels, ".")
+}
+
+func boshDNSLabel(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, name)
+}
+
+// ServeHTTP implements the Prometheus HTTP SD endpoint.
+func (s *ServiceDiscovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.TargetGroups()); err != nil {
+		log.Errorf("Error writing service discovery targets: %v", err)
+	}
+}
+
+// WriteFile writes the target groups to a Prometheus file_sd JSON file.
+func (s *ServiceDiscovery) WriteFile(path string) error {
+	content, err := json.MarshalIndent(s.TargetGroups(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(append(content, '\n')); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+func (s *ServiceDiscovery) WriteFileLoop(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.WriteFile(path); err != nil {
+			log.Errorf("Error writing service discovery file `%s`: %v", path, err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,233 @@
+package collectors_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/bosh-prometheus/bosh_tsdb_exporter/director"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+)
+
+var _ = Describe("ServiceDiscovery", func() {
+	var (
+		err               error
+		environment       string
+		tsdbListener      net.Listener
+		directorClient    *fakeDirectorClient
+		hmTSDBCollector   *HMTSDBCollector
+		environmentRouter *EnvironmentRouter
+		directorCollector *DirectorCollector
+		serviceDiscovery  *ServiceDiscovery
+		withDirector      bool
+
+		expectedTargetGroups []TargetGroup
+
+		deploymentName = "fake-deployment-name"
+		jobName        = "fake-job-name"
+		jobID          = "fake-job-id"
+		jobIndex       = "0"
+	)
+
+	BeforeEach(func() {
+		environment = "test_environment"
+		withDirector = true
+
+		directorClient = &fakeDirectorClient{
+			deployments: []director.Deployment{{Name: deploymentName}},
+			vms: map[string][]director.VM{
+				deploymentName: {
+					{Deployment: deploymentName, JobName: jobName, Index: jobIndex, ID: jobID, IPs: []string{"10.0.0.1", "10.0.1.1"}},
+					{Deployment: deploymentName, JobName: jobName, Index: "1", ID: "fake-silent-job-id", IPs: []string{"10.0.0.2"}},
+				},
+			},
+			vmsErr: map[string]error{},
+		}
+
+		expectedTargetGroups = []TargetGroup{
+			{
+				Targets: []string{"10.0.0.1:9100"},
+				Labels: map[string]string{
+					"environment":     environment,
+					"bosh_deployment": deploymentName,
+					"bosh_job_name":   jobName,
+					"bosh_job_index":  jobIndex,
+					"bosh_job_id":     jobID,
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		tsdbListener.Close()
+	})
+
+	JustBeforeEach(func() {
+		var hmTSDBListener *HMTSDBListener
+		hmTSDBCollector, hmTSDBListener, tsdbListener = newTestHMTSDBListener("test_exporter", environment, HMTSDBCollectorConfig{}, HMTSDBListenerConfig{})
+		hmJSONCollector := NewHMJSONCollector("test_exporter", environment, hmTSDBListener, strings.NewReader(fmt.Sprintf(
+			`{"kind":"heartbeat","timestamp":%d,"deployment":"%s","job":"%s","index":"%s","instance_id":"%s","metrics":[{"name":"system.healthy","value":"1","timestamp":%d,"tags":{}}]}`+"\n"+
+				`{"kind":"heartbeat","timestamp":%d,"deployment":"%s","job":"%s","index":"2","instance_id":"fake-unknown-job-id","metrics":[{"name":"system.healthy","value":"1","timestamp":%d,"tags":{}}]}`+"\n",
+			time.Now().Unix(), deploymentName, jobName, jobIndex, jobID, time.Now().Unix(),
+			time.Now().Unix(), deploymentName, jobName, time.Now().Unix(),
+		)))
+		Eventually(hmJSONCollector.Done()).Should(BeClosed())
+
+		directorCollector = nil
+		if withDirector {
+			directorCollector = NewDirectorCollector("test_exporter", environment, directorClient, time.Hour, nil)
+			Eventually(func() int { return len(directorCollector.VMs()) }).Should(Equal(len(directorClient.vms[deploymentName])))
+		}
+
+		environmentRouter = NewEnvironmentRouter(nil, nil)
+		environmentRouter.Add(hmTSDBCollector)
+
+		serviceDiscovery = NewServiceDiscovery(9100, "default", environmentRouter, directorCollector)
+	})
+
+	Describe("TargetGroups", func() {
+		It("returns the reporting BOSH Jobs with a known IP", func() {
+			Expect(serviceDiscovery.TargetGroups()).To(Equal(expectedTargetGroups))
+		})
+
+		Context("when several instances of a BOSH Job are reporting", func() {
+			BeforeEach(func() {
+				directorClient.vms[deploymentName] = append(directorClient.vms[deploymentName], director.VM{
+					Deployment: deploymentName, JobName: jobName, Index: "2", ID: "fake-unknown-job-id", IPs: []string{"10.0.0.3"},
+				})
+				expectedTargetGroups = append(expectedTargetGroups, TargetGroup{
+					Targets: []string{"10.0.0.3:9100"},
+					Labels: map[string]string{
+						"environment":     environment,
+						"bosh_deployment": deploymentName,
+						"bosh_job_name":   jobName,
+						"bosh_job_index":  "2",
+						"bosh_job_id":     "fake-unknown-job-id",
+					},
+				})
+			})
+
+			It("returns a target group per instance", func() {
+				Expect(serviceDiscovery.TargetGroups()).To(Equal(expectedTargetGroups))
+			})
+		})
+
+		Context("when there is no BOSH Director", func() {
+			BeforeEach(func() {
+				withDirector = false
+				expectedTargetGroups[0].Targets = []string{"fake-job-id.fake-job-name.default.fake-deployment-name.bosh:9100"}
+				expectedTargetGroups = append(expectedTargetGroups, TargetGroup{
+					Targets: []string{"fake-unknown-job-id.fake-job-name.default.fake-deployment-name.bosh:9100"},
+					Labels: map[string]string{
+						"environment":     environment,
+						"bosh_deployment": deploymentName,
+						"bosh_job_name":   jobName,
+						"bosh_job_index":  "2",
+						"bosh_job_id":     "fake-unknown-job-id",
+					},
+				})
+			})
+
+			It("returns the BOSH DNS names of the reporting BOSH Jobs", func() {
+				Expect(serviceDiscovery.TargetGroups()).To(Equal(expectedTargetGroups))
+			})
+		})
+		Context("when several environments are reporting", func() {
+			var otherTSDBListener net.Listener
+
+			JustBeforeEach(func() {
+				var otherHMTSDBCollector *HMTSDBCollector
+				var otherHMTSDBListener *HMTSDBListener
+				otherHMTSDBCollector, otherHMTSDBListener, otherTSDBListener = newTestHMTSDBListener("test_exporter", "other_environment", HMTSDBCollectorConfig{}, HMTSDBListenerConfig{})
+				hmJSONCollector := NewHMJSONCollector("test_exporter", "other_environment", otherHMTSDBListener, strings.NewReader(fmt.Sprintf(
+					`{"kind":"heartbeat","timestamp":%d,"deployment":"%s","job":"%s","index":"0","instance_id":"fake-other-job-id","metrics":[{"name":"system.healthy","value":"1","timestamp":%d,"tags":{}}]}`+"\n",
+					time.Now().Unix(), deploymentName, jobName, time.Now().Unix(),
+				)))
+				Eventually(hmJSONCollector.Done()).Should(BeClosed())
+				environmentRouter.Add(otherHMTSDBCollector)
+
+				expectedTargetGroups = append([]TargetGroup{{
+					Targets: []string{"fake-other-job-id.fake-job-name.default.fake-deployment-name.bosh:9100"},
+					Labels: map[string]string{
+						"environment":     "other_environment",
+						"bosh_deployment": deploymentName,
+						"bosh_job_name":   jobName,
+						"bosh_job_index":  "0",
+						"bosh_job_id":     "fake-other-job-id",
+					},
+				}}, expectedTargetGroups...)
+			})
+
+			AfterEach(func() {
+				otherTSDBListener.Close()
+			})
+
+			It("returns the reporting BOSH Jobs of every environment labelled with their environment", func() {
+				Expect(serviceDiscovery.TargetGroups()).To(Equal(expectedTargetGroups))
+			})
+		})
+	})
+
+	Describe("ServeHTTP", func() {
+		var recorder *httptest.ResponseRecorder
+
+		BeforeEach(func() {
+			recorder = httptest.NewRecorder()
+		})
+
+		It("returns the target groups", func() {
+			serviceDiscovery.ServeHTTP(recorder, httptest.NewRequest("GET", "/sd", nil))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			targetGroups := []TargetGroup{}
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &targetGroups)).To(Succeed())
+			Expect(targetGroups).To(Equal(expectedTargetGroups))
+		})
+
+		It("rejects other methods", func() {
+			serviceDiscovery.ServeHTTP(recorder, httptest.NewRequest("POST", "/sd", nil))
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+
+	Describe("WriteFile", func() {
+		var tmpDir string
+
+		BeforeEach(func() {
+			tmpDir, err = ioutil.TempDir("", "service_discovery")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("writes the target groups", func() {
+			path := filepath.Join(tmpDir, "targets.json")
+			Expect(serviceDiscovery.WriteFile(path)).To(Succeed())
+
+			content, err := ioutil.ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			targetGroups := []TargetGroup{}
+			Expect(json.Unmarshal(content, &targetGroups)).To(Succeed())
+			Expect(targetGroups).To(Equal(expectedTargetGroups))
+
+			files, err := ioutil.ReadDir(tmpDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+		})
+	})
+})
@@ -0,0 +1,50 @@
+package collectors
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TagMapping controls how a BOSH HM TSDB tag is exported as a Prometheus label.
+type TagMapping struct {
+	Tag     string `yaml:"tag"`
+	Label   string `yaml:"label,omitempty"`
+	Default string `yaml:"default,omitempty"`
+	Drop    bool   `yaml:"drop,omitempty"`
+}
+
+func (t TagMapping) LabelName() string {
+	if t.Label == "" {
+		return t.Tag
+	}
+
+	return t.Label
+}
+
+func (t TagMapping) validate() error {
+	if t.Tag == "" {
+		return errors.New("`tag` is required")
+	}
+
+	if _, ok := jobTagLabelNames[t.Tag]; ok {
+		return fmt.Errorf("tag `%s` is reserved", t.Tag)
+	}
+
+	if t.Drop {
+		if t.Label != "" || t.Default != "" {
+			return fmt.Errorf("dropped tag `%s` cannot have a label or a default", t.Tag)
+		}
+		return nil
+	}
+
+	labelName := t.LabelName()
+	if !labelNameRE.MatchString(labelName) || strings.HasPrefix(labelName, "__") {
+		return fmt.Errorf("`%s` is not a valid label name", labelName)
+	}
+	if labelName == "environment" || containsString(jobLabelNames, labelName) {
+		return fmt.Errorf("label `%s` is reserved", labelName)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package collectors
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TimestampPolicy controls how the timestamps stamped by the BOSH HM on every
+// metric are validated and exposed.
+type TimestampPolicy struct {
+	MaxAge    time.Duration
+	MaxFuture time.Duration
+	Export    bool
+}
+
+func (p TimestampPolicy) validate(timestamp time.Time, now time.Time) error {
+	if p.MaxAge > 0 && timestamp.Before(now.Add(-p.MaxAge)) {
+		return fmt.Errorf("timestamp %v is older than %v", timestamp.Unix(), p.MaxAge)
+	}
+
+	if p.MaxFuture > 0 && timestamp.After(now.Add(p.MaxFuture)) {
+		return fmt.Errorf("timestamp %v is more than %v in the future", timestamp.Unix(), p.MaxFuture)
+	}
+
+	return nil
+}
+
+func parseTimestamp(token string) (time.Time, error) {
+	timestamp, err := strconv.ParseInt(token, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if timestamp < 0 {
+		return time.Time{}, fmt.Errorf("negative timestamp %d", timestamp)
+	}
+
+	if len(token) > 10 {
+		return time.Unix(0, timestamp*int64(time.Millisecond)), nil
+	}
+
+	return time.Unix(timestamp, 0), nil
+}
+
+type timestampedMetric struct {
+	prometheus.Metric
+	timestamp time.Time
+}
+
+func (m timestampedMetric) Write(metric *dto.Metric) error {
+	if err := m.Metric.Write(metric); err != nil {
+		return err
+	}
+
+	timestampMs := m.timestamp.UnixNano() / int64(time.Millisecond)
+	metric.TimestampMs = &timestampMs
+
+	return nil
+}
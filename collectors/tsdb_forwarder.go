@@ -0,0 +1,235 @@
+package collectors
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	tsdbForwarderDialTimeout  = 10 * time.Second
+	tsdbForwarderWriteTimeout = 10 * time.Second
+	tsdbForwarderMinBackoff   = time.Second
+	tsdbForwarderMaxBackoff   = time.Minute
+)
+
+// TSDBForwarder forwards the BOSH HM metrics published on a HMMetricBus, as
+// TSDB `put` messages, to an upstream OpenTSDB (or another exporter), through a
+// bounded buffer so a slow or unavailable target never blocks the ingestion.
+type TSDBForwarder struct {
+	target                           string
+	allow                            *regexp.Regexp
+	deny                             *regexp.Regexp
+	messages                         chan string
+	done                             chan struct{}
+	totalForwardedTSDBMessagesMetric prometheus.Counter
+	totalDroppedTSDBMessagesMetric   prometheus.Counter
+	totalForwardErrorsMetric         prometheus.Counter
+	bufferedTSDBMessagesMetric       prometheus.Gauge
+}
+
+// NewTSDBForwarder returns a TSDBForwarder to the `target` host:port, buffering
+// up to `bufferSize` messages.
+func NewTSDBForwarder(
+	namespace string,
+	environment string,
+	target string,
+	bufferSize int,
+	allow string,
+	deny string,
+) (*TSDBForwarder, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, fmt.Errorf("invalid TSDB forward target `%s`: %v", target, err)
+	}
+
+	allowRE, err := compileMetricNameRegexp(allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSDB forward allow regex: %v", err)
+	}
+
+	denyRE, err := compileMetricNameRegexp(deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSDB forward deny regex: %v", err)
+	}
+
+	constLabels := prometheus.Labels{
+		"environment": environment,
+		"target":      target,
+	}
+
+	totalForwardedTSDBMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "forwarded_tsdb_messages_total",
+			Help:        "Total number of BOSH HM TSDB messages forwarded to the target.",
+			ConstLabels: constLabels,
+		},
+	)
+
+	totalDroppedTSDBMessagesMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "dropped_forwarded_tsdb_messages_total",
+			Help:        "Total number of BOSH HM TSDB messages not forwarded to the target because its buffer was full.",
+			ConstLabels: constLabels,
+		},
+	)
+
+	totalForwardErrorsMetric := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "tsdb_forward_errors_total",
+			Help:        "Total number of errors connecting or writing to the BOSH HM TSDB forward target.",
+			ConstLabels: constLabels,
+		},
+	)
+
+	bufferedTSDBMessagesMetric := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "",
+			Name:        "buffered_forwarded_tsdb_messages",
+			Help:        "Number of BOSH HM TSDB messages waiting to be forwarded to the target.",
+			ConstLabels: constLabels,
+		},
+	)
+
+	forwarder := &TSDBForwarder{
+		target:                           target,
+		allow:                            allowRE,
+		deny:                             denyRE,
+		messages:                         make(chan string, bufferSize),
+		done:                             make(chan struct{}),
+		totalForwardedTSDBMessagesMetric: totalForwardedTSDBMessagesMetric,
+		totalDroppedTSDBMessagesMetric:   totalDroppedTSDBMessagesMetric,
+		totalForwardErrorsMetric:         totalForwardErrorsMetric,
+		bufferedTSDBMessagesMetric:       bufferedTSDBMessagesMetric,
+	}
+
+	go forwarder.run()
+
+	return forwarder, nil
+}
+
+func (f *TSDBForwarder) SinkName() string {
+	return "tsdb_forward/" + f.target
+}
+
+// Consume forwards a BOSH HM metric as a TSDB `put` message, tagged with its
+// environment.
+func (f *TSDBForwarder) Consume(environment string, hmMetric HMMetric) {
+	f.Forward(hmMetric.Name, formatHMMessage(environment, hmMetric))
+}
+
+// Forward queues a BOSH HM TSDB message, dropping it when the buffer is full.
+func (f *TSDBForwarder) Forward(name string, hmMessage string) {
+	if f.allow != nil && !f.allow.MatchString(name) {
+		return
+	}
+	if f.deny != nil && f.deny.MatchString(name) {
+		return
+	}
+
+	select {
+	case f.messages <- hmMessage:
+	default:
+		f.totalDroppedTSDBMessagesMetric.Inc()
+	}
+}
+
+func (f *TSDBForwarder) Close() {
+	close(f.done)
+}
+
+func (f *TSDBForwarder) Collect(ch chan<- prometheus.Metric) {
+	f.bufferedTSDBMessagesMetric.Set(float64(len(f.messages)))
+
+	f.totalForwardedTSDBMessagesMetric.Collect(ch)
+	f.totalDroppedTSDBMessagesMetric.Collect(ch)
+	f.totalForwardErrorsMetric.Collect(ch)
+	f.bufferedTSDBMessagesMetric.Collect(ch)
+}
+
+func (f *TSDBForwarder) Describe(ch chan<- *prometheus.Desc) {
+	f.totalForwardedTSDBMessagesMetric.Describe(ch)
+	f.totalDroppedTSDBMessagesMetric.Describe(ch)
+	f.totalForwardErrorsMetric.Describe(ch)
+	f.bufferedTSDBMessagesMetric.Describe(ch)
+}
+
+func (f *TSDBForwarder) run() {
+	backoff := tsdbForwarderMinBackoff
+	pending := ""
+
+	for {
+		conn, err := net.DialTimeout("tcp", f.target, tsdbForwarderDialTimeout)
+		if err == nil {
+			var written bool
+			pending, written, err = f.write(conn, pending)
+			conn.Close()
+			if err == nil {
+				return
+			}
+			log.Errorf("Error forwarding BOSH HM TSDB messages to `%s`: %v", f.target, err)
+			f.totalForwardErrorsMetric.Inc()
+
+			// Only trust the target again once it accepted a message, so a
+			// target closing every connection is not redialed in a tight loop.
+			if written {
+				backoff = tsdbForwarderMinBackoff
+				continue
+			}
+		} else {
+			log.Errorf("Error connecting to BOSH HM TSDB forward target `%s`: %v", f.target, err)
+			f.totalForwardErrorsMetric.Inc()
+		}
+
+		select {
+		case <-f.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > tsdbForwarderMaxBackoff {
+			backoff = tsdbForwarderMaxBackoff
+		}
+	}
+}
+
+func (f *TSDBForwarder) write(conn net.Conn, pending string) (string, bool, error) {
+	// Discard the target responses (e.g. OpenTSDB errors), noticing when it
+	// closes the connection.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	written := false
+	for {
+		if pending != "" {
+			conn.SetWriteDeadline(time.Now().Add(tsdbForwarderWriteTimeout))
+			if _, err := io.WriteString(conn, pending+"\n"); err != nil {
+				return pending, written, err
+			}
+			f.totalForwardedTSDBMessagesMetric.Inc()
+			written = true
+		}
+
+		select {
+		case <-f.done:
+			return "", written, nil
+		case <-closed:
+			return "", written, io.EOF
+		case pending = <-f.messages:
+		}
+	}
+}
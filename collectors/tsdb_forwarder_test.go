@@ -0,0 +1,321 @@
+package collectors_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/collectors"
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/utils/test_matchers"
+)
+
+var _ = Describe("TSDBForwarder", func() {
+	var (
+		err            error
+		namespace      string
+		environment    string
+		target         string
+		bufferSize     int
+		allow          string
+		deny           string
+		targetListener net.Listener
+		targetLines    chan string
+		tsdbForwarder  *TSDBForwarder
+
+		totalForwardedTSDBMessagesMetric prometheus.Counter
+		totalDroppedTSDBMessagesMetric   prometheus.Counter
+		totalForwardErrorsMetric         prometheus.Counter
+		bufferedTSDBMessagesMetric       prometheus.Gauge
+	)
+
+	BeforeEach(func() {
+		namespace = "test_exporter"
+		environment = "test_environment"
+		bufferSize = 100
+		allow = ""
+		deny = ""
+
+		targetListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		target = targetListener.Addr().String()
+
+		targetLines = serveTSDBTarget(targetListener)
+
+		constLabels := prometheus.Labels{
+			"environment": environment,
+			"target":      target,
+		}
+
+		totalForwardedTSDBMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "",
+				Name:        "forwarded_tsdb_messages_total",
+				Help:        "Total number of BOSH HM TSDB messages forwarded to the target.",
+				ConstLabels: constLabels,
+			},
+		)
+
+		totalDroppedTSDBMessagesMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "",
+				Name:        "dropped_forwarded_tsdb_messages_total",
+				Help:        "Total number of BOSH HM TSDB messages not forwarded to the target because its buffer was full.",
+				ConstLabels: constLabels,
+			},
+		)
+
+		totalForwardErrorsMetric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "",
+				Name:        "tsdb_forward_errors_total",
+				Help:        "Total number of errors connecting or writing to the BOSH HM TSDB forward target.",
+				ConstLabels: constLabels,
+			},
+		)
+
+		bufferedTSDBMessagesMetric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Subsystem:   "",
+				Name:        "buffered_forwarded_tsdb_messages",
+				Help:        "Number of BOSH HM TSDB messages waiting to be forwarded to the target.",
+				ConstLabels: constLabels,
+			},
+		)
+	})
+
+	AfterEach(func() {
+		targetListener.Close()
+		if tsdbForwarder != nil {
+			tsdbForwarder.Close()
+		}
+	})
+
+	JustBeforeEach(func() {
+		tsdbForwarder, err = NewTSDBForwarder(namespace, environment, target, bufferSize, allow, deny)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	collect := func() []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 100)
+		tsdbForwarder.Collect(ch)
+		close(ch)
+
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		return metrics
+	}
+
+	Describe("Describe", func() {
+		var descriptions chan *prometheus.Desc
+
+		JustBeforeEach(func() {
+			descriptions = make(chan *prometheus.Desc)
+			go tsdbForwarder.Describe(descriptions)
+		})
+
+		It("returns a forwarded_tsdb_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalForwardedTSDBMessagesMetric.Desc())))
+		})
+
+		It("returns a dropped_forwarded_tsdb_messages_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalDroppedTSDBMessagesMetric.Desc())))
+		})
+
+		It("returns a tsdb_forward_errors_total metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(totalForwardErrorsMetric.Desc())))
+		})
+
+		It("returns a buffered_forwarded_tsdb_messages metric description", func() {
+			Eventually(descriptions).Should(Receive(Equal(bufferedTSDBMessagesMetric.Desc())))
+		})
+	})
+
+	It("forwards the messages to the target", func() {
+		tsdbForwarder.Forward("system.healthy", "put system.healthy 1510000000 1 deployment=fake-deployment")
+		tsdbForwarder.Forward("system.load.1m", "put system.load.1m 1510000000 0.5 deployment=fake-deployment")
+
+		Eventually(targetLines).Should(Receive(Equal("put system.healthy 1510000000 1 deployment=fake-deployment")))
+		Eventually(targetLines).Should(Receive(Equal("put system.load.1m 1510000000 0.5 deployment=fake-deployment")))
+
+		totalForwardedTSDBMessagesMetric.Add(2)
+		Eventually(collect).Should(ContainElement(PrometheusMetric(totalForwardedTSDBMessagesMetric)))
+	})
+
+	It("forwards the consumed metrics as put messages tagged with their environment", func() {
+		tsdbForwarder.Consume(environment, HMMetric{
+			Name:      "system.healthy",
+			Value:     1,
+			Tags:      map[string]string{"job": "fake-job", "deployment": "fake-deployment"},
+			Timestamp: time.Unix(1510000000, 0),
+		})
+		tsdbForwarder.Consume(environment, HMMetric{
+			Name:      "system.load.1m",
+			Value:     0.5,
+			Timestamp: time.Unix(0, 1510000000250*int64(time.Millisecond)),
+		})
+		tsdbForwarder.Consume("other_environment", HMMetric{
+			Name:      "system.healthy",
+			Value:     0,
+			Tags:      map[string]string{"environment": "fake-environment"},
+			Timestamp: time.Unix(1510000000, 0),
+		})
+
+		Eventually(targetLines).Should(Receive(Equal("put system.healthy 1510000000 1 deployment=fake-deployment environment=test_environment job=fake-job")))
+		Eventually(targetLines).Should(Receive(Equal("put system.load.1m 1510000000250 0.5 environment=test_environment")))
+		Eventually(targetLines).Should(Receive(Equal("put system.healthy 1510000000 0 environment=other_environment")))
+	})
+
+	Context("when there are filters", func() {
+		BeforeEach(func() {
+			allow = `system\..*`
+			deny = `system\.load\..*`
+		})
+
+		It("only forwards the matching messages", func() {
+			tsdbForwarder.Forward("custom.metric", "put custom.metric 1510000000 1")
+			tsdbForwarder.Forward("system.load.1m", "put system.load.1m 1510000000 0.5")
+			tsdbForwarder.Forward("system.healthy", "put system.healthy 1510000000 1")
+
+			Eventually(targetLines).Should(Receive(Equal("put system.healthy 1510000000 1")))
+			Consistently(targetLines).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the target is not available", func() {
+		BeforeEach(func() {
+			bufferSize = 1
+			targetListener.Close()
+			totalDroppedTSDBMessagesMetric.Add(2)
+			bufferedTSDBMessagesMetric.Set(1)
+			totalForwardErrorsMetric.Inc()
+		})
+
+		It("buffers the messages and drops them once the buffer is full", func() {
+			for i := 0; i < 3; i++ {
+				tsdbForwarder.Forward("system.healthy", fmt.Sprintf("put system.healthy 151000000%d 1", i))
+			}
+
+			metrics := collect()
+			Expect(metrics).To(ContainElement(PrometheusMetric(totalDroppedTSDBMessagesMetric)))
+			Expect(metrics).To(ContainElement(PrometheusMetric(bufferedTSDBMessagesMetric)))
+		})
+
+		It("returns a tsdb_forward_errors_total metric", func() {
+			Eventually(collect).Should(ContainElement(PrometheusMetric(totalForwardErrorsMetric)))
+		})
+	})
+
+	Context("when the target closes every connection", func() {
+		var connections chan struct{}
+
+		BeforeEach(func() {
+			targetListener.Close()
+			targetListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			target = targetListener.Addr().String()
+
+			connections = make(chan struct{}, 100)
+			go func() {
+				for {
+					conn, err := targetListener.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+					connections <- struct{}{}
+				}
+			}()
+		})
+
+		It("keeps backing off before reconnecting", func() {
+			Eventually(connections).Should(Receive())
+			Eventually(connections, 2*time.Second).Should(Receive())
+			Consistently(connections, 1500*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the target is not valid", func() {
+		It("returns an error", func() {
+			_, err := NewTSDBForwarder(namespace, environment, "fake-target", bufferSize, allow, deny)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("HMTSDBListener with TSDBForwarders", func() {
+	var (
+		targetListener net.Listener
+		tsdbListener   net.Listener
+		hmMetricBus    *HMMetricBus
+		tsdbForwarder  *TSDBForwarder
+		targetLines    chan string
+	)
+
+	BeforeEach(func() {
+		var err error
+		targetListener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+
+		targetLines = serveTSDBTarget(targetListener)
+
+		tsdbForwarder, err = NewTSDBForwarder("test_exporter", "test_environment", targetListener.Addr().String(), 100, "", "")
+		Expect(err).ToNot(HaveOccurred())
+
+		hmMetricBus = NewHMMetricBus("test_exporter", "test_environment", 100)
+		hmMetricBus.Subscribe(tsdbForwarder)
+		_, _, tsdbListener = newTestHMTSDBListener("test_exporter", "test_environment", HMTSDBCollectorConfig{HMMetricBus: hmMetricBus}, HMTSDBListenerConfig{})
+	})
+
+	AfterEach(func() {
+		hmMetricBus.Close()
+		tsdbForwarder.Close()
+		tsdbListener.Close()
+		targetListener.Close()
+	})
+
+	It("forwards the valid put messages with their tags sorted", func() {
+		conn, err := net.Dial("tcp", tsdbListener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		timestamp := time.Now().Unix()
+		fmt.Fprint(conn, "put invalid.metric\n")
+		fmt.Fprint(conn, "version\n")
+		fmt.Fprintf(conn, "put system.load.1m %d 0.50 deployment=fake-deployment job=fake-job index=0 id=fake-id\n", timestamp)
+
+		Eventually(targetLines).Should(Receive(Equal(fmt.Sprintf("put system.load.1m %d 0.5 deployment=fake-deployment environment=test_environment id=fake-id index=0 job=fake-job", timestamp))))
+		Consistently(targetLines).ShouldNot(Receive())
+	})
+})
+
+// serveTSDBTarget accepts a connection on a fake BOSH HM TSDB forward target,
+// returning the lines it receives.
+func serveTSDBTarget(listener net.Listener) chan string {
+	lines := make(chan string, 100)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	return lines
+}
@@ -0,0 +1,423 @@
+package director
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxTaskResultLineSize = 1024 * 1024
+
+type Config struct {
+	URL              string
+	ClientID         string
+	ClientSecret     string
+	CACert           string
+	TaskPollInterval time.Duration
+	TaskTimeout      time.Duration
+}
+
+type Deployment struct {
+	Name string `json:"name"`
+}
+
+type VM struct {
+	Deployment string
+	AgentID    string
+	VMCID      string
+	JobName    string
+	Index      string
+	ID         string
+	AZ         string
+	IPs        []string
+	VMType     string
+	Stemcell   string
+}
+
+// Instance is an instance the BOSH Director expects for a deployment, whether
+// or not it currently has a VM.
+type Instance struct {
+	Deployment string
+	AgentID    string
+	VMCID      string
+	JobName    string
+	Index      string
+	ID         string
+	AZ         string
+	IPs        []string
+	ExpectsVM  bool
+}
+
+type Client interface {
+	Deployments() ([]Deployment, error)
+	VMs(deployment string) ([]VM, error)
+	Instances(deployment string) ([]Instance, error)
+}
+
+type client struct {
+	config     Config
+	httpClient *http.Client
+	tokenMutex sync.Mutex
+	auth       *authInfo
+	token      string
+	expiresAt  time.Time
+}
+
+type authInfo struct {
+	Type    string `json:"type"`
+	Options struct {
+		URL string `json:"url"`
+	} `json:"options"`
+}
+
+type infoResponse struct {
+	UserAuthentication authInfo `json:"user_authentication"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type taskResponse struct {
+	ID    int64  `json:"id"`
+	State string `json:"state"`
+}
+
+type vmResponse struct {
+	AgentID      string   `json:"agent_id"`
+	VMCID        string   `json:"vm_cid"`
+	JobName      string   `json:"job_name"`
+	Index        *int     `json:"index"`
+	ID           string   `json:"id"`
+	AZ           string   `json:"az"`
+	IPs          []string `json:"ips"`
+	VMType       string   `json:"vm_type"`
+	ResourcePool string   `json:"resource_pool"`
+	Stemcell     struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"stemcell"`
+}
+
+type instanceResponse struct {
+	AgentID   string   `json:"agent_id"`
+	CID       string   `json:"cid"`
+	Job       string   `json:"job"`
+	Index     *int     `json:"index"`
+	ID        string   `json:"id"`
+	AZ        string   `json:"az"`
+	IPs       []string `json:"ips"`
+	ExpectsVM *bool    `json:"expects_vm"`
+}
+
+func NewClient(config Config) (Client, error) {
+	if config.URL == "" {
+		return nil, errors.New("BOSH Director URL is required")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+
+	if config.TaskPollInterval <= 0 {
+		config.TaskPollInterval = time.Second
+	}
+	if config.TaskTimeout <= 0 {
+		config.TaskTimeout = 5 * time.Minute
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.CACert != "" {
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM([]byte(config.CACert)) {
+			return nil, errors.New("BOSH Director CA certificate cannot be parsed")
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	httpClient := &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+		// Task redirects are followed explicitly, so the credentials are not
+		// sent anywhere else.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &client{config: config, httpClient: httpClient}, nil
+}
+
+func (c *client) Deployments() ([]Deployment, error) {
+	deployments := []Deployment{}
+	if err := c.getJSON("/deployments", &deployments); err != nil {
+		return nil, err
+	}
+
+	return deployments, nil
+}
+
+// VMs returns the VMs of a deployment, fetched with a `format=full` task to
+// get their stemcell and VM type.
+func (c *client) VMs(deployment string) ([]VM, error) {
+	resp, err := c.get("/deployments/" + url.PathEscape(deployment) + "/vms?format=full")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("BOSH Director returned %s for the VMs of deployment `%s`", resp.Status, deployment)
+	}
+
+	taskID, err := taskIDFromLocation(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.waitForTask(taskID); err != nil {
+		return nil, err
+	}
+
+	output, err := c.getBody(fmt.Sprintf("/tasks/%d/output?type=result", taskID))
+	if err != nil {
+		return nil, err
+	}
+
+	vms := []VM{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), maxTaskResultLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		vmResp := vmResponse{}
+		if err := json.Unmarshal(line, &vmResp); err != nil {
+			return nil, fmt.Errorf("BOSH Director task %d result cannot be parsed: %v", taskID, err)
+		}
+		vms = append(vms, newVM(deployment, vmResp))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return vms, nil
+}
+
+// Instances returns the instances of a deployment.
+func (c *client) Instances(deployment string) ([]Instance, error) {
+	instancesResp := []instanceResponse{}
+	if err := c.getJSON("/deployments/"+url.PathEscape(deployment)+"/instances", &instancesResp); err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0, len(instancesResp))
+	for _, instanceResp := range instancesResp {
+		instance := Instance{
+			Deployment: deployment,
+			AgentID:    instanceResp.AgentID,
+			VMCID:      instanceResp.CID,
+			JobName:    instanceResp.Job,
+			ID:         instanceResp.ID,
+			AZ:         instanceResp.AZ,
+			IPs:        instanceResp.IPs,
+			ExpectsVM:  instanceResp.ExpectsVM == nil || *instanceResp.ExpectsVM,
+		}
+		if instanceResp.Index != nil {
+			instance.Index = strconv.Itoa(*instanceResp.Index)
+		}
+		instances = append(instances, instance)
+	}
+
+	return instances, nil
+}
+
+func newVM(deployment string, vmResp vmResponse) VM {
+	vm := VM{
+		Deployment: deployment,
+		AgentID:    vmResp.AgentID,
+		VMCID:      vmResp.VMCID,
+		JobName:    vmResp.JobName,
+		ID:         vmResp.ID,
+		AZ:         vmResp.AZ,
+		IPs:        vmResp.IPs,
+		VMType:     vmResp.VMType,
+	}
+	if vmResp.Index != nil {
+		vm.Index = strconv.Itoa(*vmResp.Index)
+	}
+	if vm.VMType == "" {
+		vm.VMType = vmResp.ResourcePool
+	}
+	if vmResp.Stemcell.Name != "" {
+		vm.Stemcell = vmResp.Stemcell.Name + "/" + vmResp.Stemcell.Version
+	}
+
+	return vm
+}
+
+func taskIDFromLocation(location string) (int64, error) {
+	locationURL, err := url.Parse(location)
+	if err != nil {
+		return 0, fmt.Errorf("BOSH Director task location `%s` cannot be parsed: %v", location, err)
+	}
+
+	parts := strings.Split(strings.TrimSuffix(locationURL.Path, "/"), "/")
+	if len(parts) < 2 || parts[len(parts)-2] != "tasks" {
+		return 0, fmt.Errorf("BOSH Director task location `%s` is not a task", location)
+	}
+
+	return strconv.ParseInt(parts[len(parts)-1], 10, 64)
+}
+
+func (c *client) waitForTask(taskID int64) error {
+	deadline := time.Now().Add(c.config.TaskTimeout)
+	for {
+		task := taskResponse{}
+		if err := c.getJSON(fmt.Sprintf("/tasks/%d", taskID), &task); err != nil {
+			return err
+		}
+
+		switch task.State {
+		case "done":
+			return nil
+		case "queued", "processing", "cancelling":
+		default:
+			return fmt.Errorf("BOSH Director task %d finished with state `%s`", taskID, task.State)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("BOSH Director task %d did not finish within %v", taskID, c.config.TaskTimeout)
+		}
+		time.Sleep(c.config.TaskPollInterval)
+	}
+}
+
+func (c *client) getJSON(path string, v interface{}) error {
+	body, err := c.getBody(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("BOSH Director response for `%s` cannot be parsed: %v", path, err)
+	}
+
+	return nil
+}
+
+func (c *client) getBody(path string) ([]byte, error) {
+	resp, err := c.get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("BOSH Director returned %s for `%s`", resp.Status, path)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *client) get(path string) (*http.Response, error) {
+	authorization, err := c.authorization()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", c.config.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+
+	return c.httpClient.Do(req)
+}
+
+func (c *client) authorization() (string, error) {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	if c.auth == nil {
+		info := infoResponse{}
+		resp, err := c.httpClient.Get(c.config.URL + "/info")
+		if err != nil {
+			return "", err
+		}
+		err = decodeJSONResponse(resp, &info)
+		if err != nil {
+			return "", fmt.Errorf("BOSH Director info cannot be fetched: %v", err)
+		}
+		c.auth = &info.UserAuthentication
+	}
+
+	if c.auth.Type != "uaa" {
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(c.config.ClientID, c.config.ClientSecret)
+		return req.Header.Get("Authorization"), nil
+	}
+
+	if c.token != "" && time.Now().Before(c.expiresAt) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.auth.Options.URL, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.config.ClientID), url.QueryEscape(c.config.ClientSecret))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	token := tokenResponse{}
+	if err := decodeJSONResponse(resp, &token); err != nil {
+		return "", fmt.Errorf("UAA token cannot be fetched: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("UAA token cannot be fetched: empty access token")
+	}
+
+	tokenType := token.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	c.token = tokenType + " " + token.AccessToken
+	// Renew the token a bit before it expires.
+	c.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 30*time.Second)
+
+	return c.token, nil
+}
+
+func decodeJSONResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,260 @@
+package director_test
+
+import (
+	"encoding/pem"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	. "github.com/bosh-prometheus/bosh_tsdb_exporter/director"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		err          error
+		server       *ghttp.Server
+		config       Config
+		client       Client
+		authType     string
+		tokenCount   int
+		taskPolls    int
+		clientID     = "fake-client-id"
+		clientSecret = "fake-client-secret"
+		accessToken  = "fake-access-token"
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewTLSServer()
+		authType = "uaa"
+		tokenCount = 0
+		taskPolls = 0
+
+		server.RouteToHandler("GET", "/info", func(w http.ResponseWriter, r *http.Request) {
+			ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"user_authentication": map[string]interface{}{
+					"type":    authType,
+					"options": map[string]string{"url": server.URL()},
+				},
+			})(w, r)
+		})
+		server.RouteToHandler("POST", "/oauth/token", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth(clientID, clientSecret),
+			ghttp.VerifyFormKV("grant_type", "client_credentials"),
+			func(w http.ResponseWriter, r *http.Request) {
+				tokenCount++
+			},
+			ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{
+				"access_token": accessToken,
+				"token_type":   "bearer",
+				"expires_in":   3600,
+			}),
+		))
+
+		config = Config{
+			URL:              server.URL(),
+			ClientID:         clientID,
+			ClientSecret:     clientSecret,
+			CACert:           string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.HTTPTestServer.Certificate().Raw})),
+			TaskPollInterval: time.Millisecond,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	JustBeforeEach(func() {
+		client, err = NewClient(config)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("NewClient", func() {
+		It("returns an error when the URL is missing", func() {
+			_, err := NewClient(Config{})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error when the CA certificate is not valid", func() {
+			_, err := NewClient(Config{URL: server.URL(), CACert: "fake-ca-cert"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Deployments", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/deployments", ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("Authorization", "Bearer "+accessToken),
+				ghttp.RespondWith(http.StatusOK, `[{"name":"fake-deployment-1"},{"name":"fake-deployment-2"}]`),
+			))
+		})
+
+		It("returns the deployments", func() {
+			deployments, err := client.Deployments()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deployments).To(Equal([]Deployment{{Name: "fake-deployment-1"}, {Name: "fake-deployment-2"}}))
+		})
+
+		It("reuses the UAA token", func() {
+			_, err := client.Deployments()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = client.Deployments()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tokenCount).To(Equal(1))
+		})
+
+		Context("when the BOSH Director uses basic auth", func() {
+			BeforeEach(func() {
+				authType = "basic"
+				server.RouteToHandler("GET", "/deployments", ghttp.CombineHandlers(
+					ghttp.VerifyBasicAuth(clientID, clientSecret),
+					ghttp.RespondWith(http.StatusOK, `[]`),
+				))
+			})
+
+			It("uses the client credentials as basic auth", func() {
+				_, err := client.Deployments()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tokenCount).To(Equal(0))
+			})
+		})
+
+		Context("when the CA certificate does not match", func() {
+			BeforeEach(func() {
+				config.CACert = ""
+			})
+
+			It("returns an error", func() {
+				_, err := client.Deployments()
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when the BOSH Director returns an error", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/deployments", ghttp.RespondWith(http.StatusUnauthorized, ""))
+			})
+
+			It("returns an error", func() {
+				_, err := client.Deployments()
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("VMs", func() {
+		var taskState string
+
+		BeforeEach(func() {
+			taskState = "done"
+			server.RouteToHandler("GET", "/deployments/fake-deployment/vms", ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/deployments/fake-deployment/vms", "format=full"),
+				ghttp.VerifyHeaderKV("Authorization", "Bearer "+accessToken),
+				ghttp.RespondWith(http.StatusFound, "", http.Header{"Location": {server.URL() + "/tasks/42"}}),
+			))
+			server.RouteToHandler("GET", "/tasks/42", func(w http.ResponseWriter, r *http.Request) {
+				taskPolls++
+				state := taskState
+				if taskPolls == 1 && taskState == "done" {
+					state = "processing"
+				}
+				ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]interface{}{"id": 42, "state": state})(w, r)
+			})
+			server.RouteToHandler("GET", "/tasks/42/output", ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/tasks/42/output", "type=result"),
+				ghttp.RespondWith(http.StatusOK, `{"agent_id":"fake-agent-id","vm_cid":"fake-vm-cid","job_name":"fake-job","index":0,"id":"fake-id","az":"z1","ips":["10.0.0.1","10.0.1.1"],"vm_type":"small","stemcell":{"name":"fake-stemcell","version":"3468.21"}}
+{"agent_id":"fake-agent-id-2","vm_cid":"fake-vm-cid-2","job_name":"fake-job","index":null,"id":"fake-id-2","az":"z2","ips":["10.0.0.2"],"vm_type":"","resource_pool":"medium"}
+`),
+			))
+		})
+
+		It("returns the VMs once the task is done", func() {
+			vms, err := client.VMs("fake-deployment")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(taskPolls).To(Equal(2))
+			Expect(vms).To(Equal([]VM{
+				{
+					Deployment: "fake-deployment",
+					AgentID:    "fake-agent-id",
+					VMCID:      "fake-vm-cid",
+					JobName:    "fake-job",
+					Index:      "0",
+					ID:         "fake-id",
+					AZ:         "z1",
+					IPs:        []string{"10.0.0.1", "10.0.1.1"},
+					VMType:     "small",
+					Stemcell:   "fake-stemcell/3468.21",
+				},
+				{
+					Deployment: "fake-deployment",
+					AgentID:    "fake-agent-id-2",
+					VMCID:      "fake-vm-cid-2",
+					JobName:    "fake-job",
+					ID:         "fake-id-2",
+					AZ:         "z2",
+					IPs:        []string{"10.0.0.2"},
+					VMType:     "medium",
+				},
+			}))
+		})
+
+		Context("when the task fails", func() {
+			BeforeEach(func() {
+				taskState = "error"
+			})
+
+			It("returns an error", func() {
+				_, err := client.VMs("fake-deployment")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+	Describe("Instances", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/deployments/fake-deployment/instances", ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("Authorization", "Bearer "+accessToken),
+				ghttp.RespondWith(http.StatusOK, `[{"agent_id":"fake-agent-id","cid":"fake-vm-cid","job":"fake-job","index":0,"id":"fake-id","az":"z1","ips":["10.0.0.1"],"expects_vm":true},{"agent_id":"","cid":null,"job":"fake-errand","index":0,"id":"fake-id-2","az":"z1","ips":[],"expects_vm":false}]`),
+			))
+		})
+
+		It("returns the instances", func() {
+			instances, err := client.Instances("fake-deployment")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instances).To(Equal([]Instance{
+				{
+					Deployment: "fake-deployment",
+					AgentID:    "fake-agent-id",
+					VMCID:      "fake-vm-cid",
+					JobName:    "fake-job",
+					Index:      "0",
+					ID:         "fake-id",
+					AZ:         "z1",
+					IPs:        []string{"10.0.0.1"},
+					ExpectsVM:  true,
+				},
+				{
+					Deployment: "fake-deployment",
+					JobName:    "fake-errand",
+					Index:      "0",
+					ID:         "fake-id-2",
+					AZ:         "z1",
+					IPs:        []string{},
+					ExpectsVM:  false,
+				},
+			}))
+		})
+
+		Context("when the BOSH Director returns an error", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/deployments/fake-deployment/instances", ghttp.RespondWith(http.StatusNotFound, ""))
+			})
+
+			It("returns an error", func() {
+				_, err := client.Instances("fake-deployment")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+})